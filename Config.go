@@ -31,6 +31,11 @@ type ConfigTop struct {
 
 	// Snapshot specifies that that the container should be snapshoted with this name at the end of the configuration process.
 	Snapshot string `yaml:"snapshot"`
+
+	// DependsOn is a list of instances that should be processed before this instance,
+	// when they are processed by the same command.
+	// An instance also depends on the instances of its origin, device-template, device-origin, and source-config.
+	DependsOn []string `yaml:"depends-on,omitempty"`
 }
 
 type ConfigInherit struct {
@@ -93,6 +98,9 @@ type ConfigInherit struct {
 
 	CloudConfigFiles []HostPath `yaml:"cloud-config-files"`
 
+	// Retention specifies which snapshots to keep, when pruning snapshots with "snapshot prune"
+	Retention *Retention `yaml:"retention,omitempty"`
+
 	/*
 		// PreScripts are scripts that are executed early, before packages, users, files, or Scripts
 		PreScripts []*Script `yaml:"pre-scripts,omitempty"`
@@ -113,7 +121,7 @@ type ConfigInherit struct {
 
 // Source specifies how to copy or clone the instance container, filesystem, and device directories.
 // When DeviceTemplate is specified, the filesystems are copied with rsync.
-// When DeviceOrigin is specified, the filesystems are cloned with zfs-clone
+// When DeviceOrigin is specified, the filesystems are cloned with zfs-clone, or btrfs subvolume snapshot
 // The filesystems that are copied are determined by applying the source instance name to the filesystems of this config,
 // or to the filesystems of a source config.
 //
@@ -150,7 +158,7 @@ type Source struct {
 	// device-origin is the name an instance and a short snapshot name.
 	// It has the form <instance>@<snapshot> where <instance> is an instance name,
 	// and @<snapshot> is a the short snapshot name of the instance filesystems.
-	// Each device zfs filesystem is cloned from @<snapshot>
+	// Each device zfs filesystem or btrfs subvolume is cloned from @<snapshot>
 	// The filesytems are those specified in SourceConfig, if any, otherwise this config.
 	DeviceOrigin Pattern `yaml:"device-origin"`
 
@@ -163,6 +171,22 @@ type Source struct {
 	SourceConfig HostPath `yaml:"source-config,omitempty"`
 }
 
+// Retention specifies which timestamped snapshots to keep.
+// Only snapshots whose names are UTC timestamps, as in the default snapshot name (YYYYMMDDhhmmss), are pruned.
+// Other snapshots, such as snapshots that are used as a device-origin, are always kept.
+// A snapshot is kept if any of the rules keeps it.
+// The Hourly, Daily, Weekly, and Monthly rules keep the latest snapshot of each of the latest N hours, days, weeks, or months
+// that have snapshots.
+type Retention struct {
+	Hourly  int `yaml:"hourly,omitempty"`
+	Daily   int `yaml:"daily,omitempty"`
+	Weekly  int `yaml:"weekly,omitempty"`
+	Monthly int `yaml:"monthly,omitempty"`
+	// MaxAge keeps all snapshots that are newer than MaxAge.
+	// It is a Go duration (e.g. 36h), or a number of days (e.g. 14d) or weeks (e.g. 4w)
+	MaxAge string `yaml:"max-age,omitempty"`
+}
+
 // OS specifies the container OS
 type OS struct {
 	// Name if the name of the container image, without the version number.
@@ -180,13 +204,28 @@ type OS struct {
 	Version Pattern `yaml:"version"`
 }
 
-// Filesystem is a ZFS filesystem or a plain directory that is created when an instance is created
+// Filesystem is a ZFS filesystem, a btrfs subvolume, a plain directory, or an LXD custom storage volume
+// that is created when an instance is created
 // The disk devices of an instance are created as subdirectories of a Filesystem
 type Filesystem struct {
-	// Pattern is a pattern that is used to produce the directory or zfs filesystem
-	// If the pattern begins with '/', it is a directory
-	// If it does not begin with '/', it is a zfs filesystem name
+	// Pattern is a pattern that is used to produce the directory, zfs filesystem, btrfs subvolume, or volume name
+	// If Type is empty and the pattern begins with '/', it is a directory
+	// If Type is empty and it does not begin with '/', it is a zfs filesystem name
+	// For a btrfs subvolume, it is the absolute path of the subvolume.
+	// For a volume, it is the name of the custom volume in Pool.
 	Pattern Pattern
+	// Type is the filesystem type: zfs, dir, btrfs, or volume.
+	// If empty, the type is determined from the Pool and the Pattern.
+	// btrfs snapshots are created next to their subvolume, as <subvolume>@<snapshot>
+	// volume filesystems are LXD custom storage volumes.  They are created, copied, snapshotted, and deleted
+	// through the LXD API, so they do not require access to the LXD host.
+	// A volume is attached as a whole, so the devices of a volume filesystem must have Dir "" or "."
+	Type string `yaml:"type,omitempty"`
+	// Pool is the LXD storage pool of a volume filesystem.
+	// Specifying a Pool implies type volume.
+	Pool Pattern `yaml:"pool,omitempty"`
+	// VolumeConfig is the LXD configuration of a new volume, for example size.
+	VolumeConfig map[string]string `yaml:"volume-config,omitempty"`
 	// Zfsproperties is a list of properties that are set when a zfs filesystem is created or cloned
 	Zfsproperties map[string]string `yaml:""`
 	// Destroy allows lxdops destroy the filesystem when requested.
@@ -195,9 +234,34 @@ type Filesystem struct {
 	Transient bool `yaml:"transient"`
 }
 
-// A Device is an LXD disk device that is attached to the instance profile, which in turn is attached to a container
+// Device is a device of the instance profile.
+// A disk device is a directory in an instance filesystem.
+// Other devices, such as proxy, nic, or unix-char devices, are specified by their LXD device keys, in Config.
+//
+// Example:
+//
+//	devices:
+//	  home:
+//	    path: /home
+//	    filesystem: default
+//	  http:
+//	    type: proxy
+//	    config:
+//	      listen: tcp:0.0.0.0:(http-port)
+//	      connect: tcp:127.0.0.1:80
+//	  eth0:
+//	    type: nic
+//	    config:
+//	      network: lxdbr0
+//	      hwaddr: (hwaddr)
+//	      ipv4.address: (address)
 type Device struct {
-	// Path is the device "path" in the LXD disk device
+	// Type is the LXD device type.  It defaults to disk.
+	Type string `yaml:"type,omitempty"`
+
+	// Path is the device "path" in the LXD disk device.
+	// For other devices, it is the "path" key, if it is not empty.  Such a device cannot also have a "path" key in Config.
+	// Path goes through pattern substitution.
 	Path string
 
 	// Filesystem is the Filesystem Id that this device belongs to
@@ -210,6 +274,19 @@ type Device struct {
 	// Dir goes through pattern substitution, using parenthesized tokens, for example (instance)
 	// Dir may be absolute, but this is no longer necessary now that filesystems are specified, since one can define the "/" filesystem.
 	Dir Pattern `yaml:""`
+
+	// Config has additional LXD device keys, such as readonly for a disk device, or listen and connect for a proxy device.
+	// Each value goes through pattern substitution.
+	// For disk devices, it cannot have the keys that lxdops sets: path, source, and pool.
+	Config map[string]Pattern `yaml:"config,omitempty"`
+}
+
+// DeviceDisk is the default device type
+const DeviceDisk = "disk"
+
+// IsDisk returns true if the device is a disk device, whose source is in an instance filesystem.
+func (t *Device) IsDisk() bool {
+	return t.Type == "" || t.Type == DeviceDisk
 }
 
 // File specifies a file that is copied from the host to the container
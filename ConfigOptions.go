@@ -57,6 +57,11 @@ func (t *ConfigOptions) UpdateConfig(config *Config) {
 }
 
 func (t *ConfigOptions) ReadConfig(file string) (*Config, error) {
+	return t.readConfig(file, nil)
+}
+
+// readConfig reads a config file, and applies update, if it is not nil, before applying the command line options.
+func (t *ConfigOptions) readConfig(file string, update func(config *Config)) (*Config, error) {
 	err := t.initProperties()
 	if err != nil {
 		return nil, err
@@ -70,6 +75,9 @@ func (t *ConfigOptions) ReadConfig(file string) (*Config, error) {
 	if !config.Verify() {
 		return nil, errors.New("invalid config")
 	}
+	if update != nil {
+		update(config)
+	}
 	t.UpdateConfig(config)
 	return config, nil
 }
@@ -102,18 +110,62 @@ func (t *ConfigOptions) Instance2(file string, includeSource bool) (*Instance, e
 	return t.instance2(file, includeSource)
 }
 
-func (t *ConfigOptions) RunInstances(f func(*Instance) error, includeSource bool, args ...string) error {
+// InstanceList returns the instances of several config or stack files
+func (t *ConfigOptions) InstanceList(includeSource bool, args ...string) ([]*Instance, error) {
+	instances, _, err := t.instanceList(includeSource, args...)
+	return instances, err
+}
+
+func (t *ConfigOptions) instanceList(includeSource bool, args ...string) ([]*Instance, []*instanceArg, error) {
 	if t.Name != "" && len(args) != 1 {
-		return errors.New("--name can be used with only one config file")
+		return nil, nil, errors.New("--name can be used with only one config file")
 	}
-	for _, arg := range args {
-		instance, err := t.Instance2(arg, includeSource)
+	list, err := t.instanceArgs(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	instances := make([]*Instance, len(list))
+	for i, arg := range list {
+		instance, err := t.argInstance(arg, includeSource)
 		if err != nil {
-			return err
+			return nil, nil, fmt.Errorf("%s: %w", arg.Label, err)
 		}
-		err = f(instance)
+		instances[i] = instance
+	}
+	return instances, list, nil
+}
+
+// RunInstances calls f for the instance of each config file, in dependency order.
+// It stops at the first error.
+func (t *ConfigOptions) RunInstances(f func(*Instance) error, includeSource bool, args ...string) error {
+	return t.runInstances(f, includeSource, false, args...)
+}
+
+// runInstances calls f for the instance of each config file, in dependency order, or in reverse dependency order.
+func (t *ConfigOptions) runInstances(f func(*Instance) error, includeSource bool, reverse bool, args ...string) error {
+	instances, list, err := t.instanceList(includeSource, args...)
+	if err != nil {
+		return err
+	}
+	deps, err := dependencies(instances)
+	if err != nil {
+		return err
+	}
+	if reverse {
+		deps = reverseDependencies(deps)
+	}
+	labels := make([]string, len(list))
+	for i, arg := range list {
+		labels[i] = arg.Label
+	}
+	order, err := dependencyOrder(deps, labels)
+	if err != nil {
+		return err
+	}
+	for _, i := range order {
+		err = f(instances[i])
 		if err != nil {
-			return fmt.Errorf("%s: %w", arg, err)
+			return fmt.Errorf("%s: %w", labels[i], err)
 		}
 	}
 	return nil
@@ -124,3 +176,10 @@ func (t *ConfigOptions) InstanceFunc(f func(*Instance) error, includeSource bool
 		return t.RunInstances(f, includeSource, configs...)
 	}
 }
+
+// ReverseInstanceFunc is like InstanceFunc, but it processes each instance before the instances that it depends on.
+func (t *ConfigOptions) ReverseInstanceFunc(f func(*Instance) error, includeSource bool) func(configs []string) error {
+	return func(configs []string) error {
+		return t.runInstances(f, includeSource, true, configs...)
+	}
+}
@@ -35,3 +35,21 @@ func PrintConfigYaml(config *Config) error {
 	fmt.Println(string(data))
 	return nil
 }
+
+// MarshalConfigYaml returns a config in the format of PrintConfigYaml
+func MarshalConfigYaml(config *Config) ([]byte, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(Comment + "\n" + string(data)), nil
+}
+
+// WriteConfigYaml writes a config to a file, in the format of PrintConfigYaml
+func WriteConfigYaml(config *Config, file string) error {
+	data, err := MarshalConfigYaml(config)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
@@ -12,6 +12,7 @@ import (
 type Configurer struct {
 	Client *lxdutil.LxdClient `name:"-"`
 	ConfigOptions
+	JobOptions
 	Trace  bool `name:"trace,t" usage:"print exec arguments"`
 	DryRun bool `name:"dry-run" usage:"show the commands to run, but do not change anything"`
 }
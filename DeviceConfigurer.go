@@ -4,11 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/canonical/lxd/shared/api"
 	"melato.org/lxdops/lxdutil"
 	"melato.org/lxdops/util"
-	"melato.org/script"
 )
 
 type DeviceConfigurer struct {
@@ -18,6 +18,10 @@ type DeviceConfigurer struct {
 	NoRsync bool
 	Trace   bool
 	DryRun  bool
+	// Host runs host commands.  If nil, a ScriptRunner is used.
+	Host HostRunner
+	// Client is used for volume filesystems
+	Client *lxdutil.LxdClient
 }
 
 func NewDeviceConfigurer(instance *Instance) (*DeviceConfigurer, error) {
@@ -30,35 +34,154 @@ func NewDeviceConfigurer(instance *Instance) (*DeviceConfigurer, error) {
 	return t, nil
 }
 
-func (t *DeviceConfigurer) NewScript() *script.Script {
-	return &script.Script{Trace: t.Trace, DryRun: t.DryRun}
+func (t *DeviceConfigurer) host() HostRunner {
+	if t.Host == nil {
+		return &ScriptRunner{Trace: t.Trace, DryRun: t.DryRun}
+	}
+	return t.Host
+}
+
+func (t *DeviceConfigurer) volumeOps(project string) (*VolumeOps, error) {
+	volumes, err := NewVolumeOps(t.Client, project)
+	if err != nil {
+		return nil, err
+	}
+	volumes.Trace = t.Trace
+	volumes.DryRun = t.DryRun
+	return volumes, nil
 }
 
-func (t *DeviceConfigurer) chownDir(scr *script.Script, dir string) {
-	//scr.Run("sudo", "chown", "1000000:1000000", dir)
+func (t *DeviceConfigurer) chownDir(dir string) error {
+	//"sudo", "chown", "1000000:1000000", dir
 	if t.Owner != "" {
-		scr.Run("sudo", "chown", t.Owner, dir)
+		return t.host().Run("sudo", "chown", t.Owner, dir)
 	}
+	return nil
 }
 
 func (t *DeviceConfigurer) CreateDir(dir string, chown bool) error {
 	if !util.DirExists(dir) {
-		script := t.NewScript()
-		script.Run("sudo", "mkdir", "-p", dir)
+		err := t.host().Run("sudo", "mkdir", "-p", dir)
 		//err = os.Mkdir(dir, 0755)
+		if err != nil {
+			return err
+		}
 		if chown {
-			t.chownDir(script, dir)
+			return t.chownDir(dir)
+		}
+	}
+	return nil
+}
+
+func (t *DeviceConfigurer) createBtrfs(fs *InstanceFS, originSnapshot string) error {
+	dir := fs.Dir()
+	parent := filepath.Dir(dir)
+	if !util.DirExists(parent) {
+		err := t.host().Run("sudo", "mkdir", "-p", parent)
+		if err != nil {
+			return err
+		}
+	}
+	if originSnapshot != "" {
+		if util.DirExists(dir) {
+			// a nested subvolume appears as an empty directory in the snapshot of its parent
+			err := t.host().Run("sudo", "rmdir", dir)
+			if err != nil {
+				return err
+			}
+		}
+		err := t.host().Run("sudo", "btrfs", "subvolume", "snapshot", originSnapshot, dir)
+		if err != nil {
+			return err
+		}
+		fs.IsNew = true
+		return nil
+	}
+	err := t.host().Run("sudo", "btrfs", "subvolume", "create", dir)
+	if err != nil {
+		return err
+	}
+	fs.IsNew = true
+	return t.chownDir(dir)
+}
+
+// createVolume creates a volume filesystem, if it does not exist,
+// or copies it from a snapshot of the origin volume, if originFS is not nil.
+func (t *DeviceConfigurer) createVolume(fs *InstanceFS, origin *Instance, originFS *InstanceFS, snapshot string) error {
+	volumes, err := t.volumeOps(t.Config.Project)
+	if err != nil {
+		return err
+	}
+	if originFS != nil {
+		originVolumes, err := t.volumeOps(origin.Config.Project)
+		if err != nil {
+			return err
+		}
+		return volumes.Copy(fs, originVolumes.Server, originFS, snapshot)
+	}
+	exists, err := volumes.Exists(fs)
+	if err != nil || exists {
+		return err
+	}
+	fs.IsNew = true
+	return volumes.Create(fs)
+}
+
+// copyVolumes copies the non-transient volumes of the template instance that the instance does not have.
+func (t *DeviceConfigurer) copyVolumes(instance, template *Instance) error {
+	volumes, err := instance.VolumeList()
+	if err != nil || len(volumes) == 0 {
+		return err
+	}
+	templateFilesystems, err := template.Filesystems()
+	if err != nil {
+		return err
+	}
+	ops, err := t.volumeOps(t.Config.Project)
+	if err != nil {
+		return err
+	}
+	templateOps, err := t.volumeOps(template.Config.Project)
+	if err != nil {
+		return err
+	}
+	for _, fs := range volumes {
+		templateFS, exists := templateFilesystems[fs.Id]
+		if fs.Filesystem.Transient || !exists || !templateFS.IsVolume() {
+			continue
+		}
+		volumeExists, err := ops.Exists(fs)
+		if err != nil {
+			return err
+		}
+		if volumeExists {
+			continue
+		}
+		templateExists, err := templateOps.Exists(templateFS)
+		if err != nil {
+			return err
+		}
+		if !templateExists {
+			fmt.Printf("skipping missing template volume %s\n", templateFS.VolumeName())
+			continue
+		}
+		err = ops.Copy(fs, templateOps.Server, templateFS, "")
+		if err != nil {
+			return err
 		}
-		return script.Error()
 	}
 	return nil
 }
 
+// CreateFilesystem creates a filesystem, or clones it from originDataset, which is a zfs or btrfs snapshot.
 func (t *DeviceConfigurer) CreateFilesystem(fs *InstanceFS, originDataset string) error {
 	if fs.IsDir() {
 		fs.IsNew = true
 		return t.CreateDir(fs.Dir(), true)
 	}
+	if fs.IsBtrfs() {
+		return t.createBtrfs(fs, originDataset)
+	}
 
 	var args []string
 	if originDataset != "" {
@@ -77,13 +200,15 @@ func (t *DeviceConfigurer) CreateFilesystem(fs *InstanceFS, originDataset string
 		args = append(args, originDataset)
 	}
 	args = append(args, fs.Path)
-	s := t.NewScript()
-	s.Run("sudo", args...)
+	err := t.host().Run("sudo", args...)
+	if err != nil {
+		return err
+	}
+	fs.IsNew = true
 	if originDataset == "" {
-		t.chownDir(s, fs.Dir())
-		fs.IsNew = true
+		return t.chownDir(fs.Dir())
 	}
-	return s.Error()
+	return nil
 }
 
 func (t *DeviceConfigurer) CreateFilesystems(instance, origin *Instance, snapshot string) error {
@@ -98,26 +223,35 @@ func (t *DeviceConfigurer) CreateFilesystems(instance, origin *Instance, snapsho
 			return err
 		}
 		for id, path := range paths {
-			if !path.IsZfs() {
-				return errors.New("cannot use origin with non-zfs filesystem: " + id)
+			if !path.IsSnapshotable() {
+				return errors.New("cannot use origin with non-zfs or btrfs filesystem: " + id)
+			}
+			originPath, exists := originPaths[id]
+			if exists && originPath.Type() != path.Type() {
+				return fmt.Errorf("filesystem %s: cannot clone %s from %s", id, path.Type(), originPath.Type())
 			}
 		}
 	}
 	var pathList []*InstanceFS
 	for _, path := range paths {
-		if origin != nil || !util.DirExists(path.Dir()) {
+		if path.IsVolume() || origin != nil || !util.DirExists(path.Dir()) {
 			pathList = append(pathList, path)
 		}
 	}
 	InstanceFSList(pathList).Sort()
 
 	for _, path := range pathList {
-		var originDataset string
-		if path.IsZfs() {
-			originPath, exists := originPaths[path.Id]
-			if exists {
-				originDataset = originPath.Path + "@" + snapshot
+		originPath := originPaths[path.Id]
+		if path.IsVolume() {
+			err := t.createVolume(path, origin, originPath, snapshot)
+			if err != nil {
+				return err
 			}
+			continue
+		}
+		var originDataset string
+		if originPath != nil {
+			originDataset = originPath.SnapshotPath(snapshot)
 		}
 		err := t.CreateFilesystem(path, originDataset)
 		if err != nil {
@@ -133,19 +267,44 @@ func (t *DeviceConfigurer) ConfigureDevices(instance *Instance) error {
 	if source.IsDefined() && source.Clone {
 		err = t.CreateFilesystems(instance, source.Instance, source.Snapshot)
 	} else {
+		if !t.NoRsync && source.IsDefined() {
+			// volumes cannot be copied with rsync, so copy them whole, before creating the missing ones
+			err = t.copyVolumes(instance, source.Instance)
+			if err != nil {
+				return err
+			}
+		}
 		err = t.CreateFilesystems(instance, nil, "")
 	}
 	if err != nil {
 		return err
 	}
+	return t.createDeviceDirs(instance, source)
+}
+
+// CreateMissingDevices creates the filesystems and device directories of an instance that do not exist,
+// without cloning or copying anything from the device source.
+func (t *DeviceConfigurer) CreateMissingDevices(instance *Instance) error {
+	err := t.CreateFilesystems(instance, nil, "")
+	if err != nil {
+		return err
+	}
+	return t.createDeviceDirs(instance, &DeviceSource{})
+}
+
+// createDeviceDirs creates the missing device directories,
+// and copies them from the device source, if it is defined and it is not cloned.
+func (t *DeviceConfigurer) createDeviceDirs(instance *Instance, source *DeviceSource) error {
 	filesystems, err := instance.Filesystems()
 	if err != nil {
 		return err
 	}
 
-	script := t.NewScript()
 	devices := SortDevices(t.Config.Devices)
 	for _, d := range devices {
+		if !d.Device.IsDisk() {
+			continue
+		}
 		dir, err := instance.DeviceDir(d.Name, d.Device)
 		if err != nil {
 			return err
@@ -155,6 +314,10 @@ func (t *DeviceConfigurer) ConfigureDevices(instance *Instance) error {
 			fmt.Fprintf(os.Stderr, "missing filesystem: %s\n", d.Device.Filesystem)
 			continue
 		}
+		if fs.IsVolume() {
+			// the device is the whole volume
+			continue
+		}
 		if !fs.IsNew && util.DirExists(dir) {
 			continue
 		}
@@ -168,14 +331,14 @@ func (t *DeviceConfigurer) ConfigureDevices(instance *Instance) error {
 				return err
 			}
 			if templateDir != "" && util.DirExists(templateDir) {
-				script.Run("sudo", "rsync", "-a", templateDir+"/", dir+"/")
+				err = t.host().Run("sudo", "rsync", "-a", templateDir+"/", dir+"/")
+				if err != nil {
+					return err
+				}
 			} else {
 				fmt.Printf("skipping missing template Device=%s dir=%s\n", d.Name, templateDir)
 			}
 		}
-		if script.Error() != nil {
-			return script.Error()
-		}
 	}
 	return nil
 }
@@ -216,21 +379,43 @@ func (t *DeviceConfigurer) RenameFilesystems(oldInstance, newInstance *Instance)
 	if err != nil {
 		return err
 	}
-	s := t.NewScript()
-	for _, oldpath := range InstanceFSList(oldPaths).Roots() {
+	var hostPaths []*InstanceFS
+	for _, oldpath := range oldPaths {
+		newpath := newPaths[oldpath.Id]
+		if !oldpath.IsVolume() {
+			hostPaths = append(hostPaths, oldpath)
+		} else if oldpath.Path != newpath.Path {
+			volumes, err := t.volumeOps(oldInstance.Config.Project)
+			if err != nil {
+				return err
+			}
+			err = volumes.Rename(oldpath, newpath.Path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, oldpath := range InstanceFSList(hostPaths).Roots() {
 		newpath := newPaths[oldpath.Id]
 		if oldpath.Path == newpath.Path {
 			continue
 		}
-		if oldpath.IsDir() {
+		if oldpath.IsDir() || oldpath.IsBtrfs() {
 			newdir := newpath.Dir()
 			if util.DirExists(newdir) {
 				return errors.New(newdir + ": already exists")
 			}
-			s.Run("mv", oldpath.Dir(), newdir)
+			if oldpath.IsBtrfs() {
+				err = t.host().Run("sudo", "mv", oldpath.Dir(), newdir)
+			} else {
+				err = t.host().Run("mv", oldpath.Dir(), newdir)
+			}
 		} else {
-			s.Run("sudo", "zfs", "rename", oldpath.Path, newpath.Path)
+			err = t.host().Run("sudo", "zfs", "rename", oldpath.Path, newpath.Path)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	return s.Error()
+	return nil
 }
@@ -3,26 +3,29 @@ package lxdops
 import (
 	"errors"
 	"fmt"
-	"io"
+	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"time"
 
 	lxd "github.com/canonical/lxd/client"
 	"github.com/canonical/lxd/shared/api"
 	"melato.org/lxdops/lxdutil"
 	"melato.org/lxdops/util"
-	"melato.org/script"
 )
 
 type Launcher struct {
 	Client *lxdutil.LxdClient `name:"-"`
 	ConfigOptions
+	JobOptions
 	RebuildProfiles bool `name:"profiles" usage:"if true, rebuild profiles according to config, otherwise keep existing profiles"`
 	WaitInterval    int  `name:"wait" usage:"# seconds to wait before snapshot"`
 	Trace           bool `name:"t" usage:"trace print what is happening"`
 	Api             bool `name:"api" usage:"use LXD API to copy containers"`
 	DryRun          bool `name:"dry-run" usage:"show the commands to run, but do not change anything"`
+	KeepOnFailure   bool `name:"keep-on-failure" usage:"if launch fails, keep what it created, instead of undoing it"`
+	// Host runs host commands.  If nil, a ScriptRunner is used.
+	Host HostRunner `name:"-"`
 }
 
 func (t *Launcher) Init() error {
@@ -37,8 +40,23 @@ func (t *Launcher) Configured() error {
 	return t.ConfigOptions.Configured()
 }
 
-func (t *Launcher) NewScript() *script.Script {
-	return &script.Script{Trace: t.Trace, DryRun: t.DryRun}
+func (t *Launcher) host() HostRunner {
+	if t.Host == nil {
+		return &ScriptRunner{Trace: t.Trace, DryRun: t.DryRun}
+	}
+	return t.Host
+}
+
+func (t *Launcher) newDeviceConfigurer(instance *Instance) (*DeviceConfigurer, error) {
+	dev, err := NewDeviceConfigurer(instance)
+	if err != nil {
+		return nil, err
+	}
+	dev.Trace = t.Trace
+	dev.DryRun = t.DryRun
+	dev.Host = t.Host
+	dev.Client = t.Client
+	return dev, nil
 }
 
 func (t *Launcher) getRebuildOptions(instance *Instance) (error, *RebuildOptions) {
@@ -121,10 +139,9 @@ func (t *Launcher) lxcLaunch(instance *Instance, server lxd.InstanceServer, opti
 		lxcArgs = append(lxcArgs, option)
 	}
 	lxcArgs = append(lxcArgs, container)
-	s := t.NewScript()
-	s.Run("lxc", lxcArgs...)
-	if s.HasError() {
-		return s.Error()
+	err = t.host().Run("lxc", lxcArgs...)
+	if err != nil {
+		return err
 	}
 	return t.configureContainer(instance, server, options)
 }
@@ -240,7 +257,6 @@ func (t *Launcher) configureContainer(instance *Instance, server lxd.InstanceSer
 }
 
 func (t *Launcher) copyContainer(instance *Instance, source ContainerSource, server lxd.InstanceServer, options *launch_options) error {
-	s := t.NewScript()
 	container := instance.Container()
 	config := instance.Config
 	sourceServer, err := t.Client.ProjectServer(source.Project)
@@ -302,10 +318,10 @@ func (t *Launcher) copyContainer(instance *Instance, source ContainerSource, ser
 			copyArgs = append(copyArgs, source.Container+"/"+source.Snapshot)
 		}
 		copyArgs = append(copyArgs, container)
-		s.Run("lxc", copyArgs...)
-		if s.HasError() {
+		err = t.host().Run("lxc", copyArgs...)
+		if err != nil {
 			t.deleteProfiles(server, missingProfiles)
-			return s.Error()
+			return err
 		}
 
 	}
@@ -322,22 +338,18 @@ func (t *Launcher) copyContainer(instance *Instance, source ContainerSource, ser
 
 func (t *Launcher) CreateDevices(instance *Instance) error {
 	t.Trace = true
-	dev, err := NewDeviceConfigurer(instance)
+	dev, err := t.newDeviceConfigurer(instance)
 	if err != nil {
 		return err
 	}
-	dev.Trace = t.Trace
-	dev.DryRun = t.DryRun
 	return dev.ConfigureDevices(instance)
 }
 
 func (t *Launcher) CreateProfile(instance *Instance) error {
-	dev, err := NewDeviceConfigurer(instance)
+	dev, err := t.newDeviceConfigurer(instance)
 	if err != nil {
 		return err
 	}
-	dev.Trace = t.Trace
-	dev.DryRun = t.DryRun
 	profileName := instance.ProfileName()
 	if profileName != "" {
 		fmt.Println(profileName)
@@ -380,6 +392,21 @@ func (t *Launcher) verifyProfiles(server lxd.InstanceServer, profiles []string)
 func (t *Launcher) launchContainer(instance *Instance, rebuildOptions *RebuildOptions) error {
 	fmt.Println("launch", instance.Name)
 	t.Trace = true
+	undo := &launchUndo{}
+	err := t.launchSteps(instance, rebuildOptions, undo)
+	if err != nil && !t.DryRun {
+		fmt.Fprintf(os.Stderr, "launch %s failed: %v\n", instance.Name, err)
+		if t.KeepOnFailure {
+			undo.Print()
+		} else if err := undo.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "undo %s: %v\n", instance.Name, err)
+		}
+	}
+	return err
+}
+
+// launchSteps launches an instance, recording in undo how to undo each step that it completes.
+func (t *Launcher) launchSteps(instance *Instance, rebuildOptions *RebuildOptions, undo *launchUndo) error {
 	config := instance.Config
 	server, err := t.Client.ProjectServer(config.Project)
 	if err != nil {
@@ -393,12 +420,14 @@ func (t *Launcher) launchContainer(instance *Instance, rebuildOptions *RebuildOp
 		}
 	}
 
-	dev, err := NewDeviceConfigurer(instance)
+	dev, err := t.newDeviceConfigurer(instance)
 	if err != nil {
 		return err
 	}
-	dev.Trace = t.Trace
-	dev.DryRun = t.DryRun
+	// register the undo before creating the filesystems, since some of them may be created before an error
+	undo.Add("destroy new filesystems", func() error {
+		return t.destroyNewFilesystems(instance)
+	})
 	err = dev.ConfigureDevices(instance)
 	if err != nil {
 		return err
@@ -410,8 +439,26 @@ func (t *Launcher) launchContainer(instance *Instance, rebuildOptions *RebuildOp
 		if err != nil {
 			return err
 		}
+		undo.Add("delete profile "+profileName, func() error {
+			return lxdutil.AnnotateLXDError(profileName, server.DeleteProfile(profileName))
+		})
 	}
+	container := instance.Container()
+	if _, _, err := server.GetInstance(container); api.StatusErrorCheck(err, http.StatusNotFound) {
+		// the container does not exist, so if it exists after an error, it was created by the launch
+		undo.Add("delete container "+container, func() error {
+			return t.deleteNewContainer(server, container)
+		})
+	} else if err != nil {
+		return lxdutil.AnnotateLXDError(container, err)
+	}
+	return t.createContainer(instance, server, rebuildOptions)
+}
 
+// createContainer launches or copies the container of an instance, whose devices and profile exist,
+// and configures it.
+func (t *Launcher) createContainer(instance *Instance, server lxd.InstanceServer, rebuildOptions *RebuildOptions) error {
+	config := instance.Config
 	var profiles []string
 	if rebuildOptions != nil && len(rebuildOptions.Profiles) > 0 {
 		profiles = make([]string, len(rebuildOptions.Profiles))
@@ -419,15 +466,7 @@ func (t *Launcher) launchContainer(instance *Instance, rebuildOptions *RebuildOp
 			profiles[i] = profile
 		}
 	} else {
-		profiles = append(profiles, config.Profiles...)
-		if config.Devices != nil {
-			if len(profiles) == 0 {
-				profiles = append(profiles, "default")
-			}
-			if profileName != "" {
-				profiles = append(profiles, profileName)
-			}
-		}
+		profiles = instance.ContainerProfiles()
 	}
 	configProfiles := profiles
 	if config.HasProfilesConfig() {
@@ -452,7 +491,7 @@ func (t *Launcher) launchContainer(instance *Instance, rebuildOptions *RebuildOp
 		}
 	}
 	configurer := t.NewConfigurer()
-	err = configurer.ConfigureContainer(instance)
+	err := configurer.ConfigureContainer(instance)
 	if err != nil {
 		return err
 	}
@@ -553,25 +592,61 @@ func (t *Launcher) DeleteContainer(instance *Instance) error {
 	}
 	var zfsFilesystems []string
 	var dirFilesystems []string
+	var volumeFilesystems []*InstanceFS
 	for _, fs := range filesystems {
 		if fs.IsZfs() {
 			zfsFilesystems = append(zfsFilesystems, fs.Path)
+		} else if fs.IsVolume() {
+			volumeFilesystems = append(volumeFilesystems, fs)
 		} else {
 			dirFilesystems = append(dirFilesystems, fs.Path)
 		}
 	}
 	fmt.Fprintln(os.Stderr, "remaining filesystems:")
+	var lines []string
+	if len(volumeFilesystems) > 0 {
+		volumes, err := NewVolumeOps(t.Client, instance.Config.Project)
+		if err != nil {
+			return err
+		}
+		for _, fs := range volumeFilesystems {
+			exists, err := volumes.Exists(fs)
+			if err != nil {
+				return err
+			}
+			if exists {
+				lines = append(lines, "volume "+fs.VolumeName())
+			}
+		}
+	}
 	if len(zfsFilesystems) > 0 {
-		cmd := exec.Command("zfs", append([]string{"list", "-o", "name,used,referenced,origin,mountpoint"}, zfsFilesystems...)...)
-		cmd.Stderr = io.Discard
-		cmd.Stdout = os.Stdout
-		cmd.Run()
+		zfsLines, _ := t.host().Lines("zfs", append([]string{"list", "-o", "name,used,referenced,origin,mountpoint"}, zfsFilesystems...)...)
+		lines = append(lines, zfsLines...)
 	}
 	if len(dirFilesystems) > 0 {
-		cmd := exec.Command("ls", append([]string{"-l"}, dirFilesystems...)...)
-		cmd.Stderr = io.Discard
-		cmd.Stdout = os.Stdout
-		cmd.Run()
+		dirLines, _ := t.host().Lines("ls", append([]string{"-l"}, dirFilesystems...)...)
+		lines = append(lines, dirLines...)
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// destroyBtrfs deletes a btrfs subvolume and its snapshots
+func (t *Launcher) destroyBtrfs(fs *InstanceFS) error {
+	snapshots, err := filepath.Glob(fs.SnapshotPath("*"))
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		err := t.host().Run("sudo", "btrfs", "subvolume", "delete", snapshot)
+		if err != nil {
+			return err
+		}
+	}
+	if util.DirExists(fs.Dir()) {
+		return t.host().Run("sudo", "btrfs", "subvolume", "delete", fs.Dir())
 	}
 	return nil
 }
@@ -587,24 +662,56 @@ func (t *Launcher) DestroyContainer(instance *Instance) error {
 	}
 	var zfsFilesystems []string
 	var dirFilesystems []string
+	var btrfsFilesystems []*InstanceFS
+	var volumeFilesystems []*InstanceFS
 	for _, fs := range filesystems {
 		if fs.Filesystem.Destroy {
 			if fs.IsZfs() {
 				zfsFilesystems = append(zfsFilesystems, fs.Path)
+			} else if fs.IsVolume() {
+				volumeFilesystems = append(volumeFilesystems, fs)
+			} else if fs.IsBtrfs() {
+				btrfsFilesystems = append(btrfsFilesystems, fs)
 			} else {
 				dirFilesystems = append(dirFilesystems, fs.Path)
 			}
 		}
 	}
 	if len(zfsFilesystems) > 0 {
-		s := script.Script{DryRun: t.DryRun, Trace: t.Trace}
-		lines := s.Cmd("zfs", append([]string{"list", "-H", "-o", "name"}, zfsFilesystems...)...).ToLines()
-		s.Errors.Clear()
+		// ignore errors from missing filesystems
+		lines, _ := t.host().Lines("zfs", append([]string{"list", "-H", "-o", "name"}, zfsFilesystems...)...)
 		for _, line := range lines {
-			s.Run("sudo", "zfs", "destroy", "-r", line)
+			err := t.host().Run("sudo", "zfs", "destroy", "-r", line)
+			if err != nil {
+				return err
+			}
 		}
-		if s.HasError() {
-			return s.Error()
+	}
+	if len(volumeFilesystems) > 0 {
+		volumes, err := NewVolumeOps(t.Client, instance.Config.Project)
+		if err != nil {
+			return err
+		}
+		volumes.Trace = t.Trace
+		volumes.DryRun = t.DryRun
+		for _, fs := range volumeFilesystems {
+			exists, err := volumes.Exists(fs)
+			if err != nil {
+				return err
+			}
+			if exists {
+				err := volumes.Delete(fs)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// delete nested subvolumes before their parents
+	for i := len(btrfsFilesystems) - 1; i >= 0; i-- {
+		err := t.destroyBtrfs(btrfsFilesystems[i])
+		if err != nil {
+			return err
 		}
 	}
 	var firstError error
@@ -639,12 +746,10 @@ func (t *Launcher) Rename(configFile string, newname string) error {
 	if err != nil {
 		return err
 	}
-	dev, err := NewDeviceConfigurer(instance)
+	dev, err := t.newDeviceConfigurer(instance)
 	if err != nil {
 		return err
 	}
-	dev.Trace = t.Trace
-	dev.DryRun = t.DryRun
 
 	containerName := instance.Container()
 	newContainerName := newInstance.Container()
@@ -1,7 +1,16 @@
 package lxdops
 
 import (
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/cloudconfig/ostype"
+	"melato.org/lxdops/lxdutil"
+	"melato.org/lxdops/lxdutil/lxdtest"
+	"melato.org/lxdops/util"
 )
 
 func TestBaseName(t *testing.T) {
@@ -10,3 +19,291 @@ func TestBaseName(t *testing.T) {
 		t.Errorf("name: %s expected:%s", name, "a")
 	}
 }
+
+// lxcRunner is a RecordingRunner that also applies "lxc init" to a fake LXD server
+type lxcRunner struct {
+	RecordingRunner
+	Server *lxdtest.Server
+}
+
+func (t *lxcRunner) Run(name string, args ...string) error {
+	err := t.RecordingRunner.Run(name, args...)
+	if err != nil || name != "lxc" {
+		return err
+	}
+	server := t.Server
+	if len(args) > 2 && args[0] == "--project" {
+		server = server.UseProject(args[1]).(*lxdtest.Server)
+		args = args[2:]
+	}
+	if args[0] != "init" {
+		return nil
+	}
+	// lxc init <image> [-p <profile>]... [<option>]... <container>
+	var profiles []string
+	for i := 2; i < len(args)-1; i++ {
+		if args[i] == "-p" {
+			i++
+			profiles = append(profiles, args[i])
+		}
+	}
+	post := api.InstancesPost{Name: args[len(args)-1], InstancePut: api.InstancePut{Profiles: profiles}}
+	_, err = server.CreateInstance(post)
+	return err
+}
+
+// failingServer is a fake LXD server whose queries fail with an error other than not found,
+// for testing that lxdops does not treat such errors as missing resources.
+type failingServer struct {
+	*lxdtest.Server
+	// Methods are the names of the methods that fail
+	Methods []string
+}
+
+var errUnavailable = api.StatusErrorf(http.StatusInternalServerError, "server unavailable")
+
+func (t *failingServer) fails(method string) bool {
+	for _, m := range t.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *failingServer) GetStoragePoolVolume(pool string, volType string, name string) (*api.StorageVolume, string, error) {
+	if t.fails("GetStoragePoolVolume") {
+		return nil, "", errUnavailable
+	}
+	return t.Server.GetStoragePoolVolume(pool, volType, name)
+}
+
+func (t *failingServer) GetProfile(name string) (*api.Profile, string, error) {
+	if t.fails("GetProfile") {
+		return nil, "", errUnavailable
+	}
+	return t.Server.GetProfile(name)
+}
+
+func (t *failingServer) GetInstanceState(name string) (*api.InstanceState, string, error) {
+	if t.fails("GetInstanceState") {
+		return nil, "", errUnavailable
+	}
+	return t.Server.GetInstanceState(name)
+}
+
+func (t *failingServer) GetInstance(name string) (*api.Instance, string, error) {
+	if t.fails("GetInstance") {
+		return nil, "", errUnavailable
+	}
+	return t.Server.GetInstance(name)
+}
+
+type launcherTest struct {
+	Launcher *Launcher
+	Server   *lxdtest.Server
+	Host     *lxcRunner
+}
+
+func newLauncherTest() *launcherTest {
+	server := lxdtest.NewServer()
+	server.AddProfile("base", api.ProfilePut{})
+	client := &lxdutil.LxdClient{}
+	client.SetRootServer(server)
+	host := &lxcRunner{Server: server}
+	launcher := &Launcher{Client: client, Host: host}
+	launcher.Project = "default"
+	return &launcherTest{Launcher: launcher, Server: server, Host: host}
+}
+
+func newLaunchConfig() *Config {
+	OSTypes["alpine"] = &ostype.Alpine{}
+	config := &Config{}
+	config.OS = &OS{Name: "alpine", Image: "images:alpine/3.18"}
+	config.Project = "default"
+	config.Profiles = []string{"base"}
+	config.Filesystems = map[string]*Filesystem{
+		"root": {Pattern: "z/test/(instance)", Destroy: true},
+	}
+	config.Devices = map[string]*Device{
+		"home": {Path: "/home", Filesystem: "root"},
+	}
+	return config
+}
+
+func (x *launcherTest) launch(t *testing.T, name string) *Instance {
+	t.Helper()
+	instance, err := NewInstance(nil, newLaunchConfig(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+func verifyProfiles(t *testing.T, server *lxdtest.Server, container string, profiles ...string) {
+	t.Helper()
+	c := server.Instance(container)
+	if c == nil {
+		t.Fatalf("missing container: %s", container)
+	}
+	if !util.StringSlice(c.Profiles).Equals(profiles) {
+		t.Errorf("%s profiles: %v expected: %v", container, c.Profiles, profiles)
+	}
+}
+
+func TestLaunch(t *testing.T) {
+	x := newLauncherTest()
+	x.launch(t, "a")
+	verifyCommands(t, x.Host.Commands,
+		"sudo zfs create -p z/test/a",
+		"sudo mkdir -p /z/test/a/home",
+		"lxc --project default init images:alpine/3.18 -p base -p a.lxdops a",
+	)
+	verifyProfiles(t, x.Server, "a", "base", "a.lxdops")
+	if x.Server.Instance("a").Status != api.Running.String() {
+		t.Errorf("container is not running")
+	}
+	profile := x.Server.Profile("a.lxdops")
+	if profile == nil {
+		t.Fatalf("missing profile")
+	}
+	home := profile.Devices["home"]
+	if home["type"] != "disk" || home["path"] != "/home" || home["source"] != "/z/test/a/home" {
+		t.Errorf("home device: %v", home)
+	}
+}
+
+func TestLaunchMissingProfile(t *testing.T) {
+	x := newLauncherTest()
+	config := newLaunchConfig()
+	config.Profiles = []string{"missing"}
+	instance, err := NewInstance(nil, config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err == nil {
+		t.Fatalf("launched with missing profile")
+	}
+	verifyCommands(t, x.Host.Commands)
+}
+
+func TestLaunchServerError(t *testing.T) {
+	x := newLauncherTest()
+	x.Launcher.Client.SetRootServer(&failingServer{Server: x.Server, Methods: []string{"GetInstance"}})
+	instance, err := NewInstance(nil, newLaunchConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err == nil {
+		t.Fatalf("launched without checking the container")
+	}
+	if x.Server.Instance("a") != nil || x.Server.Profile("a.lxdops") != nil {
+		t.Errorf("the launch was not undone")
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	x := newLauncherTest()
+	instance := x.launch(t, "a")
+	hwaddr := x.Server.Instance("a").Config["volatile.eth0.hwaddr"]
+	if hwaddr == "" {
+		t.Fatalf("missing hwaddr")
+	}
+	x.Host.Commands = nil
+	err := x.Launcher.Rebuild(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, x.Host.Commands,
+		"sudo zfs create -p z/test/a",
+		"sudo mkdir -p /z/test/a/home",
+		"lxc --project default init images:alpine/3.18 -p base -p a.lxdops a",
+	)
+	verifyProfiles(t, x.Server, "a", "base", "a.lxdops")
+	if x.Server.Instance("a").Config["volatile.eth0.hwaddr"] != hwaddr {
+		t.Errorf("hwaddr was not preserved")
+	}
+}
+
+func TestRename(t *testing.T) {
+	x := newLauncherTest()
+	x.Server.AddProfile("a.lxdops", api.ProfilePut{})
+	x.Server.AddInstance("a", api.InstancePut{Profiles: []string{"base", "a.lxdops"}})
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "a.yaml")
+	err := os.WriteFile(configFile, []byte(`#lxdops
+filesystems:
+  root:
+    pattern: z/test/(instance)
+devices:
+  home:
+    path: /home
+    filesystem: root
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.Rename(configFile, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, x.Host.Commands, "sudo zfs rename z/test/a z/test/b")
+	if x.Server.Instance("a") != nil {
+		t.Errorf("old container exists")
+	}
+	verifyProfiles(t, x.Server, "b", "base", "b.lxdops")
+	if x.Server.Profile("a.lxdops") != nil {
+		t.Errorf("old profile exists")
+	}
+	if x.Server.Profile("b.lxdops").Devices["home"]["source"] != "/z/test/b/home" {
+		t.Errorf("new profile: %v", x.Server.Profile("b.lxdops").Devices)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	x := newLauncherTest()
+	instance := x.launch(t, "a")
+	err := x.Launcher.DeleteContainer(instance)
+	if err == nil {
+		t.Fatalf("deleted running container")
+	}
+	err = lxdutil.InstanceServer{Server: x.Server}.StopContainer("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.Host.Commands = nil
+	err = x.Launcher.DeleteContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Server.Instance("a") != nil || x.Server.Profile("a.lxdops") != nil {
+		t.Errorf("container or profile was not deleted")
+	}
+	verifyCommands(t, x.Host.Commands)
+	verifyCommands(t, x.Host.Queries, "zfs list -o name,used,referenced,origin,mountpoint z/test/a")
+}
+
+func TestDestroy(t *testing.T) {
+	x := newLauncherTest()
+	instance := x.launch(t, "a")
+	err := lxdutil.InstanceServer{Server: x.Server}.StopContainer("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.Host.Commands = nil
+	x.Host.Output = map[string][]string{"zfs list -H -o name z/test/a": {"z/test/a"}}
+	err = x.Launcher.DestroyContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Server.Instance("a") != nil {
+		t.Errorf("container was not deleted")
+	}
+	verifyCommands(t, x.Host.Commands, "sudo zfs destroy -r z/test/a")
+}
@@ -36,6 +36,40 @@ func (t *ProfileConfigurer) Profiles(instance *Instance) ([]string, error) {
 	return append(profiles, profile), nil
 }
 
+// ProfileDiff is the difference between the config profiles of an instance and the profiles of its container
+type ProfileDiff struct {
+	OnlyInConfig    []string
+	OnlyInContainer []string
+	// Order is true if the profiles are the same, but in a different order
+	Order bool
+}
+
+// Equal returns true if the container has the config profiles, in order
+func (t *ProfileDiff) Equal() bool {
+	return len(t.OnlyInConfig) == 0 && len(t.OnlyInContainer) == 0 && !t.Order
+}
+
+// DiffProfiles compares the config profiles of an instance with the profiles of its container
+func (t *ProfileConfigurer) DiffProfiles(instance *Instance, containerProfiles []string) (*ProfileDiff, error) {
+	profiles, err := t.Profiles(instance)
+	if err != nil {
+		return nil, err
+	}
+	return diffProfiles(profiles, containerProfiles), nil
+}
+
+// diffProfiles compares the expected profiles of a container with its actual profiles
+func diffProfiles(profiles []string, containerProfiles []string) *ProfileDiff {
+	diff := &ProfileDiff{}
+	if util.StringSlice(profiles).Equals(containerProfiles) {
+		return diff
+	}
+	diff.OnlyInConfig = util.StringSlice(profiles).Diff(containerProfiles)
+	diff.OnlyInContainer = util.StringSlice(containerProfiles).Diff(profiles)
+	diff.Order = len(diff.OnlyInConfig) == 0 && len(diff.OnlyInContainer) == 0
+	return diff
+}
+
 func (t *ProfileConfigurer) Diff(instance *Instance) error {
 	container := instance.Container()
 	server, err := t.Client.ProjectServer(instance.Config.Project)
@@ -46,23 +80,22 @@ func (t *ProfileConfigurer) Diff(instance *Instance) error {
 	if err != nil {
 		return lxdutil.AnnotateLXDError(container, err)
 	}
-	profiles, err := t.Profiles(instance)
+	diff, err := t.DiffProfiles(instance, c.Profiles)
 	if err != nil {
 		return err
 	}
-	if util.StringSlice(profiles).Equals(c.Profiles) {
-		return nil
-	}
-	onlyInConfig := util.StringSlice(profiles).Diff(c.Profiles)
-	onlyInContainer := util.StringSlice(c.Profiles).Diff(profiles)
 	sep := " "
-	if len(onlyInConfig) > 0 {
-		fmt.Printf("%s profiles only in config: %s\n", container, strings.Join(onlyInConfig, sep))
+	if len(diff.OnlyInConfig) > 0 {
+		fmt.Printf("%s profiles only in config: %s\n", container, strings.Join(diff.OnlyInConfig, sep))
 	}
-	if len(onlyInContainer) > 0 {
-		fmt.Printf("%s profiles only in container: %s\n", container, strings.Join(onlyInContainer, sep))
+	if len(diff.OnlyInContainer) > 0 {
+		fmt.Printf("%s profiles only in container: %s\n", container, strings.Join(diff.OnlyInContainer, sep))
 	}
-	if len(onlyInConfig) == 0 && len(onlyInContainer) == 0 {
+	if diff.Order {
+		profiles, err := t.Profiles(instance)
+		if err != nil {
+			return err
+		}
 		fmt.Printf("%s profiles are in different order: %s\n", container, strings.Join(profiles, sep))
 	}
 	return nil
@@ -126,6 +159,31 @@ func (t *ProfileConfigurer) Apply(instance *Instance) error {
 	return nil
 }
 
+// Sync updates the devices and config of the existing instance profile to the configured ones, in place.
+// It prints the changes first.  It fails if the profile is modified by someone else in the meantime.
+func (t *ProfileConfigurer) Sync(instance *Instance) error {
+	server, err := t.Client.ProjectServer(instance.Config.Project)
+	if err != nil {
+		return err
+	}
+	profileName := instance.ProfileName()
+	plan, desired, etag, err := instanceProfileChanges(instance, server)
+	if err != nil {
+		return err
+	}
+	if len(plan.Actions) == 0 {
+		fmt.Printf("%s: no changes\n", profileName)
+		return nil
+	}
+	for _, action := range plan.Actions {
+		fmt.Println(action)
+	}
+	if t.DryRun {
+		return nil
+	}
+	return updateInstanceProfile(server, profileName, desired, etag)
+}
+
 func (t *ProfileConfigurer) List(instance *Instance) error {
 	profiles, err := t.Profiles(instance)
 	if err != nil {
@@ -0,0 +1,75 @@
+package lxdops
+
+import (
+	"testing"
+
+	"github.com/canonical/lxd/shared/api"
+)
+
+func TestProfileApply(t *testing.T) {
+	x := newLauncherTest()
+	x.Server.AddProfile("a.lxdops", api.ProfilePut{})
+	x.Server.AddInstance("a", api.InstancePut{Profiles: []string{"default"}})
+	instance, err := NewInstance(nil, newLaunchConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles := &ProfileConfigurer{Client: x.Launcher.Client}
+	err = profiles.Diff(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = profiles.Apply(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyProfiles(t, x.Server, "a", "base", "a.lxdops")
+}
+
+func TestProfileSync(t *testing.T) {
+	x := newLauncherTest()
+	instance := x.launch(t, "a")
+	profile := x.Server.Profile("a.lxdops")
+	profile.Devices["home"]["path"] = "/old"
+	profile.Devices["tmp"] = map[string]string{"type": "disk", "path": "/tmp", "source": "/tmp"}
+	profiles := &ProfileConfigurer{Client: x.Launcher.Client, DryRun: true}
+	err := profiles.Sync(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Server.Profile("a.lxdops").Devices["home"]["path"] != "/old" {
+		t.Fatalf("dry-run changed the profile")
+	}
+	profiles.DryRun = false
+	err = profiles.Sync(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile = x.Server.Profile("a.lxdops")
+	if profile.Devices["home"]["path"] != "/home" || profile.Devices["tmp"] != nil {
+		t.Fatalf("devices: %v", profile.Devices)
+	}
+	verifyProfiles(t, x.Server, "a", "base", "a.lxdops")
+}
+
+func TestProfileSyncETag(t *testing.T) {
+	x := newLauncherTest()
+	instance := x.launch(t, "a")
+	server, err := x.Launcher.Client.ProjectServer("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, desired, etag, err := instanceProfileChanges(instance, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// modify the profile after it was read
+	err = server.UpdateProfile("a.lxdops", api.ProfilePut{Description: "other"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = updateInstanceProfile(server, "a.lxdops", desired, etag)
+	if err == nil {
+		t.Fatal("expected etag error")
+	}
+}
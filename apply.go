@@ -0,0 +1,179 @@
+package lxdops
+
+import (
+	"fmt"
+	"net/http"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
+)
+
+// instanceProfileChanges reads the instance profile, and compares it with the configured devices and config.
+// It returns the changes, the desired profile, and the etag of the profile that was read.
+func instanceProfileChanges(instance *Instance, server lxd.InstanceServer) (*InstancePlan, api.ProfilePut, string, error) {
+	profileName := instance.ProfileName()
+	profile, etag, err := server.GetProfile(profileName)
+	if err != nil {
+		return nil, api.ProfilePut{}, "", lxdutil.AnnotateLXDError(profileName, err)
+	}
+	desired, err := instance.InstanceProfile()
+	if err != nil {
+		return nil, api.ProfilePut{}, "", err
+	}
+	desired.Description = profile.Description
+	plan := &InstancePlan{Instance: instance.Name}
+	plan.DiffProfile(profileName, desired, profile.ProfilePut)
+	return plan, desired, etag, nil
+}
+
+// updateInstanceProfile replaces the instance profile, if it has not changed since it was read with etag.
+func updateInstanceProfile(server lxd.InstanceServer, profileName string, profile api.ProfilePut, etag string) error {
+	err := server.UpdateProfile(profileName, profile, etag)
+	if api.StatusErrorCheck(err, http.StatusPreconditionFailed) {
+		return fmt.Errorf("%s: the profile was modified while updating it, try again", profileName)
+	}
+	return lxdutil.AnnotateLXDError(profileName, err)
+}
+
+// updateProfile replaces the devices and config of the instance profile with the configured ones.
+func (t *Launcher) updateProfile(instance *Instance, server lxd.InstanceServer) error {
+	_, desired, etag, err := instanceProfileChanges(instance, server)
+	if err != nil {
+		return err
+	}
+	profileName := instance.ProfileName()
+	fmt.Printf("update profile %s\n", profileName)
+	if t.DryRun {
+		return nil
+	}
+	return updateInstanceProfile(server, profileName, desired, etag)
+}
+
+// updateProfiles sets the profiles of an existing container to the config profiles, in order.
+func (t *Launcher) updateProfiles(instance *Instance, server lxd.InstanceServer) error {
+	container := instance.Container()
+	c, etag, err := server.GetInstance(container)
+	if err != nil {
+		return lxdutil.AnnotateLXDError(container, err)
+	}
+	c.Profiles = instance.ContainerProfiles()
+	fmt.Printf("set %s profiles: %v\n", container, c.Profiles)
+	if t.DryRun {
+		return nil
+	}
+	op, err := server.UpdateInstance(container, c.InstancePut, etag)
+	if err == nil {
+		err = op.Wait()
+	}
+	return lxdutil.AnnotateLXDError(container, err)
+}
+
+func (t *Launcher) createSnapshot(instance *Instance, server lxd.InstanceServer) error {
+	container := instance.Container()
+	snapshot := instance.Config.Snapshot
+	fmt.Printf("snapshot %s %s\n", container, snapshot)
+	if t.DryRun {
+		return nil
+	}
+	op, err := server.CreateContainerSnapshot(container, api.ContainerSnapshotsPost{Name: snapshot})
+	if err == nil {
+		err = op.Wait()
+	}
+	return lxdutil.AnnotateLXDError(container, err)
+}
+
+// Apply converges an instance to its config, making only the changes that plan shows:
+//   - It creates the missing filesystems and device directories.
+//     If neither the container nor any filesystem exists, it creates them as launch does,
+//     cloning or copying them from the device source.
+//   - It creates the instance profile, or updates its devices and config in place.
+//   - It launches the container if it does not exist.
+//   - It sets the profiles of an existing container to the config profiles, in order.
+//   - It creates the config snapshot of an existing container, if it is missing.
+//
+// It does not change anything else, such as the container config, or existing files.
+func (t *Launcher) Apply(instance *Instance) error {
+	plan := &Plan{Client: t.Client}
+	p, err := plan.InstancePlan(instance)
+	if err != nil {
+		return err
+	}
+	if len(p.Actions) == 0 {
+		fmt.Printf("%s: no changes\n", instance.Name)
+		return nil
+	}
+	fmt.Printf("%s:\n", instance.Name)
+	for _, action := range p.Actions {
+		fmt.Printf("  %s\n", action)
+	}
+	// trace the changes, without changing the options of the launcher, which may apply other instances
+	launcher := *t
+	launcher.Trace = true
+	return launcher.applyPlan(instance, p)
+}
+
+// applyPlan makes the changes of the plan of an instance
+func (t *Launcher) applyPlan(instance *Instance, p *InstancePlan) error {
+	kinds := make(map[string]int)
+	for _, action := range p.Actions {
+		kinds[action.Kind]++
+	}
+	server, err := t.Client.ProjectServer(instance.Config.Project)
+	if err != nil {
+		return err
+	}
+	filesystems, err := instance.FilesystemList()
+	if err != nil {
+		return err
+	}
+	containerExists := true
+	if _, _, err := server.GetInstance(instance.Container()); api.StatusErrorCheck(err, http.StatusNotFound) {
+		containerExists = false
+	} else if err != nil {
+		return lxdutil.AnnotateLXDError(instance.Container(), err)
+	}
+
+	if kinds["filesystem"]+kinds["device"] > 0 {
+		dev, err := t.newDeviceConfigurer(instance)
+		if err != nil {
+			return err
+		}
+		if !containerExists && kinds["filesystem"] == len(filesystems) {
+			err = dev.ConfigureDevices(instance)
+		} else {
+			err = dev.CreateMissingDevices(instance)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if kinds["profile"] > 0 {
+		dev, err := t.newDeviceConfigurer(instance)
+		if err != nil {
+			return err
+		}
+		err = dev.CreateProfile(t.Client, instance)
+		if err != nil {
+			return err
+		}
+	} else if kinds["profile-device"]+kinds["profile-config"] > 0 {
+		err = t.updateProfile(instance, server)
+		if err != nil {
+			return err
+		}
+	}
+	if !containerExists {
+		return t.createContainer(instance, server, nil)
+	}
+	if kinds["container"] > 0 {
+		err = t.updateProfiles(instance, server)
+		if err != nil {
+			return err
+		}
+	}
+	if kinds["snapshot"] > 0 {
+		return t.createSnapshot(instance, server)
+	}
+	return nil
+}
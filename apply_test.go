@@ -0,0 +1,70 @@
+package lxdops
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	x := newLauncherTest()
+	dir := t.TempDir()
+	config := newLaunchConfig()
+	config.Filesystems["root"].Pattern = Pattern(dir + "/(instance)")
+	instance, err := NewInstance(nil, config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.Apply(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyProfiles(t, x.Server, "a", "base", "a.lxdops")
+	if x.Launcher.Trace {
+		t.Errorf("apply changed the launcher options")
+	}
+	// the fake host does not create directories
+	err = os.MkdirAll(filepath.Join(dir, "a", "home"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x.Host.Commands = nil
+	err = x.Launcher.Apply(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, x.Host.Commands)
+
+	// drift
+	c := x.Server.Instance("a")
+	c.Profiles = []string{"a.lxdops", "base"}
+	profile := x.Server.Profile("a.lxdops")
+	profile.Devices["home"]["source"] = "/other"
+	config.Devices["log"] = &Device{Path: "/var/log", Filesystem: "root"}
+	config.ProfileConfig = map[string]string{"boot.autostart": "false"}
+	instance, err = NewInstance(nil, config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.Apply(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, x.Host.Commands, "sudo mkdir -p "+filepath.Join(dir, "a", "log"))
+	verifyProfiles(t, x.Server, "a", "base", "a.lxdops")
+	profile = x.Server.Profile("a.lxdops")
+	if profile.Devices["home"]["source"] != filepath.Join(dir, "a", "home") ||
+		profile.Devices["log"]["path"] != "/var/log" || profile.Config["boot.autostart"] != "false" {
+		t.Errorf("profile was not updated: %v %v", profile.Devices, profile.Config)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "a", "log"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := (&Plan{Client: x.Launcher.Client}).InstancePlan(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, planActions(p))
+}
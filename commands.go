@@ -24,22 +24,33 @@ func RootCommand() *command.SimpleCommand {
 	var cmd command.SimpleCommand
 	cmd.Flags(client)
 	launcher := &Launcher{Client: client}
-	cmd.Command("launch").Flags(launcher).RunFunc(launcher.InstanceFunc(launcher.LaunchContainer, true))
-	cmd.Command("delete").Flags(launcher).RunFunc(launcher.InstanceFunc(launcher.DeleteContainer, false))
-	cmd.Command("destroy").Flags(launcher).RunFunc(launcher.InstanceFunc(launcher.DestroyContainer, false))
-	cmd.Command("rebuild").Flags(launcher).RunFunc(launcher.InstanceFunc(launcher.Rebuild, true))
+	cmd.Command("launch").Flags(launcher).RunFunc(launcher.JobsFunc(launcher.JobList, launcher.InstanceFunc(launcher.LaunchContainer, true)))
+	cmd.Command("delete").Flags(launcher).RunFunc(launcher.JobsFunc(launcher.ReverseJobList, launcher.ReverseInstanceFunc(launcher.DeleteContainer, false)))
+	cmd.Command("destroy").Flags(launcher).RunFunc(launcher.JobsFunc(launcher.ReverseJobList, launcher.ReverseInstanceFunc(launcher.DestroyContainer, false)))
+	cmd.Command("apply").Flags(launcher).RunFunc(launcher.JobsFunc(launcher.JobList, launcher.InstanceFunc(launcher.Apply, true)))
+	cmd.Command("rebuild").Flags(launcher).RunFunc(launcher.JobsFunc(launcher.JobList, launcher.InstanceFunc(launcher.Rebuild, true)))
 	cmd.Command("rename").Flags(launcher).RunFunc(launcher.Rename)
-	cmd.Command("create-devices").Flags(launcher).RunFunc(launcher.InstanceFunc(launcher.CreateDevices, true))
-	cmd.Command("create-profile").Flags(launcher).RunFunc(launcher.InstanceFunc(launcher.CreateProfile, false))
+	cmd.Command("create-devices").Flags(launcher).RunFunc(launcher.JobsFunc(launcher.JobList, launcher.InstanceFunc(launcher.CreateDevices, true)))
+	cmd.Command("create-profile").Flags(launcher).RunFunc(launcher.JobsFunc(launcher.JobList, launcher.InstanceFunc(launcher.CreateProfile, false)))
 
-	snapshot := &Snapshot{}
-	cmd.Command("snapshot").Flags(snapshot).RunFunc(snapshot.InstanceFunc(snapshot.Run, false))
+	snapshot := &Snapshot{Client: client}
+	snapshotCmd := cmd.Command("snapshot").Flags(snapshot).RunFunc(snapshot.JobsFunc(snapshot.IndependentJobList, snapshot.RunConfigs))
+	snapshotList := &SnapshotList{Client: client}
+	snapshotCmd.Command("list").Flags(snapshotList).RunFunc(snapshotList.InstanceFunc(snapshotList.List, false))
+	snapshotPrune := &SnapshotPrune{Client: client}
+	snapshotCmd.Command("prune").Flags(snapshotPrune).RunFunc(snapshotPrune.InstanceFunc(snapshotPrune.Prune, false))
 
-	rollback := &Rollback{}
+	rollback := &Rollback{Client: client}
 	cmd.Command("rollback").Flags(rollback).RunFunc(rollback.InstanceFunc(rollback.Run, false))
 
+	plan := &Plan{Client: client}
+	cmd.Command("plan").Flags(plan).RunFunc(plan.InstanceFunc(plan.Print, true))
+
+	status := &Status{Client: client}
+	cmd.Command("status").Flags(status).RunFunc(status.Run)
+
 	configurer := &Configurer{Client: client}
-	cmd.Command("configure").Flags(configurer).RunFunc(configurer.InstanceFunc(configurer.ConfigureContainer, false))
+	cmd.Command("configure").Flags(configurer).RunFunc(configurer.JobsFunc(configurer.JobList, configurer.InstanceFunc(configurer.ConfigureContainer, false)))
 
 	instanceOps := &InstanceOps{}
 	instanceCmd := cmd.Command("instance").Flags(instanceOps)
@@ -56,6 +67,7 @@ func RootCommand() *command.SimpleCommand {
 	profile.Command("diff").Flags(profileConfigurer).RunFunc(profileConfigurer.InstanceFunc(profileConfigurer.Diff, false))
 	profile.Command("apply").Flags(profileConfigurer).RunFunc(profileConfigurer.InstanceFunc(profileConfigurer.Apply, false))
 	profile.Command("reorder").Flags(profileConfigurer).RunFunc(profileConfigurer.InstanceFunc(profileConfigurer.Reorder, false))
+	profile.Command("sync").Flags(profileConfigurer).RunFunc(profileConfigurer.InstanceFunc(profileConfigurer.Sync, false))
 	profileOps := &lxdutil.ProfileOps{Client: client}
 	profile.Command("export").Flags(profileOps).RunFunc(profileOps.Export)
 	profile.Command("import").Flags(profileOps).RunFunc(profileOps.Import)
@@ -111,12 +123,16 @@ func RootCommand() *command.SimpleCommand {
 	copyProfiles := &lxdutil.ProjectCopyProfiles{Client: client}
 	projectCmd.Command("copy-profiles").Flags(copyProfiles).RunFunc(copyProfiles.CopyProfiles)
 
-	exportOps := &ExportOps{}
-	cmd.Command("export").Flags(exportOps).RunFunc(exportOps.Export)
+	exportOps := &ExportOps{Client: client}
+	exportCmd := cmd.Command("export").Flags(exportOps).RunFunc(exportOps.Export)
+	exportVerify := &ExportOps{}
+	exportCmd.Command("verify").Flags(exportVerify).RunFunc(exportVerify.Verify)
 	cmd.Command("import").Flags(exportOps).RunFunc(exportOps.Import)
 
 	var migrate Migrate
 	cmd.Command("copy-filesystems").Flags(&migrate).RunFunc(migrate.CopyFilesystems)
+	migrateInstance := &MigrateInstance{Client: client}
+	cmd.Command("migrate").Flags(migrateInstance).RunFunc(migrateInstance.InstanceFunc(migrateInstance.Run, false))
 
 	imageOps := &lxdutil.ImageOps{Client: client}
 	imageCmd := cmd.Command("image")
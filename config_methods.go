@@ -6,6 +6,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"melato.org/lxdops/util"
 )
@@ -62,13 +63,43 @@ func (user *User) HomeDir() string {
 	}
 }
 
+// IsVolume returns true if the filesystem is an LXD custom storage volume.
+func (fs *Filesystem) IsVolume() bool {
+	return fs.Type == FilesystemVolume || (fs.Type == "" && fs.Pool != "")
+}
+
 func (config *Config) verifyDevices() bool {
 	valid := true
 	devicePaths := make(map[string]bool)
-	for _, d := range config.Devices {
-		if config.Filesystems[d.Filesystem] == nil {
+	for name, d := range config.Devices {
+		if _, exists := d.Config["type"]; exists {
+			valid = false
+			fmt.Fprintf(os.Stderr, "device %s: specify the device type with type, instead of config\n", name)
+		}
+		if !d.IsDisk() {
+			if d.Filesystem != "" || d.Dir != "" {
+				valid = false
+				fmt.Fprintf(os.Stderr, "device %s: %s device cannot have a filesystem or dir\n", name, d.Type)
+			}
+			if _, exists := d.Config["path"]; exists && d.Path != "" {
+				valid = false
+				fmt.Fprintf(os.Stderr, "device %s: specify the path either with path or with config, not both\n", name)
+			}
+			continue
+		}
+		for _, key := range []string{"path", "source", "pool"} {
+			if _, exists := d.Config[key]; exists {
+				valid = false
+				fmt.Fprintf(os.Stderr, "device %s: disk device config cannot have %s\n", name, key)
+			}
+		}
+		fs := config.Filesystems[d.Filesystem]
+		if fs == nil {
 			valid = false
 			fmt.Fprintf(os.Stderr, "unknown filesystem id: %s\n", d.Filesystem)
+		} else if fs.IsVolume() && d.Dir != "" && d.Dir != "." {
+			valid = false
+			fmt.Fprintf(os.Stderr, "device %s: volume filesystem %s cannot have a dir: %s\n", d.Path, d.Filesystem, d.Dir)
 		}
 		if devicePaths[d.Path] {
 			valid = false
@@ -79,6 +110,33 @@ func (config *Config) verifyDevices() bool {
 	return valid
 }
 
+func (config *Config) verifyFilesystems() bool {
+	valid := true
+	for id, fs := range config.Filesystems {
+		if fs.Pool != "" && fs.Type != "" && fs.Type != FilesystemVolume {
+			valid = false
+			fmt.Fprintf(os.Stderr, "filesystem %s: %s filesystem cannot have a pool\n", id, fs.Type)
+		}
+		switch fs.Type {
+		case "", FilesystemZfs, FilesystemDir:
+		case FilesystemVolume:
+			if fs.Pool == "" {
+				valid = false
+				fmt.Fprintf(os.Stderr, "filesystem %s: missing volume pool\n", id)
+			}
+		case FilesystemBtrfs:
+			if !strings.HasPrefix(string(fs.Pattern), "/") && !strings.HasPrefix(string(fs.Pattern), "(") {
+				valid = false
+				fmt.Fprintf(os.Stderr, "filesystem %s: btrfs pattern should be an absolute path: %s\n", id, fs.Pattern)
+			}
+		default:
+			valid = false
+			fmt.Fprintf(os.Stderr, "filesystem %s: unknown type: %s\n", id, fs.Type)
+		}
+	}
+	return valid
+}
+
 func (config *Config) Verify() bool {
 	valid := true
 	for _, file := range config.CloudConfigFiles {
@@ -89,9 +147,19 @@ func (config *Config) Verify() bool {
 	if !config.VerifyFileExists(config.SourceConfig) {
 		valid = false
 	}
+	if !config.verifyFilesystems() {
+		valid = false
+	}
 	if !config.verifyDevices() {
 		valid = false
 	}
+	if config.Retention != nil {
+		err := config.Retention.Verify()
+		if err != nil {
+			valid = false
+			fmt.Fprintf(os.Stderr, "retention: %v\n", err)
+		}
+	}
 
 	duplicates := config.getDuplicates(config.Profiles)
 	if len(duplicates) > 0 {
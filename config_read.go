@@ -115,6 +115,9 @@ func (r *ConfigReader) mergeInherit(t, c *ConfigInherit) error {
 	if len(c.LxcOptions) != 0 {
 		t.LxcOptions = c.LxcOptions
 	}
+	if c.Retention != nil {
+		t.Retention = c.Retention
+	}
 
 	if t.Filesystems == nil {
 		t.Filesystems = make(map[string]*Filesystem)
@@ -1,6 +1,7 @@
 package lxdops
 
 import (
+	"path/filepath"
 	"testing"
 
 	"melato.org/lxdops/util"
@@ -16,3 +17,95 @@ func TestConfigProfiles(t *testing.T) {
 		t.Fatalf("%v", profiles)
 	}
 }
+
+func TestNonDiskDevices(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.yaml")
+	writeTestFile(t, file, `#lxdops
+properties:
+  http-port: "8080"
+filesystems:
+  root:
+    pattern: z/test/(instance)
+devices:
+  home:
+    path: /home
+    filesystem: root
+    config:
+      readonly: "true"
+  data:
+    path: /data/(instance)
+    filesystem: root
+  http:
+    type: proxy
+    config:
+      listen: tcp:0.0.0.0:(http-port)
+      connect: tcp:127.0.0.1:80
+  tty:
+    type: unix-char
+    path: /dev/tty-(instance)
+`)
+	config, err := ReadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Verify() {
+		t.Fatal("invalid config")
+	}
+	instance, err := NewInstance(nil, config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := instance.NewDeviceMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"home": "path=/home readonly=true source=/z/test/a/home type=disk",
+		"data": "path=/data/a source=/z/test/a/data type=disk",
+		"http": "connect=tcp:127.0.0.1:80 listen=tcp:0.0.0.0:8080 type=proxy",
+		"tty":  "path=/dev/tty-a type=unix-char",
+	}
+	for name, device := range expected {
+		if formatDevice(devices[name]) != device {
+			t.Errorf("%s: %s", name, formatDevice(devices[name]))
+		}
+	}
+	list, err := instance.DeviceList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("disk devices: %v", list)
+	}
+}
+
+func TestVerifyNonDiskDevices(t *testing.T) {
+	config := &Config{}
+	config.Filesystems = map[string]*Filesystem{"root": {Pattern: "z/test/(instance)"}}
+	config.Devices = map[string]*Device{
+		"eth0": {Type: "nic", Filesystem: "root"},
+	}
+	if config.verifyDevices() {
+		t.Errorf("accepted nic device with a filesystem")
+	}
+	config.Devices = map[string]*Device{
+		"home": {Path: "/home", Filesystem: "root", Config: map[string]Pattern{"source": "/tmp"}},
+	}
+	if config.verifyDevices() {
+		t.Errorf("accepted disk device with source")
+	}
+	config.Devices = map[string]*Device{
+		"tty": {Type: "unix-char", Path: "/dev/tty1", Config: map[string]Pattern{"path": "/dev/tty2"}},
+	}
+	if config.verifyDevices() {
+		t.Errorf("accepted device with two paths")
+	}
+	config.Devices = map[string]*Device{
+		"eth0": {Type: "nic", Config: map[string]Pattern{"network": "lxdbr0"}},
+		"home": {Path: "/home", Filesystem: "root"},
+	}
+	if !config.verifyDevices() {
+		t.Errorf("rejected valid devices")
+	}
+}
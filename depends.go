@@ -0,0 +1,146 @@
+package lxdops
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// sourceNames returns the names of the instances and containers that an instance is copied or cloned from.
+func (t *Instance) sourceNames() (instances []string, containers []string, err error) {
+	config := t.Config
+	instances = append(instances, config.DependsOn...)
+	origin, err := config.Origin.Substitute(t.Properties)
+	if err != nil {
+		return nil, nil, err
+	}
+	if origin != "" {
+		var source ContainerSource
+		source.parse(origin)
+		containers = append(containers, source.Container)
+	}
+	template, err := config.DeviceTemplate.Substitute(t.Properties)
+	if err != nil {
+		return nil, nil, err
+	}
+	if template != "" {
+		instances = append(instances, template)
+	}
+	deviceOrigin, err := config.DeviceOrigin.Substitute(t.Properties)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deviceOrigin != "" {
+		instances = append(instances, strings.Split(deviceOrigin, "@")[0])
+	}
+	return instances, containers, nil
+}
+
+// dependencies returns, for each instance, the indexes of the instances that it depends on.
+// Dependencies on instances that are not in the list are ignored, since they should already exist.
+func dependencies(instances []*Instance) ([][]int, error) {
+	byName := make(map[string]int)
+	byContainer := make(map[string]int)
+	byFile := make(map[string]int)
+	for i, instance := range instances {
+		byName[instance.Name] = i
+		byContainer[instance.Container()] = i
+		if instance.file != "" {
+			file, err := filepath.Abs(instance.file)
+			if err != nil {
+				return nil, err
+			}
+			byFile[file] = i
+		}
+	}
+	deps := make([][]int, len(instances))
+	for i, instance := range instances {
+		set := make(map[int]bool)
+		add := func(j int, exists bool) {
+			if exists && j != i && !set[j] {
+				set[j] = true
+				deps[i] = append(deps[i], j)
+			}
+		}
+		names, containers, err := instance.sourceNames()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", instance.Name, err)
+		}
+		for _, name := range names {
+			j, exists := byName[name]
+			add(j, exists)
+		}
+		for _, container := range containers {
+			j, exists := byContainer[container]
+			add(j, exists)
+		}
+		if instance.Config.SourceConfig != "" {
+			file, err := filepath.Abs(string(instance.Config.SourceConfig))
+			if err != nil {
+				return nil, err
+			}
+			j, exists := byFile[file]
+			add(j, exists)
+		}
+	}
+	return deps, nil
+}
+
+func reverseDependencies(deps [][]int) [][]int {
+	reverse := make([][]int, len(deps))
+	for i, list := range deps {
+		for _, j := range list {
+			reverse[j] = append(reverse[j], i)
+		}
+	}
+	return reverse
+}
+
+// dependencyOrder returns the indexes of the instances in an order where each instance follows its dependencies.
+// Otherwise, it keeps the order of the instances.  labels identify the instances in the error message.
+// It returns an error if there is a dependency cycle.
+func dependencyOrder(deps [][]int, labels []string) ([]int, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make([]int, len(deps))
+	var order []int
+	var path []int
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			var cycle []string
+			for k := len(path) - 1; k >= 0; k-- {
+				cycle = append([]string{labels[path[k]]}, cycle...)
+				if path[k] == i {
+					break
+				}
+			}
+			cycle = append(cycle, labels[i])
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+		state[i] = visiting
+		path = append(path, i)
+		for _, j := range deps[i] {
+			err := visit(j)
+			if err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		order = append(order, i)
+		return nil
+	}
+	for i := range deps {
+		err := visit(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,75 @@
+package lxdops
+
+import (
+	"testing"
+)
+
+func newDependencyInstance(t *testing.T, name string, configure func(config *Config)) *Instance {
+	t.Helper()
+	config := &Config{}
+	configure(config)
+	instance, err := newInstance(nil, config, name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+func TestDependencies(t *testing.T) {
+	configs := []string{"app.yaml", "db.yaml", "template.yaml", "test.yaml"}
+	instances := []*Instance{
+		newDependencyInstance(t, "app", func(c *Config) {
+			c.DependsOn = []string{"db", "other"}
+			c.Origin = "template/copy"
+		}),
+		newDependencyInstance(t, "db", func(c *Config) {
+			c.DeviceTemplate = "template"
+		}),
+		newDependencyInstance(t, "template", func(c *Config) {}),
+		newDependencyInstance(t, "test", func(c *Config) {
+			c.DeviceOrigin = "(instance)-prod@copy"
+			c.Properties = map[string]string{}
+		}),
+	}
+	deps, err := dependencies(instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps[0]) != 2 || deps[0][0] != 1 || deps[0][1] != 2 {
+		t.Fatalf("app: %v", deps[0])
+	}
+	if len(deps[1]) != 1 || deps[1][0] != 2 {
+		t.Fatalf("db: %v", deps[1])
+	}
+	if len(deps[2]) != 0 || len(deps[3]) != 0 {
+		t.Fatalf("%v", deps)
+	}
+	order, err := dependencyOrder(deps, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{2, 1, 0, 3}
+	for i, j := range expected {
+		if order[i] != j {
+			t.Fatalf("order: %v", order)
+		}
+	}
+	order, err = dependencyOrder(reverseDependencies(deps), configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []int{0, 1, 2, 3}
+	for i, j := range expected {
+		if order[i] != j {
+			t.Fatalf("reverse order: %v", order)
+		}
+	}
+}
+
+func TestDependencyCycle(t *testing.T) {
+	configs := []string{"a.yaml", "b.yaml", "c.yaml"}
+	_, err := dependencyOrder([][]int{{1}, {2}, {0}}, configs)
+	if err == nil || err.Error() != "dependency cycle: a.yaml -> b.yaml -> c.yaml -> a.yaml" {
+		t.Fatalf("%v", err)
+	}
+}
@@ -1,40 +1,189 @@
 package lxdops
 
 import (
+	"bufio"
+	"crypto/cipher"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
+	"melato.org/lxdops/yaml"
 )
 
 var TraceExport bool
 
 type ExportOps struct {
 	ConfigOptions
-	Dir      string `name:"d" usage:"import/export directory"`
+	Dir      string `name:"d" usage:"import/export directory, or - for a tar archive on stdout/stdin"`
 	Snapshot string `name:"snapshot" usage:"short name of snapshot to export"`
+	Format   string `name:"format" usage:"export format: tar, or zfs, for zfs send streams of zfs filesystems"`
 	Image    bool   `name:"image" usage:"export/import lxc image too -- experimental"`
-	DryRun   bool
+	Bundle   bool   `name:"bundle" usage:"export/import the container, its profiles, and the merged config too"`
+	Tmp      string `name:"tmp" usage:"parent of the snapshot mount point of an export archive"`
+	// KeyFile and KeyProperty are alternative sources of the encryption secret
+	KeyFile     string `name:"key-file" usage:"encrypt/decrypt the export files with a key derived from the content of this file"`
+	KeyProperty string `name:"key-property" usage:"encrypt/decrypt the export files with a key derived from the value of this property"`
+	DryRun      bool
+	// Host runs host commands.  If nil, a ScriptRunner is used.
+	Host   HostRunner         `name:"-"`
+	Client *lxdutil.LxdClient `name:"-"`
+}
+
+func (t *ExportOps) Init() error {
+	t.Format = ExportTar
+	return t.ConfigOptions.Init()
+}
+
+func (t *ExportOps) Configured() error {
+	switch t.Format {
+	case ExportTar:
+	case ExportZfs:
+		if t.Snapshot == "" {
+			return errors.New("the zfs export format requires a snapshot")
+		}
+	default:
+		return fmt.Errorf("unknown export format: %s", t.Format)
+	}
+	return t.ConfigOptions.Configured()
+}
+
+func (t *ExportOps) host() HostRunner {
+	if t.Host == nil {
+		return &ScriptRunner{Trace: TraceExport, DryRun: t.DryRun}
+	}
+	return t.Host
 }
 
 func (t *ExportOps) Run(name string, arg ...string) error {
-	cmd := exec.Command(name, arg...)
+	return t.host().Run(name, arg...)
+}
+
+// mkdir creates an export directory with sudo, since it may be in a directory that only root can write,
+// and makes it owned by the current user, since lxdops writes the manifest without sudo.
+func (t *ExportOps) mkdir(dir string) error {
+	err := t.Run("sudo", "mkdir", "-p", dir)
+	if err != nil {
+		return err
+	}
+	return t.Run("sudo", "chown", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()), dir)
+}
+
+// zfsProperties returns the properties that are set locally on a zfs filesystem
+func (t *ExportOps) zfsProperties(fs *InstanceFS) (map[string]string, error) {
+	lines, err := t.host().Lines("zfs", "get", "-H", "-o", "property,value", "-s", "local", "all", fs.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fs.Path, err)
+	}
+	properties := make(map[string]string)
+	for _, line := range lines {
+		key, value, found := strings.Cut(line, "\t")
+		if found {
+			properties[key] = value
+		}
+	}
+	return properties, nil
+}
+
+// writeFile creates an export file, writes it with f, and sets its size and checksum.
+func (t *ExportOps) writeFile(files *exportFiles, file *ExportedFile, f func(w io.Writer) error) error {
+	out, err := files.Create(file)
+	if err != nil {
+		return err
+	}
+	err = f(out)
+	err2 := out.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", file.File, err)
+	}
+	return nil
+}
+
+// addFile writes an export file, other than a filesystem file, and adds it to the manifest.
+func (t *ExportOps) addFile(files *exportFiles, manifest *ExportManifest, name string, f func(w io.Writer) error) error {
+	file := &ExportedFile{File: name}
+	manifest.Files = append(manifest.Files, file)
+	return t.writeFile(files, file, f)
+}
+
+// addImageFiles adds the exported image files of an export directory to the manifest.
+// These are the files that lxc image export created in the directory.
+func (t *ExportOps) addImageFiles(dir string, manifest *ExportManifest) error {
+	known := make(map[string]bool)
+	for _, file := range manifest.AllFiles() {
+		known[file.File] = true
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && !known[name] && name != ExportManifestFile {
+			file := &ExportedFile{File: name}
+			err := file.Checksum(dir)
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, file)
+		}
+	}
+	return nil
+}
+
+// writeManifest writes the manifest, which is the last export file.  It is not encrypted.
+func (t *ExportOps) writeManifest(w exportWriter, manifest *ExportManifest) error {
 	if TraceExport {
-		fmt.Printf("%s\n", cmd.String())
+		fmt.Printf("write %s\n", ExportManifestFile)
 	}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return writeYamlFile(w, ExportManifestFile, manifest)
+}
+
+// writeYamlFile writes v to an export file, as yaml
+func writeYamlFile(w exportWriter, name string, v interface{}) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	out, err := w.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	err2 := out.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
 }
 
 func (t *ExportOps) Export(configFile string) error {
-	TraceExport = true
+	if t.Dir == ExportStreamDir {
+		return withStdoutToStderr(func(stdout io.Writer) error {
+			return t.exportStream(configFile, stdout)
+		})
+	}
 	instance, err := t.Instance(configFile)
 	if err != nil {
 		return err
 	}
 	dir := t.Dir
-	filesystems, err := instance.FilesystemList()
+	var w exportWriter = &dirWriter{Dir: dir}
+	if t.DryRun {
+		w = discardWriter{}
+	}
+	files, err := t.newExportFiles(instance, w)
 	if err != nil {
 		return err
 	}
@@ -44,54 +193,271 @@ func (t *ExportOps) Export(configFile string) error {
 			return err
 		}
 	}
-	err = t.Run("sudo", "mkdir", "-p", dir)
+	err = t.mkdir(dir)
 	if err != nil {
 		return err
 	}
-
-	var mntDir string
-	if t.Snapshot != "" {
-		mntDir = filepath.Join(dir, "mnt")
-		err := t.Run("sudo", "mkdir", "-p", mntDir)
+	manifest, err := t.export(instance, files, filepath.Join(dir, "mnt"))
+	if err != nil {
+		return err
+	}
+	if t.Image && !t.DryRun {
+		err = t.addImageFiles(dir, manifest)
 		if err != nil {
 			return err
 		}
-		defer t.Run("sudo", "rmdir", mntDir)
 	}
+	return t.writeManifest(w, manifest)
+}
 
+// export writes the filesystems of an instance, and its bundle, to files.
+// It returns the manifest of the files, without writing it.
+// The zfs streams are written first, so that import can receive them before it creates the other filesystems.
+// mntDir is the mount point for exporting zfs snapshots in tar format.
+// If it is empty, a temporary directory is used.
+func (t *ExportOps) export(instance *Instance, files *exportFiles, mntDir string) (*ExportManifest, error) {
+	TraceExport = true
+	filesystems, err := instance.FilesystemList()
+	if err != nil {
+		return nil, err
+	}
+	var streams, tars []*InstanceFS
 	for _, fs := range filesystems {
 		if fs.Filesystem.Transient {
 			continue
 		}
-		tarFile := filepath.Join(dir, fs.Id+".tar.gz")
-		var err error
-		if t.Snapshot == "" || fs.IsDir() {
-			err = t.Run("sudo", "tar", "cfz", tarFile, "-C", fs.Dir(), ".")
+		if fs.IsVolume() {
+			fmt.Printf("skipping volume %s: volumes cannot be exported\n", fs.VolumeName())
+			continue
+		}
+		if t.Format == ExportZfs && fs.IsZfs() {
+			streams = append(streams, fs)
 		} else {
-			err = t.Run("sudo", "mount", "-t", "zfs", "-o", "ro", fs.Path+"@"+t.Snapshot, mntDir)
+			tars = append(tars, fs)
+		}
+	}
+	if t.Snapshot != "" && t.Format != ExportZfs {
+		if mntDir == "" {
+			mntDir, err = os.MkdirTemp(t.Tmp, "lxdops-mnt-")
 			if err != nil {
-				return err
+				return nil, err
 			}
-			err = t.Run("sudo", "tar", "cfz", tarFile, "-C", mntDir, ".")
-			err2 := t.Run("sudo", "umount", mntDir)
-			if err == nil {
-				err = err2
+			defer os.Remove(mntDir)
+		} else {
+			err := t.Run("sudo", "mkdir", "-p", mntDir)
+			if err != nil {
+				return nil, err
 			}
+			defer t.Run("sudo", "rmdir", mntDir)
+		}
+	}
+
+	manifest := &ExportManifest{Instance: instance.Name, Snapshot: t.Snapshot, LxdopsVersion: Version, Encryption: files.Encryption}
+	for _, fs := range streams {
+		efs := &ExportedFS{Id: fs.Id, Pattern: string(fs.Filesystem.Pattern), Format: ExportZfs}
+		efs.File = fs.Id + ".zfs"
+		efs.Zfsproperties, err = t.zfsProperties(fs)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Filesystems = append(manifest.Filesystems, efs)
+		err = t.writeFile(files, &efs.ExportedFile, func(out io.Writer) error {
+			// zfs send -p includes the properties in the stream
+			send := exec.Command("sudo", "zfs", "send", "-p", fs.SnapshotPath(t.Snapshot))
+			send.Stdout = out
+			return t.host().RunCmd(send)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, fs := range tars {
+		efs := &ExportedFS{Id: fs.Id, Pattern: string(fs.Filesystem.Pattern), Format: ExportTar}
+		efs.File = fs.Id + ".tar.gz"
+		manifest.Filesystems = append(manifest.Filesystems, efs)
+		err = t.writeFile(files, &efs.ExportedFile, func(out io.Writer) error {
+			return t.exportTar(fs, mntDir, out)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.Bundle {
+		err = t.exportBundle(instance, files, manifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// tar writes a tar.gz archive of a directory to w
+func (t *ExportOps) tar(dir string, w io.Writer) error {
+	cmd := exec.Command("sudo", "tar", "cfz", "-", "-C", dir, ".")
+	cmd.Stdout = w
+	return t.host().RunCmd(cmd)
+}
+
+// exportTar writes a tar.gz archive of a filesystem, or of its snapshot, to w
+func (t *ExportOps) exportTar(fs *InstanceFS, mntDir string, w io.Writer) error {
+	if t.Snapshot == "" || fs.IsDir() {
+		return t.tar(fs.Dir(), w)
+	}
+	if fs.IsBtrfs() {
+		// btrfs snapshots are directories
+		return t.tar(fs.SnapshotPath(t.Snapshot), w)
+	}
+	err := t.Run("sudo", "mount", "-t", "zfs", "-o", "ro", fs.Path+"@"+t.Snapshot, mntDir)
+	if err != nil {
+		return err
+	}
+	err = t.tar(mntDir, w)
+	err2 := t.Run("sudo", "umount", mntDir)
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+// backupContainer downloads an LXD backup of the container, without its snapshots, to w.
+func (t *ExportOps) backupContainer(server lxd.InstanceServer, container string, w io.Writer) error {
+	backup := "lxdops-export"
+	op, err := server.CreateInstanceBackup(container, api.InstanceBackupsPost{Name: backup,
+		ExpiresAt: time.Now().Add(24 * time.Hour), InstanceOnly: true})
+	if err == nil {
+		err = op.Wait()
+	}
+	if err != nil {
+		return lxdutil.AnnotateLXDError(container, err)
+	}
+	defer func() {
+		op, err := server.DeleteInstanceBackup(container, backup)
+		if err == nil {
+			err = op.Wait()
+		}
+		if err != nil {
+			fmt.Printf("delete backup %s/%s: %v\n", container, backup, err)
+		}
+	}()
+	_, err = server.GetInstanceBackupFile(container, backup, &lxd.BackupFileRequest{BackupFile: writeSeeker{w}})
+	if err != nil {
+		return lxdutil.AnnotateLXDError(container, err)
+	}
+	return nil
+}
+
+// exportBundle exports the merged config, the container profiles, and an LXD backup of the container,
+// and adds them to the manifest.
+func (t *ExportOps) exportBundle(instance *Instance, files *exportFiles, manifest *ExportManifest) error {
+	server, err := t.Client.ProjectServer(instance.Config.Project)
+	if err != nil {
+		return err
+	}
+	container := instance.Container()
+	c, _, err := server.GetInstance(container)
+	if err != nil {
+		return lxdutil.AnnotateLXDError(container, err)
+	}
+	bundle := &ExportedBundle{Container: container, Backup: BundleBackupFile, Profiles: c.Profiles, Config: instance.Name + ".yaml"}
+	manifest.Bundle = bundle
+	if TraceExport {
+		fmt.Printf("write %s\n", bundle.Config)
+		fmt.Printf("export profiles %s to %s\n", strings.Join(c.Profiles, " "), BundleProfilesDir)
+		fmt.Printf("backup %s to %s\n", container, bundle.Backup)
+	}
+	if t.DryRun {
+		return nil
+	}
+	config, err := MarshalConfigYaml(instance.Config)
+	if err != nil {
+		return err
+	}
+	err = t.addFile(files, manifest, bundle.Config, func(out io.Writer) error {
+		_, err := out.Write(config)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, profile := range c.Profiles {
+		data, err := lxdutil.MarshalProfile(server, profile)
+		if err != nil {
+			return err
+		}
+		err = t.addFile(files, manifest, path.Join(BundleProfilesDir, profile), func(out io.Writer) error {
+			_, err := out.Write(data)
+			return err
+		})
+		if err != nil {
+			return err
 		}
+	}
+	return t.addFile(files, manifest, bundle.Backup, func(out io.Writer) error {
+		return t.backupContainer(server, container, out)
+	})
+}
+
+// Verify verifies an export directory without extracting it: the size and checksum of every file in its manifest,
+// and that the manifest has every exported filesystem of the instance.
+// The instance config is the specified config file, or else the config of a bundle export.
+func (t *ExportOps) Verify(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: <dir> [<config.yaml>]")
+	}
+	dir := args[0]
+	manifest, err := ReadExportManifest(dir)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("%s: missing %s", dir, ExportManifestFile)
+	}
+	if len(args) == 2 {
+		instance, err := t.Instance(args[1])
 		if err != nil {
 			return err
 		}
+		if instance.Name != manifest.Instance {
+			fmt.Printf("instance %s was exported as %s\n", instance.Name, manifest.Instance)
+		}
+		err = manifest.Validate(instance, dir)
+		if err != nil {
+			return err
+		}
+	} else if manifest.Bundle != nil && manifest.Bundle.Config != "" {
+		// verify the files first, so that the bundle config is not used if it was modified
+		err = manifest.VerifyFiles(dir)
+		if err != nil {
+			return err
+		}
+		instance, err := t.Instance(filepath.Join(dir, manifest.Bundle.Config))
+		if err != nil {
+			return err
+		}
+		err = manifest.ValidateFilesystems(instance)
+		if err != nil {
+			return err
+		}
+	} else {
+		return fmt.Errorf("%s: the export has no config, so specify the config file of %s, to verify that the export is complete", dir, manifest.Instance)
 	}
+	fmt.Printf("verified %d files\n", len(manifest.AllFiles()))
 	return nil
 }
 
 func (t *ExportOps) Import(configFile string) error {
+	if t.Dir == ExportStreamDir {
+		if t.Image {
+			return errors.New("--image requires an export directory")
+		}
+		return t.importStream(configFile, os.Stdin)
+	}
 	instance, err := t.Instance(configFile)
 	if err != nil {
 		return err
 	}
 	dir := t.Dir
-	filesystems, err := instance.FilesystemList()
+	manifest, err := ReadExportManifest(dir)
 	if err != nil {
 		return err
 	}
@@ -101,27 +467,291 @@ func (t *ExportOps) Import(configFile string) error {
 			return err
 		}
 	}
-	dev, err := NewDeviceConfigurer(instance)
+	importer, err := t.newImporter(instance)
 	if err != nil {
 		return err
 	}
-	dev.NoRsync = true
-	dev.Trace = TraceExport
-	dev.DryRun = t.DryRun
-	err = dev.ConfigureDevices(instance)
+	var files []string
+	if manifest != nil && manifest.Encryption != nil {
+		err = importer.decrypt(manifest.Encryption)
+		if err != nil {
+			return err
+		}
+		err = manifest.ValidateFilesystems(instance)
+		if err == nil {
+			err = manifest.Encryption.VerifyFiles(importer.aead, dir, manifest.AllFiles())
+		}
+	} else if manifest != nil {
+		err = manifest.Validate(instance, dir)
+	}
 	if err != nil {
 		return err
 	}
+	if manifest != nil {
+		if t.Bundle && manifest.Bundle == nil {
+			return fmt.Errorf("%s: not a bundle export", dir)
+		}
+		// receive the zfs streams first, since an older export may have them after the tar files
+		var tars []string
+		for _, efs := range manifest.Filesystems {
+			if efs.Format == ExportZfs {
+				files = append(files, efs.File)
+			} else {
+				tars = append(tars, efs.File)
+			}
+		}
+		files = append(files, tars...)
+		for _, file := range manifest.Files {
+			files = append(files, file.File)
+		}
+	} else {
+		if t.Bundle {
+			return fmt.Errorf("%s: not a bundle export", dir)
+		}
+		filesystems, err := instance.FilesystemList()
+		if err != nil {
+			return err
+		}
+		for _, fs := range filesystems {
+			if !fs.Filesystem.Transient && !fs.IsVolume() {
+				files = append(files, fs.Id+".tar.gz")
+			}
+		}
+	}
+	for _, file := range files {
+		err := importer.importDirFile(dir, file)
+		if err != nil {
+			return err
+		}
+	}
+	return importer.Finish()
+}
+
+// importer restores the files of an export, as they are read, in the order that export writes them:
+// the zfs streams, the tar files of the other filesystems, and the bundle files.
+type importer struct {
+	ops      *ExportOps
+	instance *Instance
+	// filesystems are the filesystems of the instance that can be imported, by id
+	filesystems map[string]*InstanceFS
+	// received are the filesystems that were received from zfs streams
+	received   []*InstanceFS
+	configured bool
+	// encryption is set when the export files are encrypted
+	encryption *ExportEncryption
+	aead       cipher.AEAD
+	server     lxd.InstanceServer
+	// profiles are the existing profiles
+	profiles map[string]bool
+	restored bool
+}
 
+// newImporter creates an importer for an instance.
+// For a bundle import, it checks that the container does not exist.
+func (t *ExportOps) newImporter(instance *Instance) (*importer, error) {
+	filesystems, err := instance.FilesystemList()
+	if err != nil {
+		return nil, err
+	}
+	imp := &importer{ops: t, instance: instance, filesystems: make(map[string]*InstanceFS)}
 	for _, fs := range filesystems {
-		if fs.Filesystem.Transient {
-			continue
+		if !fs.Filesystem.Transient && !fs.IsVolume() {
+			imp.filesystems[fs.Id] = fs
 		}
-		tarFile := filepath.Join(dir, fs.Id+".tar.gz")
-		err = t.Run("sudo", "tar", "xfz", tarFile, "-C", fs.Dir(), ".")
+	}
+	if t.Bundle {
+		imp.server, err = t.Client.ProjectServer(instance.Config.Project)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		container := instance.Container()
+		if _, _, err := imp.server.GetInstance(container); err == nil {
+			return nil, fmt.Errorf("container %s already exists", container)
+		}
+		names, err := imp.server.GetProfileNames()
+		if err != nil {
+			return nil, err
+		}
+		imp.profiles = make(map[string]bool)
+		for _, name := range names {
+			imp.profiles[name] = true
+		}
+	}
+	return imp, nil
+}
+
+// ImportFile restores an export file from r, decrypting it, if the export is encrypted.
+// It reads all of r, so that all of it is verified, even if it is not restored.
+func (t *importer) ImportFile(name string, r io.Reader) error {
+	if t.encryption != nil {
+		if !strings.HasSuffix(name, EncryptedSuffix) {
+			return fmt.Errorf("%s: not an encrypted file", name)
+		}
+		name = strings.TrimSuffix(name, EncryptedSuffix)
+		r = t.encryption.NewReader(t.aead, name, r)
+	}
+	in := bufio.NewReader(r)
+	// read the first chunk, so that a wrong key, or a corrupt file, is detected before anything is restored from it
+	if _, err := in.Peek(1); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	err := t.importFile(name, in)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, in)
+	return err
+}
+
+// importFile restores an unencrypted export file from r.
+// It ignores the files that it does not restore, such as the config of a bundle,
+// or the bundle files, when the import is not a bundle import.
+func (t *importer) importFile(name string, r io.Reader) error {
+	switch {
+	case strings.HasSuffix(name, ".zfs"):
+		fs, found := t.filesystems[strings.TrimSuffix(name, ".zfs")]
+		if !found {
+			return fmt.Errorf("%s: the filesystem is not in the config", name)
+		}
+		return t.receive(fs, r)
+	case strings.HasSuffix(name, ".tar.gz"):
+		if fs, found := t.filesystems[strings.TrimSuffix(name, ".tar.gz")]; found {
+			return t.extract(fs, r)
 		}
+	case strings.HasPrefix(name, BundleProfilesDir+"/"):
+		if t.ops.Bundle {
+			return t.importProfile(path.Base(name), r)
+		}
+	case name == BundleBackupFile:
+		if t.ops.Bundle {
+			return t.restore(r)
+		}
+	}
+	return nil
+}
+
+// importDirFile restores a file of an export directory
+func (t *importer) importDirFile(dir string, name string) error {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return t.ImportFile(name, f)
+}
+
+// receive receives a zfs stream into a filesystem.
+// It creates the parent of the filesystem, unless the parent was received.
+func (t *importer) receive(fs *InstanceFS, r io.Reader) error {
+	if t.configured {
+		return fmt.Errorf("filesystem %s: unexpected zfs stream after the tar files", fs.Id)
+	}
+	if !fs.IsZfs() {
+		return fmt.Errorf("filesystem %s: cannot import zfs stream into %s filesystem", fs.Id, fs.Type())
+	}
+	var received bool
+	for _, parent := range t.received {
+		if strings.HasPrefix(fs.Path, parent.Path+"/") {
+			received = true
+			break
+		}
+	}
+	if !received {
+		for _, parent := range InstanceFSList([]*InstanceFS{fs}).ParentPaths() {
+			err := t.ops.Run("sudo", "zfs", "create", "-p", parent)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	t.received = append(t.received, fs)
+	cmd := exec.Command("sudo", "zfs", "receive", fs.Path)
+	cmd.Stdin = r
+	return t.ops.host().RunCmd(cmd)
+}
+
+// configure creates the filesystems and devices that were not received, once.
+func (t *importer) configure() error {
+	if t.configured {
+		return nil
+	}
+	t.configured = true
+	dev, err := NewDeviceConfigurer(t.instance)
+	if err != nil {
+		return err
+	}
+	dev.NoRsync = true
+	dev.Trace = TraceExport
+	dev.DryRun = t.ops.DryRun
+	dev.Host = t.ops.Host
+	return dev.ConfigureDevices(t.instance)
+}
+
+// extract extracts a tar.gz archive into a filesystem
+func (t *importer) extract(fs *InstanceFS, r io.Reader) error {
+	err := t.configure()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("sudo", "tar", "xfz", "-", "-C", fs.Dir(), ".")
+	cmd.Stdin = r
+	return t.ops.host().RunCmd(cmd)
+}
+
+// importProfile creates an exported profile, if it does not exist.
+// Existing profiles are not modified.
+func (t *importer) importProfile(profile string, r io.Reader) error {
+	if t.profiles[profile] {
+		fmt.Printf("profile %s exists\n", profile)
+		return nil
+	}
+	fmt.Printf("create profile %s\n", profile)
+	if t.ops.DryRun {
+		return nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	profileOps := &lxdutil.ProfileOps{}
+	return profileOps.ImportProfileData(t.server, profile, data, t.profiles)
+}
+
+// restore creates the container from the LXD backup of a bundle, after the filesystems and devices.
+func (t *importer) restore(r io.Reader) error {
+	err := t.configure()
+	if err != nil {
+		return err
+	}
+	t.restored = true
+	return t.ops.restoreContainer(t.server, t.instance.Container(), r)
+}
+
+// Finish creates the filesystems and devices, if no file has created them,
+// and checks that a bundle import has restored the container.
+func (t *importer) Finish() error {
+	err := t.configure()
+	if err != nil {
+		return err
+	}
+	if t.ops.Bundle && !t.restored {
+		return fmt.Errorf("the export has no %s", BundleBackupFile)
+	}
+	return nil
+}
+
+// restoreContainer creates the container from the LXD backup of a bundle, read from r.
+func (t *ExportOps) restoreContainer(server lxd.InstanceServer, container string, r io.Reader) error {
+	fmt.Printf("restore %s\n", container)
+	if t.DryRun {
+		return nil
+	}
+	op, err := server.CreateInstanceFromBackup(lxd.InstanceBackupArgs{BackupFile: r, Name: container})
+	if err == nil {
+		err = op.Wait()
+	}
+	if err != nil {
+		return lxdutil.AnnotateLXDError(container, err)
 	}
 	return nil
 }
@@ -0,0 +1,334 @@
+package lxdops
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted export files have this suffix, after the suffix of the unencrypted file.
+const EncryptedSuffix = ".enc"
+
+// ExportEncryptionFile is the first file of an encrypted export archive.  It has the encryption parameters.
+const ExportEncryptionFile = "encryption.yaml"
+
+// Export encryption parameters
+const (
+	ExportCipher = "aes-256-gcm"
+	ExportKDF    = "scrypt"
+	// encryptChunkSize is the size of the plaintext chunks that are encrypted separately
+	encryptChunkSize = 64 * 1024
+	// encryptNoncePrefixSize is the size of the random nonce prefix at the start of each encrypted file
+	encryptNoncePrefixSize = 7
+)
+
+// ExportEncryption has the parameters that were used to encrypt the files of an export.
+// The encryption key is derived from a secret (a passphrase or the content of a key file) with scrypt.
+// Each file is encrypted in chunks with AES-256-GCM, so that it can be decrypted as a stream.
+// The nonce of each chunk consists of a random prefix, stored at the start of the file,
+// the chunk number, and a flag that marks the last chunk, so that chunks cannot be reordered or truncated.
+// The name of the unencrypted file is authenticated with each chunk, so that files cannot be swapped.
+type ExportEncryption struct {
+	Cipher string `yaml:"cipher"`
+	KDF    string `yaml:"kdf"`
+	// Salt is the hex scrypt salt
+	Salt string `yaml:"salt"`
+	N    int    `yaml:"n"`
+	R    int    `yaml:"r"`
+	P    int    `yaml:"p"`
+	// ChunkSize is the size of each encrypted plaintext chunk
+	ChunkSize int `yaml:"chunk-size"`
+}
+
+// NewExportEncryption creates encryption parameters with a new random salt
+func NewExportEncryption() (*ExportEncryption, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &ExportEncryption{Cipher: ExportCipher, KDF: ExportKDF, Salt: hex.EncodeToString(salt),
+		N: 1 << 15, R: 8, P: 1, ChunkSize: encryptChunkSize}, nil
+}
+
+// AEAD derives the encryption key from a secret, and returns the cipher for it.
+func (t *ExportEncryption) AEAD(secret []byte) (cipher.AEAD, error) {
+	if t.Cipher != ExportCipher || t.KDF != ExportKDF {
+		return nil, fmt.Errorf("unsupported encryption: %s/%s", t.Cipher, t.KDF)
+	}
+	if t.ChunkSize <= 0 {
+		return nil, fmt.Errorf("invalid encryption chunk size: %d", t.ChunkSize)
+	}
+	salt, err := hex.DecodeString(t.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("encryption salt: %w", err)
+	}
+	key, err := scrypt.Key(secret, salt, t.N, t.R, t.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, chunk uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptNoncePrefixSize:], chunk)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// NewWriter returns a writer that encrypts to w.  name is the name of the unencrypted file.
+// Closing the writer writes the last chunk, and closes w.
+func (t *ExportEncryption) NewWriter(aead cipher.AEAD, name string, w io.WriteCloser) io.WriteCloser {
+	return &encryptWriter{aead: aead, name: []byte(name), w: w, buf: make([]byte, 0, t.ChunkSize)}
+}
+
+// NewReader returns a reader that decrypts r.  name is the name of the unencrypted file.
+// The reader returns an error if r is not authentic, or if it is truncated.
+func (t *ExportEncryption) NewReader(aead cipher.AEAD, name string, r io.Reader) io.Reader {
+	return &decryptReader{aead: aead, name: name, in: bufio.NewReader(r), buf: make([]byte, t.ChunkSize+aead.Overhead())}
+}
+
+// Encrypt encrypts r to w.  name is the name of the unencrypted file.
+func (t *ExportEncryption) Encrypt(aead cipher.AEAD, name string, r io.Reader, w io.Writer) error {
+	out := t.NewWriter(aead, name, nopWriteCloser{w})
+	_, err := io.Copy(out, r)
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// Decrypt decrypts r to w.  name is the name of the unencrypted file.
+func (t *ExportEncryption) Decrypt(aead cipher.AEAD, name string, r io.Reader, w io.Writer) error {
+	_, err := io.Copy(w, t.NewReader(aead, name, r))
+	return err
+}
+
+// encryptWriter encrypts each chunk, when it is full and more data follows it,
+// so that a full chunk can be the last chunk.
+type encryptWriter struct {
+	aead   cipher.AEAD
+	name   []byte
+	w      io.WriteCloser
+	prefix []byte
+	chunk  uint32
+	buf    []byte
+}
+
+// seal encrypts and writes the buffered chunk.  The random prefix is written before the first chunk.
+func (t *encryptWriter) seal(last bool) error {
+	if t.prefix == nil {
+		t.prefix = make([]byte, encryptNoncePrefixSize)
+		_, err := rand.Read(t.prefix)
+		if err != nil {
+			return err
+		}
+		_, err = t.w.Write(t.prefix)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := t.w.Write(t.aead.Seal(nil, chunkNonce(t.prefix, t.chunk, last), t.buf, t.name))
+	if err != nil {
+		return err
+	}
+	t.chunk++
+	t.buf = t.buf[:0]
+	return nil
+}
+
+func (t *encryptWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if len(t.buf) == cap(t.buf) {
+			err := t.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(t.buf[len(t.buf):cap(t.buf)], p)
+		t.buf = t.buf[:len(t.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the last chunk, which is empty if the input is empty, and closes the underlying writer.
+func (t *encryptWriter) Close() error {
+	err := t.seal(true)
+	err2 := t.w.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+type decryptReader struct {
+	aead   cipher.AEAD
+	name   string
+	in     *bufio.Reader
+	prefix []byte
+	chunk  uint32
+	buf    []byte
+	plain  []byte
+	last   bool
+	err    error
+}
+
+// open decrypts the next chunk
+func (t *decryptReader) open() error {
+	if t.prefix == nil {
+		t.prefix = make([]byte, encryptNoncePrefixSize)
+		_, err := io.ReadFull(t.in, t.prefix)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.name, err)
+		}
+	}
+	n, err := io.ReadFull(t.in, t.buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	last := err != nil
+	if !last {
+		// a full chunk is the last chunk, if nothing follows it
+		_, err := t.in.Peek(1)
+		last = errors.Is(err, io.EOF)
+	}
+	t.plain, err = t.aead.Open(t.buf[:0], chunkNonce(t.prefix, t.chunk, last), t.buf[:n], []byte(t.name))
+	if err != nil {
+		return fmt.Errorf("%s: cannot decrypt: wrong key, or corrupt file", t.name)
+	}
+	t.chunk++
+	t.last = last
+	return nil
+}
+
+func (t *decryptReader) Read(p []byte) (int, error) {
+	for len(t.plain) == 0 {
+		if t.err != nil {
+			return 0, t.err
+		}
+		if t.last {
+			return 0, io.EOF
+		}
+		t.err = t.open()
+	}
+	n := copy(p, t.plain)
+	t.plain = t.plain[n:]
+	return n, nil
+}
+
+// VerifyFiles verifies the sizes and checksums of the files of an encrypted export directory,
+// and that they can be decrypted, without writing the decrypted content anywhere.
+func (t *ExportEncryption) VerifyFiles(aead cipher.AEAD, dir string, files []*ExportedFile) error {
+	for _, file := range files {
+		if !strings.HasSuffix(file.File, EncryptedSuffix) {
+			return fmt.Errorf("%s: not an encrypted file", file.File)
+		}
+		f, err := os.Open(filepath.Join(dir, file.File))
+		if err != nil {
+			return err
+		}
+		checksum := newChecksumReader(f)
+		_, err = io.Copy(io.Discard, t.NewReader(aead, strings.TrimSuffix(file.File, EncryptedSuffix), checksum))
+		// report a corrupt file as such, rather than as a decryption error
+		if _, err2 := io.Copy(io.Discard, checksum); err == nil {
+			err = err2
+		}
+		f.Close()
+		computed := checksum.File(file.File)
+		if err2 := file.verify(computed.Sha256, computed.Size); err2 != nil {
+			return err2
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// secret returns the encryption secret, from the key file or the key property
+func (t *ExportOps) secret(instance *Instance) ([]byte, error) {
+	if t.KeyFile != "" {
+		data, err := os.ReadFile(t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(data), "\n")), nil
+	}
+	if t.KeyProperty != "" {
+		value, err := instance.Properties.Get(t.KeyProperty)
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			return nil, fmt.Errorf("empty key property: %s", t.KeyProperty)
+		}
+		return []byte(value), nil
+	}
+	return nil, errors.New("the export is encrypted: specify --key-file or --key-property")
+}
+
+// encrypted returns true if the export should be encrypted
+func (t *ExportOps) encrypted() bool {
+	return t.KeyFile != "" || t.KeyProperty != ""
+}
+
+// newExportFiles returns the exportFiles of an export to w, which encrypts the files, if the export is encrypted
+func (t *ExportOps) newExportFiles(instance *Instance, w exportWriter) (*exportFiles, error) {
+	files := &exportFiles{Writer: w}
+	if !t.encrypted() {
+		return files, nil
+	}
+	if t.Image {
+		return nil, errors.New("--image cannot be encrypted")
+	}
+	secret, err := t.secret(instance)
+	if err != nil {
+		return nil, err
+	}
+	files.Encryption, err = NewExportEncryption()
+	if err != nil {
+		return nil, err
+	}
+	files.aead, err = files.Encryption.AEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// decrypt sets up the importer to decrypt the export files, which have the EncryptedSuffix
+func (t *importer) decrypt(encryption *ExportEncryption) error {
+	secret, err := t.ops.secret(t.instance)
+	if err != nil {
+		return err
+	}
+	aead, err := encryption.AEAD(secret)
+	if err != nil {
+		return err
+	}
+	t.encryption = encryption
+	t.aead = aead
+	return nil
+}
@@ -0,0 +1,145 @@
+package lxdops
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	encryption, err := NewExportEncryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption.ChunkSize = 4
+	aead, err := encryption.AEAD([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"", "abc", "abcd", "abcdefgh", "abcdefghi"} {
+		var encrypted bytes.Buffer
+		err := encryption.Encrypt(aead, "a", strings.NewReader(plain), &encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decrypted bytes.Buffer
+		err = encryption.Decrypt(aead, "a", bytes.NewReader(encrypted.Bytes()), &decrypted)
+		if err != nil {
+			t.Fatalf("%q: %v", plain, err)
+		}
+		if decrypted.String() != plain {
+			t.Errorf("decrypted %q: %q", plain, decrypted.String())
+		}
+		if err := encryption.Decrypt(aead, "b", bytes.NewReader(encrypted.Bytes()), &decrypted); err == nil {
+			t.Errorf("%q: decrypted with another name", plain)
+		}
+		// drop the last chunk
+		truncated := encrypted.Bytes()[:encrypted.Len()-4-aead.Overhead()]
+		if len(plain) > 4 {
+			if err := encryption.Decrypt(aead, "a", bytes.NewReader(truncated), &decrypted); err == nil {
+				t.Errorf("%q: decrypted truncated file", plain)
+			}
+		}
+	}
+}
+
+func TestExportEncrypted(t *testing.T) {
+	configFile := writeExportConfig(t, t.TempDir())
+	keyFile := filepath.Join(t.TempDir(), "key")
+	err := os.WriteFile(keyFile, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	export := &ExportOps{Dir: dir, Format: ExportTar, KeyFile: keyFile, Host: &streamRunner{}}
+	err = export.Export(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadExportManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Encryption == nil || manifest.Filesystems[0].File != "root.tar.gz.enc" {
+		t.Fatalf("manifest: %v", manifest)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "root.tar.gz")); err == nil {
+		t.Errorf("unencrypted file in export directory")
+	}
+	verify := &ExportOps{}
+	err = verify.Verify([]string{dir, configFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := &streamRunner{}
+	importer := &ExportOps{Dir: dir, Host: host}
+	err = importer.Import(configFile)
+	if err == nil {
+		t.Errorf("imported without a key")
+	}
+	wrongKey := filepath.Join(t.TempDir(), "key")
+	err = os.WriteFile(wrongKey, []byte("wrong"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importer.KeyFile = wrongKey
+	err = importer.Import(configFile)
+	if err == nil {
+		t.Errorf("imported with the wrong key")
+	}
+	verifyCommands(t, host.Commands)
+
+	importer.KeyFile = keyFile
+	err = importer.Import(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extract := "sudo tar xfz - -C /z/test/a ."
+	if stdin := host.Stdin[extract]; stdin != "sudo tar cfz - -C /z/test/a ." {
+		t.Errorf("extracted: %q", stdin)
+	}
+}
+
+func TestExportStreamEncrypted(t *testing.T) {
+	configFile := writeExportConfig(t, t.TempDir())
+	keyFile := filepath.Join(t.TempDir(), "key")
+	err := os.WriteFile(keyFile, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	export := &ExportOps{Format: ExportTar, KeyFile: keyFile, Host: &streamRunner{}}
+	err = export.exportStream(configFile, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(archive.Bytes(), []byte("tar cfz")) {
+		t.Errorf("unencrypted content in archive")
+	}
+
+	host := &streamRunner{}
+	wrongKey := filepath.Join(t.TempDir(), "key")
+	err = os.WriteFile(wrongKey, []byte("wrong"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importer := &ExportOps{KeyFile: wrongKey, Host: host}
+	err = importer.importStream(configFile, bytes.NewReader(archive.Bytes()))
+	if err == nil {
+		t.Errorf("imported with the wrong key")
+	}
+	verifyCommands(t, host.Commands)
+
+	importer.KeyFile = keyFile
+	err = importer.importStream(configFile, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extract := "sudo tar xfz - -C /z/test/a ."
+	if stdin := host.Stdin[extract]; stdin != "sudo tar cfz - -C /z/test/a ." {
+		t.Errorf("extracted: %q", stdin)
+	}
+}
@@ -0,0 +1,234 @@
+package lxdops
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"melato.org/lxdops/util"
+	"melato.org/lxdops/yaml"
+)
+
+// Version is the lxdops version.  It is set by the main program and recorded in export manifests.
+var Version string
+
+// ExportManifestFile is the name of the manifest file in an export directory
+const ExportManifestFile = "manifest.yaml"
+
+// Bundle files, in addition to the filesystem files and the manifest.
+// The merged config of the instance is exported to <instance>.yaml.
+const (
+	// BundleBackupFile is the LXD backup of the container
+	BundleBackupFile = "container.backup"
+	// BundleProfilesDir is the directory of the exported profiles
+	BundleProfilesDir = "profiles"
+)
+
+// Export formats
+const (
+	ExportTar = "tar"
+	ExportZfs = "zfs"
+)
+
+// ExportManifest describes the files of an export directory.
+// Import validates the export directory against it, before restoring anything.
+type ExportManifest struct {
+	Instance string `yaml:"instance"`
+	// Snapshot is the snapshot that was exported, if any
+	Snapshot string `yaml:"snapshot,omitempty"`
+	// LxdopsVersion is the version of lxdops that created the export
+	LxdopsVersion string        `yaml:"lxdops-version,omitempty"`
+	Filesystems   []*ExportedFS `yaml:"filesystems"`
+	// Files are the other files of the export directory, such as image files
+	Files []*ExportedFile `yaml:"files,omitempty"`
+	// Bundle is set when the export has the container, its profiles, and the config
+	Bundle *ExportedBundle `yaml:"bundle,omitempty"`
+	// Encryption is set when the files are encrypted.  The file names then have the .enc suffix.
+	Encryption *ExportEncryption `yaml:"encryption,omitempty"`
+}
+
+// ExportedBundle describes the LXD parts of a bundle export
+type ExportedBundle struct {
+	Container string `yaml:"container"`
+	// Backup is the LXD backup file of the container, without its snapshots
+	Backup string `yaml:"backup"`
+	// Profiles are the profiles of the container, in order.
+	// Each profile is exported to the file profiles/<profile>
+	Profiles []string `yaml:"profiles"`
+	// Config is the merged config of the instance
+	Config string `yaml:"config"`
+}
+
+// ExportedFile is a file of an export directory, with its size and checksum
+type ExportedFile struct {
+	// File is the name of the file, relative to the export directory
+	File   string `yaml:"file"`
+	Size   int64  `yaml:"size"`
+	Sha256 string `yaml:"sha256"`
+}
+
+// ExportedFS describes the export file of one filesystem
+type ExportedFS struct {
+	Id      string `yaml:"id"`
+	Pattern string `yaml:"pattern"`
+	// Format is tar, for a tar.gz file, or zfs, for a zfs send stream
+	Format string `yaml:"format"`
+	// Zfsproperties are the properties that were set locally on the zfs filesystem
+	Zfsproperties map[string]string `yaml:"zfsproperties,omitempty"`
+	ExportedFile  `yaml:",inline"`
+}
+
+// FileSha256 returns the hex sha256 checksum of a file, and its size
+func FileSha256(file string) (string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// ReadExportManifest reads the manifest of an export directory.
+// It returns nil, without an error, if the directory has no manifest.
+func ReadExportManifest(dir string) (*ExportManifest, error) {
+	file := filepath.Join(dir, ExportManifestFile)
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	var manifest ExportManifest
+	err := yaml.ReadFile(file, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Checksum sets the size and sha256 checksum of the export file
+func (t *ExportedFile) Checksum(dir string) error {
+	var err error
+	t.Sha256, t.Size, err = FileSha256(filepath.Join(dir, t.File))
+	return err
+}
+
+// Verify verifies the size and sha256 checksum of the export file
+func (t *ExportedFile) Verify(dir string) error {
+	sum, size, err := FileSha256(filepath.Join(dir, t.File))
+	if err != nil {
+		return err
+	}
+	return t.verify(sum, size)
+}
+
+// verify compares the size and checksum of the export file with the ones that were computed
+func (t *ExportedFile) verify(sum string, size int64) error {
+	if size != t.Size {
+		return fmt.Errorf("%s: size %d, expected %d", t.File, size, t.Size)
+	}
+	if sum != t.Sha256 {
+		return fmt.Errorf("%s: sha256 mismatch", t.File)
+	}
+	return nil
+}
+
+// Validate checks that the manifest has the exported filesystems of the instance,
+// and that the export files have the recorded sizes and checksums.
+func (t *ExportManifest) Validate(instance *Instance, dir string) error {
+	err := t.ValidateFilesystems(instance)
+	if err != nil {
+		return err
+	}
+	return t.VerifyFiles(dir)
+}
+
+// ValidateFilesystems checks that the manifest has the exported filesystems of the instance, and only those.
+func (t *ExportManifest) ValidateFilesystems(instance *Instance) error {
+	filesystems, err := instance.FilesystemList()
+	if err != nil {
+		return err
+	}
+	exported := make(map[string]*ExportedFS)
+	for _, efs := range t.Filesystems {
+		exported[efs.Id] = efs
+	}
+	var missing []string
+	for _, fs := range filesystems {
+		if fs.Filesystem.Transient || fs.IsVolume() {
+			continue
+		}
+		efs, found := exported[fs.Id]
+		if !found {
+			missing = append(missing, fs.Id)
+			continue
+		}
+		delete(exported, fs.Id)
+		if efs.Format == ExportZfs && !fs.IsZfs() {
+			return fmt.Errorf("filesystem %s: cannot import zfs stream into %s filesystem", fs.Id, fs.Type())
+		}
+		if efs.Pattern != string(fs.Filesystem.Pattern) {
+			fmt.Printf("filesystem %s: pattern %s was exported as %s\n", fs.Id, fs.Filesystem.Pattern, efs.Pattern)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("filesystems missing from export: %s", strings.Join(missing, ", "))
+	}
+	if len(exported) > 0 {
+		return fmt.Errorf("exported filesystems not in config: %s", strings.Join(util.MapKeys(exported), ", "))
+	}
+	if t.LxdopsVersion != "" && t.LxdopsVersion != Version {
+		fmt.Printf("exported by lxdops %s\n", t.LxdopsVersion)
+	}
+	return nil
+}
+
+// AllFiles returns the filesystem files and the other files of the manifest
+func (t *ExportManifest) AllFiles() []*ExportedFile {
+	var files []*ExportedFile
+	for _, efs := range t.Filesystems {
+		files = append(files, &efs.ExportedFile)
+	}
+	return append(files, t.Files...)
+}
+
+// VerifyFiles verifies the size and checksum of every file of the manifest.
+func (t *ExportManifest) VerifyFiles(dir string) error {
+	for _, file := range t.AllFiles() {
+		err := file.Verify(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyImported checks that the imported files are the files of the manifest, with the recorded sizes and checksums.
+func (t *ExportManifest) VerifyImported(files []*ExportedFile) error {
+	imported := make(map[string]*ExportedFile)
+	for _, file := range files {
+		imported[file.File] = file
+	}
+	for _, file := range t.AllFiles() {
+		f, found := imported[file.File]
+		if !found {
+			return fmt.Errorf("%s: missing from the export", file.File)
+		}
+		delete(imported, file.File)
+		err := file.verify(f.Sha256, f.Size)
+		if err != nil {
+			return err
+		}
+	}
+	if len(imported) > 0 {
+		return fmt.Errorf("files not in %s: %s", ExportManifestFile, strings.Join(util.MapKeys(imported), ", "))
+	}
+	return nil
+}
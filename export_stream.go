@@ -0,0 +1,502 @@
+package lxdops
+
+import (
+	"archive/tar"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"melato.org/lxdops/yaml"
+)
+
+// ExportStreamDir is the export directory that means stdout, for export, or stdin, for import
+const ExportStreamDir = "-"
+
+// An export archive has the files of an export, in the order that export produces them, with the manifest last.
+// Each file is written as it is produced, so its size is not known in advance, as a tar header requires.
+// Therefore each file is written in consecutive parts, named <file>.000000, <file>.000001, ...,
+// of at most exportPartSize bytes, which are buffered in memory.
+// Each part has its sha256 checksum in a PAX record, so that it is verified before it is imported.
+const (
+	exportPartSize = 8 << 20
+	// maxExportPartSize limits the memory that import uses for each part
+	maxExportPartSize = 64 << 20
+	// archiveSha256Record is the PAX record with the sha256 checksum of a part
+	archiveSha256Record = "LXDOPS.sha256"
+	partSuffixLength    = 7
+)
+
+// withStdoutToStderr runs f with os.Stdout redirected to stderr,
+// so that progress messages and command output do not get mixed with the archive.
+// It passes the original stdout to f.
+func withStdoutToStderr(f func(stdout io.Writer) error) error {
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = stdout }()
+	return f(stdout)
+}
+
+// exportWriter receives the files of an export, as they are produced.
+type exportWriter interface {
+	// Create starts an export file.  The file is complete when the returned writer is closed.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// dirWriter writes export files to an export directory
+type dirWriter struct {
+	Dir string
+}
+
+func (t *dirWriter) Create(name string) (io.WriteCloser, error) {
+	file := filepath.Join(t.Dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(file)
+}
+
+// discardWriter discards export files, for dry runs
+type discardWriter struct{}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (t nopWriteCloser) Close() error {
+	return nil
+}
+
+func (t discardWriter) Create(name string) (io.WriteCloser, error) {
+	return nopWriteCloser{io.Discard}, nil
+}
+
+// writeSeeker adapts a stream to the io.WriteSeeker that LXD requires for downloading a backup,
+// although it only writes to it.
+type writeSeeker struct {
+	io.Writer
+}
+
+func (t writeSeeker) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("cannot seek an export stream")
+}
+
+// exportFiles creates the files of an export, computing the size and checksum of each file as it is written.
+// If Encryption is set, it encrypts each file as it is written, and appends EncryptedSuffix to its name.
+// The checksums are then the checksums of the encrypted files.
+type exportFiles struct {
+	Writer     exportWriter
+	Encryption *ExportEncryption
+	aead       cipher.AEAD
+}
+
+// Create starts the export file, and sets its size and checksum, when the returned writer is closed.
+func (t *exportFiles) Create(file *ExportedFile) (io.WriteCloser, error) {
+	name := file.File
+	if t.Encryption != nil {
+		file.File += EncryptedSuffix
+	}
+	out, err := t.Writer.Create(file.File)
+	if err != nil {
+		return nil, err
+	}
+	var w io.WriteCloser = newChecksumWriter(out, file)
+	if t.Encryption != nil {
+		w = t.Encryption.NewWriter(t.aead, name, w)
+	}
+	return w, nil
+}
+
+// checksumWriter computes the size and sha256 checksum of an export file, as it is written.
+type checksumWriter struct {
+	io.WriteCloser
+	File *ExportedFile
+	hash hash.Hash
+	size int64
+}
+
+func newChecksumWriter(w io.WriteCloser, file *ExportedFile) *checksumWriter {
+	return &checksumWriter{WriteCloser: w, File: file, hash: sha256.New()}
+}
+
+func (t *checksumWriter) Write(p []byte) (int, error) {
+	n, err := t.WriteCloser.Write(p)
+	t.hash.Write(p[:n])
+	t.size += int64(n)
+	return n, err
+}
+
+// Close closes the file, and sets its size and checksum
+func (t *checksumWriter) Close() error {
+	t.File.Size = t.size
+	t.File.Sha256 = hex.EncodeToString(t.hash.Sum(nil))
+	return t.WriteCloser.Close()
+}
+
+// checksumReader computes the size and sha256 checksum of an export file, as it is read.
+type checksumReader struct {
+	io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{Reader: r, hash: sha256.New()}
+}
+
+func (t *checksumReader) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	t.hash.Write(p[:n])
+	t.size += int64(n)
+	return n, err
+}
+
+// File returns the size and checksum of what was read
+func (t *checksumReader) File(name string) *ExportedFile {
+	return &ExportedFile{File: name, Size: t.size, Sha256: hex.EncodeToString(t.hash.Sum(nil))}
+}
+
+// archiveWriter writes export files to a tar archive, in parts.
+type archiveWriter struct {
+	Writer   *tar.Writer
+	PartSize int
+	ModTime  time.Time
+}
+
+func newArchiveWriter(w io.Writer) *archiveWriter {
+	return &archiveWriter{Writer: tar.NewWriter(w), PartSize: exportPartSize, ModTime: time.Now()}
+}
+
+func (t *archiveWriter) Create(name string) (io.WriteCloser, error) {
+	return &archiveFileWriter{archive: t, name: name, buf: make([]byte, 0, t.PartSize)}, nil
+}
+
+// Close writes the end of the archive
+func (t *archiveWriter) Close() error {
+	return t.Writer.Close()
+}
+
+type archiveFileWriter struct {
+	archive *archiveWriter
+	name    string
+	part    int
+	buf     []byte
+}
+
+func partName(name string, part int) string {
+	return fmt.Sprintf("%s.%06d", name, part)
+}
+
+// parsePartName returns the file and part number of an archive entry
+func parsePartName(entry string) (string, int, error) {
+	if len(entry) > partSuffixLength && entry[len(entry)-partSuffixLength] == '.' {
+		part, err := strconv.Atoi(entry[len(entry)-partSuffixLength+1:])
+		if err == nil && part >= 0 {
+			return entry[:len(entry)-partSuffixLength], part, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unexpected archive entry: %s", entry)
+}
+
+func (t *archiveFileWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if len(t.buf) == cap(t.buf) {
+			err := t.flush()
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(t.buf[len(t.buf):cap(t.buf)], p)
+		t.buf = t.buf[:len(t.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// flush writes the buffer as the next part
+func (t *archiveFileWriter) flush() error {
+	sum := sha256.Sum256(t.buf)
+	header := &tar.Header{Name: partName(t.name, t.part), Mode: 0644, Size: int64(len(t.buf)),
+		ModTime: t.archive.ModTime, Format: tar.FormatPAX,
+		PAXRecords: map[string]string{archiveSha256Record: hex.EncodeToString(sum[:])}}
+	err := t.archive.Writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = t.archive.Writer.Write(t.buf)
+	if err != nil {
+		return err
+	}
+	t.part++
+	t.buf = t.buf[:0]
+	return nil
+}
+
+// Close writes the last part.  A file has at least one part, even if it is empty.
+func (t *archiveFileWriter) Close() error {
+	if len(t.buf) > 0 || t.part == 0 {
+		return t.flush()
+	}
+	return nil
+}
+
+// archiveReader reads the export files of an archive, verifying each part before it is read.
+type archiveReader struct {
+	reader *tar.Reader
+	// header is the next header, which has been read but not consumed
+	header *tar.Header
+	file   *archiveFileReader
+}
+
+func newArchiveReader(r io.Reader) *archiveReader {
+	return &archiveReader{reader: tar.NewReader(r)}
+}
+
+// nextHeader returns the next part header, or nil at the end of the archive.
+func (t *archiveReader) nextHeader() (*tar.Header, error) {
+	if t.header != nil {
+		header := t.header
+		t.header = nil
+		return header, nil
+	}
+	header, err := t.reader.Next()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	name := path.Clean(header.Name)
+	if header.Typeflag != tar.TypeReg || name != header.Name || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return nil, fmt.Errorf("unexpected archive entry: %s", header.Name)
+	}
+	if header.Size > maxExportPartSize {
+		return nil, fmt.Errorf("%s: archive part is too large: %d", header.Name, header.Size)
+	}
+	return header, nil
+}
+
+// readPart reads and verifies the data of a part header
+func (t *archiveReader) readPart(header *tar.Header) ([]byte, error) {
+	data := make([]byte, header.Size)
+	_, err := io.ReadFull(t.reader, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", header.Name, err)
+	}
+	sum := sha256.Sum256(data)
+	if header.PAXRecords[archiveSha256Record] != hex.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("%s: sha256 mismatch", header.Name)
+	}
+	return data, nil
+}
+
+// Next returns the name of the next export file, and a reader for its content.
+// It returns io.EOF at the end of the archive.
+// The rest of the previous file is read and verified, if it was not read.
+func (t *archiveReader) Next() (string, io.Reader, error) {
+	if t.file != nil {
+		_, err := io.Copy(io.Discard, t.file)
+		if err != nil {
+			return "", nil, err
+		}
+		t.file = nil
+	}
+	header, err := t.nextHeader()
+	if err != nil {
+		return "", nil, err
+	}
+	if header == nil {
+		return "", nil, io.EOF
+	}
+	name, part, err := parsePartName(header.Name)
+	if err != nil {
+		return "", nil, err
+	}
+	if part != 0 {
+		return "", nil, fmt.Errorf("%s: missing previous parts", header.Name)
+	}
+	data, err := t.readPart(header)
+	if err != nil {
+		return "", nil, err
+	}
+	t.file = &archiveFileReader{archive: t, name: name, data: data}
+	return name, t.file, nil
+}
+
+// archiveFileReader reads the parts of an export file from an archive
+type archiveFileReader struct {
+	archive *archiveReader
+	name    string
+	part    int
+	data    []byte
+	eof     bool
+}
+
+func (t *archiveFileReader) Read(p []byte) (int, error) {
+	for len(t.data) == 0 {
+		if t.eof {
+			return 0, io.EOF
+		}
+		header, err := t.archive.nextHeader()
+		if err != nil {
+			return 0, err
+		}
+		if header == nil {
+			t.eof = true
+			continue
+		}
+		name, part, err := parsePartName(header.Name)
+		if err != nil {
+			return 0, err
+		}
+		if name != t.name || part != t.part+1 {
+			// the next file
+			t.archive.header = header
+			t.eof = true
+			continue
+		}
+		t.data, err = t.archive.readPart(header)
+		if err != nil {
+			return 0, err
+		}
+		t.part = part
+	}
+	n := copy(p, t.data)
+	t.data = t.data[n:]
+	return n, nil
+}
+
+// exportStream exports an instance to w, as a tar archive.
+// If the export is encrypted, the first file of the archive has the encryption parameters,
+// so that import can decrypt each file as it reads it.
+func (t *ExportOps) exportStream(configFile string, w io.Writer) error {
+	if t.Image {
+		return errors.New("--image requires an export directory")
+	}
+	instance, err := t.Instance(configFile)
+	if err != nil {
+		return err
+	}
+	if t.DryRun {
+		files, err := t.newExportFiles(instance, discardWriter{})
+		if err != nil {
+			return err
+		}
+		_, err = t.export(instance, files, "")
+		return err
+	}
+	archive := newArchiveWriter(w)
+	files, err := t.newExportFiles(instance, archive)
+	if err != nil {
+		return err
+	}
+	if files.Encryption != nil {
+		err = writeYamlFile(archive, ExportEncryptionFile, files.Encryption)
+		if err != nil {
+			return err
+		}
+	}
+	manifest, err := t.export(instance, files, "")
+	if err != nil {
+		return err
+	}
+	err = t.writeManifest(archive, manifest)
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// importStream imports an instance from an export archive,
+// restoring each file as it is read from r.
+// Each part of each file is verified before it is restored, and each encrypted chunk is authenticated before it is restored.
+// When the manifest, which is the last file, is read, import verifies that it has the files that were restored,
+// with their sizes and checksums, and that the export has the filesystems of the instance.
+func (t *ExportOps) importStream(configFile string, r io.Reader) error {
+	instance, err := t.Instance(configFile)
+	if err != nil {
+		return err
+	}
+	importer, err := t.newImporter(instance)
+	if err != nil {
+		return err
+	}
+	archive := newArchiveReader(r)
+	var files []*ExportedFile
+	names := make(map[string]bool)
+	for {
+		name, file, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("archive has no %s", ExportManifestFile)
+		}
+		if err != nil {
+			return err
+		}
+		if name == ExportEncryptionFile && len(names) == 0 && importer.encryption == nil {
+			var encryption ExportEncryption
+			err = readYaml(name, file, &encryption)
+			if err != nil {
+				return err
+			}
+			err = importer.decrypt(&encryption)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if name == ExportManifestFile {
+			var manifest ExportManifest
+			err = readYaml(name, file, &manifest)
+			if err != nil {
+				return err
+			}
+			if _, _, err := archive.Next(); !errors.Is(err, io.EOF) {
+				return fmt.Errorf("%s is not the last file of the archive", ExportManifestFile)
+			}
+			err = manifest.ValidateFilesystems(instance)
+			if err != nil {
+				return err
+			}
+			err = manifest.VerifyImported(files)
+			if err != nil {
+				return err
+			}
+			return importer.Finish()
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate archive file: %s", name)
+		}
+		names[name] = true
+		checksum := newChecksumReader(file)
+		err = importer.ImportFile(name, checksum)
+		if err != nil {
+			return err
+		}
+		files = append(files, checksum.File(name))
+	}
+}
+
+// readYaml parses a yaml file of an archive
+func readYaml(name string, r io.Reader, v interface{}) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	err = yaml.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package lxdops
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
+	"melato.org/lxdops/lxdutil/lxdtest"
+)
+
+func writeExportConfig(t *testing.T, dir string) string {
+	t.Helper()
+	configFile := filepath.Join(dir, "a.yaml")
+	err := os.WriteFile(configFile, []byte(`#lxdops
+project: default
+filesystems:
+  root:
+    pattern: z/test/(instance)
+  log:
+    pattern: z/test/(instance)/log
+    transient: true
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+func TestExportZfs(t *testing.T) {
+	configFile := writeExportConfig(t, t.TempDir())
+	dir := t.TempDir()
+	host := &streamRunner{Stdout: map[string]string{"sudo zfs send -p z/test/a@s1": "stream"}}
+	host.Output = map[string][]string{
+		"zfs get -H -o property,value -s local all z/test/a": {"compression\tlz4"},
+	}
+	export := &ExportOps{Dir: dir, Snapshot: "s1", Format: ExportZfs, Host: host}
+	err := export.Export(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"sudo mkdir -p "+dir,
+		fmt.Sprintf("sudo chown %d:%d %s", os.Getuid(), os.Getgid(), dir),
+		"sudo zfs send -p z/test/a@s1",
+	)
+	manifest, err := ReadExportManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest == nil || manifest.Instance != "a" || manifest.Snapshot != "s1" || len(manifest.Filesystems) != 1 {
+		t.Fatalf("manifest: %v", manifest)
+	}
+	efs := manifest.Filesystems[0]
+	if efs.Id != "root" || efs.Format != ExportZfs || efs.Size != 6 || efs.Zfsproperties["compression"] != "lz4" {
+		t.Errorf("filesystem: %v", efs)
+	}
+
+	host = &streamRunner{}
+	importer := &ExportOps{Dir: dir, Host: host}
+	err = importer.Import(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"sudo zfs create -p z/test",
+		"sudo zfs receive z/test/a",
+		"sudo zfs create -p z/test/a",
+		"sudo zfs create -p z/test/a/log",
+	)
+	if stdin := host.Stdin["sudo zfs receive z/test/a"]; stdin != "stream" {
+		t.Errorf("received: %q", stdin)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "root.zfs"), []byte("modify"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Commands = nil
+	err = importer.Import(configFile)
+	if err == nil {
+		t.Errorf("imported modified stream")
+	}
+	verifyCommands(t, host.Commands)
+}
+
+func TestExportVerify(t *testing.T) {
+	configFile := writeExportConfig(t, t.TempDir())
+	dir := t.TempDir()
+	// the fake host does not run lxc image export, so create the image file
+	err := os.WriteFile(filepath.Join(dir, "image.tar.gz"), []byte("image"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := &ExportOps{Dir: dir, Image: true, Host: &streamRunner{}}
+	err = export.Export(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadExportManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].File != "image.tar.gz" {
+		t.Errorf("files: %v", manifest.Files)
+	}
+	verify := &ExportOps{}
+	err = verify.Verify([]string{dir, configFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verify.Verify([]string{dir})
+	if err == nil {
+		t.Errorf("verified export without a config")
+	}
+	err = os.WriteFile(filepath.Join(dir, "image.tar.gz"), []byte("modified"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verify.Verify([]string{dir, configFile})
+	if err == nil {
+		t.Errorf("verified modified file")
+	}
+	err = verify.Verify([]string{t.TempDir(), configFile})
+	if err == nil {
+		t.Errorf("verified directory without manifest")
+	}
+}
+
+func TestExportBundle(t *testing.T) {
+	x := newLauncherTest()
+	x.launch(t, "a")
+	configFile := filepath.Join(t.TempDir(), "a.yaml")
+	err := WriteConfigYaml(newLaunchConfig(), configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	export := &ExportOps{Dir: dir, Bundle: true, Host: &streamRunner{}, Client: x.Launcher.Client}
+	err = export.Export(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadExportManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := manifest.Bundle
+	if bundle == nil || bundle.Container != "a" || bundle.Config != "a.yaml" || len(bundle.Profiles) != 2 {
+		t.Fatalf("bundle: %v", bundle)
+	}
+	var files []string
+	for _, file := range manifest.Files {
+		files = append(files, file.File)
+	}
+	verifyCommands(t, files, "a.yaml", "profiles/base", "profiles/a.lxdops", BundleBackupFile)
+	// the bundle config is used for verifying that the export is complete
+	verify := &ExportOps{}
+	err = verify.Verify([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// import to a fresh host, using the exported config
+	target := lxdtest.NewServer()
+	targetClient := &lxdutil.LxdClient{}
+	targetClient.SetRootServer(target)
+	host := &streamRunner{}
+	importer := &ExportOps{Dir: dir, Bundle: true, Host: host, Client: targetClient}
+	err = importer.Import(filepath.Join(dir, bundle.Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyProfiles(t, target, "a", "base", "a.lxdops")
+	if target.Instance("a").Status != api.Stopped.String() {
+		t.Errorf("imported container is %s", target.Instance("a").Status)
+	}
+	profile := target.Profile("a.lxdops")
+	if profile == nil || profile.Devices["home"]["source"] != "/z/test/a/home" {
+		t.Errorf("imported profile: %v", profile)
+	}
+	err = importer.Import(filepath.Join(dir, bundle.Config))
+	if err == nil {
+		t.Errorf("imported existing container")
+	}
+}
+
+// streamRunner is a RecordingRunner that writes the output of each command of RunCmd to its Stdout,
+// and records the Stdin that each command reads.
+type streamRunner struct {
+	RecordingRunner
+	// Stdout specifies the output of RunCmd, by command.  The default output is the command itself.
+	Stdout map[string]string
+	// Stdin has the input of each command, by command
+	Stdin map[string]string
+}
+
+func (t *streamRunner) RunCmd(cmds ...*exec.Cmd) error {
+	err := t.RecordingRunner.RunCmd(cmds...)
+	if err != nil {
+		return err
+	}
+	command := t.Commands[len(t.Commands)-1]
+	if cmds[0].Stdin != nil {
+		data, err := io.ReadAll(cmds[0].Stdin)
+		if err != nil {
+			return err
+		}
+		if t.Stdin == nil {
+			t.Stdin = make(map[string]string)
+		}
+		t.Stdin[command] = string(data)
+	}
+	if out := cmds[len(cmds)-1].Stdout; out != nil {
+		output, found := t.Stdout[command]
+		if !found {
+			output = command
+		}
+		_, err := io.WriteString(out, output)
+		return err
+	}
+	return nil
+}
+
+func TestExportStream(t *testing.T) {
+	configFile := writeExportConfig(t, t.TempDir())
+	var archive bytes.Buffer
+	export := &ExportOps{Format: ExportTar, Host: &streamRunner{}}
+	err := export.exportStream(configFile, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := &streamRunner{}
+	importer := &ExportOps{Host: host}
+	err = importer.importStream(configFile, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extract := "sudo tar xfz - -C /z/test/a ."
+	if stdin := host.Stdin[extract]; stdin != "sudo tar cfz - -C /z/test/a ." {
+		t.Errorf("extracted: %q", stdin)
+	}
+
+	// a corrupt file is not imported
+	data := bytes.Replace(archive.Bytes(), []byte("tar cfz"), []byte("tar CFZ"), 1)
+	host.Commands = nil
+	err = importer.importStream(configFile, bytes.NewReader(data))
+	if err == nil {
+		t.Errorf("imported corrupt archive")
+	}
+	verifyCommands(t, host.Commands)
+
+	// an archive without its manifest is not imported
+	err = importer.importStream(configFile, bytes.NewReader(archive.Bytes()[:1024]))
+	if err == nil {
+		t.Errorf("imported truncated archive")
+	}
+}
+
+func TestArchiveParts(t *testing.T) {
+	var buf bytes.Buffer
+	archive := newArchiveWriter(&buf)
+	archive.PartSize = 4
+	files := []string{"a", "b.tar.gz", "c"}
+	content := map[string]string{"a": "0123456789", "b.tar.gz": "", "c": "0123"}
+	for _, name := range files {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.WriteString(w, content[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := newArchiveReader(bytes.NewReader(buf.Bytes()))
+	var names []string
+	for {
+		name, r, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+		// skip the content of the first file, to check that the next file is found
+		if name == "a" {
+			continue
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content[name] {
+			t.Errorf("%s: %q", name, data)
+		}
+	}
+	verifyCommands(t, names, files...)
+
+	reader = newArchiveReader(bytes.NewReader(bytes.Replace(buf.Bytes(), []byte("4567"), []byte("xxxx"), 1)))
+	_, r, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Errorf("read modified part")
+	}
+}
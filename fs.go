@@ -1,33 +1,90 @@
 package lxdops
 
 import (
+	"path"
 	"sort"
 	"strings"
 )
 
+// Filesystem types
+const (
+	FilesystemZfs   = "zfs"
+	FilesystemDir   = "dir"
+	FilesystemBtrfs = "btrfs"
+	// FilesystemVolume is an LXD custom storage volume
+	FilesystemVolume = "volume"
+)
+
 type InstanceFS struct {
-	Id         string
-	Path       string
+	Id   string
+	Path string
+	// Pool is the LXD storage pool of a volume filesystem
+	Pool string
+	// IsNew is set when lxdops creates or clones the filesystem
 	IsNew      bool
 	Filesystem *Filesystem
 }
 
+// Type returns the filesystem type: FilesystemZfs, FilesystemDir, FilesystemBtrfs, or FilesystemVolume.
+// If the Filesystem does not specify a type, it is a volume if it has a pool,
+// a directory if its path begins with '/', otherwise it is a zfs filesystem.
+func (t *InstanceFS) Type() string {
+	if t.Filesystem != nil && t.Filesystem.Type != "" {
+		return t.Filesystem.Type
+	}
+	if t.Pool != "" {
+		return FilesystemVolume
+	}
+	if strings.HasPrefix(t.Path, "/") {
+		return FilesystemDir
+	}
+	return FilesystemZfs
+}
+
 func (t *InstanceFS) IsDir() bool {
-	return strings.HasPrefix(t.Path, "/")
+	return t.Type() == FilesystemDir
 }
 
 func (t *InstanceFS) IsZfs() bool {
-	return !t.IsDir()
+	return t.Type() == FilesystemZfs
+}
+
+func (t *InstanceFS) IsBtrfs() bool {
+	return t.Type() == FilesystemBtrfs
+}
+
+func (t *InstanceFS) IsVolume() bool {
+	return t.Type() == FilesystemVolume
+}
+
+// IsSnapshotable returns true if the filesystem supports snapshots.
+func (t *InstanceFS) IsSnapshotable() bool {
+	return t.IsZfs() || t.IsBtrfs() || t.IsVolume()
 }
 
+// Dir returns the host directory of the filesystem.
+// LXD volumes have no host directory, so Dir returns "" for them.
 func (t *InstanceFS) Dir() string {
-	if t.IsDir() {
-		return string(t.Path)
-	} else {
+	if t.IsZfs() {
 		return "/" + string(t.Path)
+	} else if t.IsVolume() {
+		return ""
+	} else {
+		return string(t.Path)
 	}
 }
 
+// VolumeName returns <pool>/<volume>, for display.
+func (t *InstanceFS) VolumeName() string {
+	return t.Pool + "/" + t.Path
+}
+
+// SnapshotPath returns the name of a zfs snapshot, or the directory of a btrfs snapshot.
+// Btrfs snapshots are placed next to their subvolume, with the same "@" convention as zfs.
+func (t *InstanceFS) SnapshotPath(snapshot string) string {
+	return t.Path + "@" + snapshot
+}
+
 type InstanceFSList []*InstanceFS
 
 func (t InstanceFSList) Len() int           { return len(t) }
@@ -51,3 +108,16 @@ func (t InstanceFSList) Roots() []*InstanceFS {
 	}
 	return roots
 }
+
+// ParentPaths returns the parents of the roots of this set, excluding zfs pools.
+// They must exist, before the filesystems of this set can be received with zfs receive.
+func (t InstanceFSList) ParentPaths() []string {
+	var parents []string
+	for _, fs := range t.Roots() {
+		parent := path.Dir(fs.Path)
+		if strings.Contains(parent, "/") {
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
@@ -0,0 +1,193 @@
+package lxdops
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newBtrfsInstance(t *testing.T, name string) *Instance {
+	t.Helper()
+	var config Config
+	config.Filesystems = map[string]*Filesystem{
+		"root": {Pattern: "/b/test/(instance)", Type: FilesystemBtrfs},
+		"tmp":  {Pattern: "/b/test/(instance)/tmp", Type: FilesystemBtrfs, Transient: true},
+	}
+	instance, err := NewInstance(nil, &config, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+func TestFilesystemType(t *testing.T) {
+	fs := &InstanceFS{Path: "/a", Filesystem: &Filesystem{}}
+	if !fs.IsDir() {
+		t.Errorf("%s: %s", fs.Path, fs.Type())
+	}
+	fs = &InstanceFS{Path: "z/a", Filesystem: &Filesystem{}}
+	if !fs.IsZfs() || fs.Dir() != "/z/a" {
+		t.Errorf("%s: %s", fs.Path, fs.Type())
+	}
+	fs = &InstanceFS{Path: "/b/a", Filesystem: &Filesystem{Type: FilesystemBtrfs}}
+	if !fs.IsBtrfs() || fs.Dir() != "/b/a" {
+		t.Errorf("%s: %s", fs.Path, fs.Type())
+	}
+}
+
+func TestBtrfsSnapshot(t *testing.T) {
+	instance := newBtrfsInstance(t, "a")
+	host := &RecordingRunner{}
+	err := instance.Snapshot(host, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands, "sudo btrfs subvolume snapshot -r /b/test/a /b/test/a@s1")
+}
+
+func TestBtrfsRollback(t *testing.T) {
+	instance := newBtrfsInstance(t, "a")
+	host := &RecordingRunner{}
+	err := instance.Rollback(host, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the nested transient subvolume is moved to the new subvolume
+	verifyCommands(t, host.Commands,
+		"sudo btrfs subvolume show /b/test/a@s1",
+		"sudo mv -T /b/test/a /b/test/a.rollback",
+		"sudo btrfs subvolume snapshot /b/test/a@s1 /b/test/a",
+		"sudo mv -T /b/test/a.rollback/tmp /b/test/a/tmp",
+		"sudo btrfs subvolume delete /b/test/a.rollback",
+	)
+
+	// without nested subvolumes, the subvolume is deleted before it is replaced
+	var config Config
+	config.Filesystems = map[string]*Filesystem{
+		"root": {Pattern: "/b/test/(instance)", Type: FilesystemBtrfs},
+	}
+	instance, err = NewInstance(nil, &config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Commands = nil
+	err = instance.Rollback(host, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"sudo btrfs subvolume show /b/test/a@s1",
+		"sudo btrfs subvolume delete /b/test/a",
+		"sudo btrfs subvolume snapshot /b/test/a@s1 /b/test/a",
+	)
+}
+
+func TestBtrfsRollbackNested(t *testing.T) {
+	dir := t.TempDir()
+	var config Config
+	config.Filesystems = map[string]*Filesystem{
+		"root": {Pattern: Pattern(dir + "/(instance)"), Type: FilesystemBtrfs},
+		"var":  {Pattern: Pattern(dir + "/(instance)/var"), Type: FilesystemBtrfs},
+		"log":  {Pattern: Pattern(dir + "/(instance)/var/log"), Type: FilesystemBtrfs},
+		"db":   {Pattern: Pattern(dir + "/(instance)/data/db"), Type: FilesystemBtrfs, Transient: true},
+	}
+	instance, err := NewInstance(nil, &config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the snapshots of the nested subvolumes are in their parent subvolume
+	for _, path := range []string{"a/var@s1", "a/var/log@s1"} {
+		err = os.MkdirAll(filepath.Join(dir, path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	host := &RecordingRunner{}
+	err = instance.Rollback(host, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := dir + "/a"
+	verifyCommands(t, host.Commands,
+		"sudo btrfs subvolume show "+a+"@s1",
+		"sudo mv -T "+a+" "+a+".rollback",
+		"sudo btrfs subvolume snapshot "+a+"@s1 "+a,
+		"sudo mkdir -p "+a+"/data",
+		"sudo mv -T "+a+".rollback/data/db "+a+"/data/db",
+		"sudo mv -T "+a+".rollback/var "+a+"/var",
+		"sudo mv -T "+a+".rollback/var@s1 "+a+"/var@s1",
+		"sudo btrfs subvolume delete "+a+".rollback",
+		"sudo btrfs subvolume show "+a+"/var@s1",
+		"sudo mv -T "+a+"/var "+a+"/var.rollback",
+		"sudo btrfs subvolume snapshot "+a+"/var@s1 "+a+"/var",
+		"sudo mv -T "+a+"/var.rollback/log "+a+"/var/log",
+		"sudo mv -T "+a+"/var.rollback/log@s1 "+a+"/var/log@s1",
+		"sudo btrfs subvolume delete "+a+"/var.rollback",
+		"sudo btrfs subvolume show "+a+"/var/log@s1",
+		"sudo btrfs subvolume delete "+a+"/var/log",
+		"sudo btrfs subvolume snapshot "+a+"/var/log@s1 "+a+"/var/log",
+	)
+
+	// a failure after the subvolume is moved aside reports where it is
+	host = &RecordingRunner{Errors: map[string]error{
+		"sudo btrfs subvolume delete " + a + ".rollback": errors.New("directory not empty"),
+	}}
+	err = instance.Rollback(host, "s1")
+	if err == nil || !strings.Contains(err.Error(), a+".rollback") {
+		t.Errorf("error: %v", err)
+	}
+}
+
+func TestBtrfsClone(t *testing.T) {
+	instance := newBtrfsInstance(t, "a")
+	origin, err := instance.NewInstance("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &RecordingRunner{}
+	dev := &DeviceConfigurer{Config: instance.Config, Host: host}
+	err = dev.CreateFilesystems(instance, origin, "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"sudo mkdir -p /b/test",
+		"sudo btrfs subvolume snapshot /b/test/t@copy /b/test/a",
+		"sudo mkdir -p /b/test/a",
+		"sudo btrfs subvolume snapshot /b/test/t/tmp@copy /b/test/a/tmp",
+	)
+}
+
+func TestBtrfsRename(t *testing.T) {
+	instance := newBtrfsInstance(t, "a")
+	newInstance, err := instance.NewInstance("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &RecordingRunner{}
+	dev := &DeviceConfigurer{Config: instance.Config, Host: host}
+	err = dev.RenameFilesystems(instance, newInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands, "sudo mv /b/test/a /b/test/b")
+}
+
+func TestBtrfsDestroySnapshotRecursive(t *testing.T) {
+	instance := newBtrfsInstance(t, "a")
+	host := &RecordingRunner{}
+	snapshot := &Snapshot{Host: host}
+	snapshot.Snapshot = "s1"
+	snapshot.Recursive = true
+	err := snapshot.DestroySnapshot(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each nested subvolume has its own snapshot
+	verifyCommands(t, host.Commands,
+		"sudo btrfs subvolume delete /b/test/a@s1",
+		"sudo btrfs subvolume delete /b/test/a/tmp@s1",
+	)
+}
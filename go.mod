@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	github.com/canonical/lxd v0.0.0-20230707170824-a34dc9703bf0
+	golang.org/x/crypto v0.10.0
 	gopkg.in/yaml.v2 v2.4.0
 	melato.org/cloudconfig v0.0.0-20230426173728-bf10961073ff
 	melato.org/cloudconfiglxd v0.0.0-20230708184813-334a7c1295af
@@ -36,7 +37,6 @@ require (
 	github.com/rogpeppe/fastuuid v1.2.0 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/zitadel/oidc/v2 v2.6.3 // indirect
-	golang.org/x/crypto v0.10.0 // indirect
 	golang.org/x/net v0.11.0 // indirect
 	golang.org/x/oauth2 v0.9.0 // indirect
 	golang.org/x/sys v0.9.0 // indirect
@@ -0,0 +1,51 @@
+package lxdops
+
+import (
+	"os/exec"
+
+	"melato.org/script"
+)
+
+// HostRunner runs commands on the host, such as zfs, rsync, tar, or lxc.
+// Operations that change host filesystems use a HostRunner,
+// so that the commands can be replaced with a fake, for testing.
+type HostRunner interface {
+	// Run runs a command that may modify the host
+	Run(name string, args ...string) error
+
+	// RunCmd runs a command, or a pipeline of commands, connecting the output of each command to the input of the next.
+	RunCmd(cmds ...*exec.Cmd) error
+
+	// Lines runs a command that queries the host and returns its output lines.
+	// It returns the output lines even if the command fails.
+	// Its stderr is discarded.
+	Lines(name string, args ...string) ([]string, error)
+}
+
+// ScriptRunner is a HostRunner that runs commands using melato.org/script
+type ScriptRunner struct {
+	Trace  bool
+	DryRun bool
+}
+
+func (t *ScriptRunner) newScript() *script.Script {
+	return &script.Script{Trace: t.Trace, DryRun: t.DryRun}
+}
+
+func (t *ScriptRunner) Run(name string, args ...string) error {
+	s := t.newScript()
+	s.Run(name, args...)
+	return s.Error()
+}
+
+func (t *ScriptRunner) RunCmd(cmds ...*exec.Cmd) error {
+	s := t.newScript()
+	s.RunCmd(cmds...)
+	return s.Error()
+}
+
+// Lines runs the command even in DryRun mode, since it is not supposed to modify anything.
+func (t *ScriptRunner) Lines(name string, args ...string) ([]string, error) {
+	output, err := exec.Command(name, args...).Output()
+	return script.BytesToLines(output), err
+}
@@ -0,0 +1,182 @@
+package lxdops
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// RecordingRunner is a HostRunner that records commands, instead of running them.
+type RecordingRunner struct {
+	// Commands are the commands passed to Run or RunCmd, in order.  Pipelines are joined with " | "
+	Commands []string
+	// Queries are the commands passed to Lines, in order.
+	Queries []string
+	// Output specifies the output of Lines, by command
+	Output map[string][]string
+	// Errors specifies errors to return, by command
+	Errors map[string]error
+}
+
+func commandString(name string, args ...string) string {
+	return strings.Join(append([]string{name}, args...), " ")
+}
+
+func (t *RecordingRunner) Run(name string, args ...string) error {
+	command := commandString(name, args...)
+	t.Commands = append(t.Commands, command)
+	return t.Errors[command]
+}
+
+func (t *RecordingRunner) RunCmd(cmds ...*exec.Cmd) error {
+	parts := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		parts[i] = strings.Join(cmd.Args, " ")
+	}
+	command := strings.Join(parts, " | ")
+	t.Commands = append(t.Commands, command)
+	return t.Errors[command]
+}
+
+func (t *RecordingRunner) Lines(name string, args ...string) ([]string, error) {
+	command := commandString(name, args...)
+	t.Queries = append(t.Queries, command)
+	return t.Output[command], t.Errors[command]
+}
+
+func verifyCommands(t *testing.T, commands []string, expected ...string) {
+	t.Helper()
+	if len(commands) != len(expected) {
+		t.Fatalf("commands:\n%s\nexpected:\n%s", strings.Join(commands, "\n"), strings.Join(expected, "\n"))
+	}
+	for i, command := range commands {
+		if command != expected[i] {
+			t.Errorf("command %d: %s\nexpected: %s", i, command, expected[i])
+		}
+	}
+}
+
+func newTestInstance(t *testing.T, name string) *Instance {
+	t.Helper()
+	var config Config
+	config.Filesystems = map[string]*Filesystem{
+		"root": {Pattern: "z/test/(instance)", Destroy: true},
+		"log":  {Pattern: "z/test/(instance)/log", Transient: true},
+	}
+	instance, err := NewInstance(nil, &config, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+func TestInstanceSnapshot(t *testing.T) {
+	instance := newTestInstance(t, "a")
+	host := &RecordingRunner{}
+	err := instance.Snapshot(host, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands, "sudo zfs snapshot z/test/a@s1")
+}
+
+func TestDestroySnapshotRecursive(t *testing.T) {
+	instance := newTestInstance(t, "a")
+	host := &RecordingRunner{}
+	snapshot := &Snapshot{Host: host}
+	snapshot.Snapshot = "s1"
+	snapshot.Recursive = true
+	err := snapshot.DestroySnapshot(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands, "sudo zfs destroy -R z/test/a@s1")
+}
+
+func TestRenameFilesystems(t *testing.T) {
+	instance := newTestInstance(t, "a")
+	newInstance, err := instance.NewInstance("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &RecordingRunner{}
+	dev := &DeviceConfigurer{Config: instance.Config, Host: host}
+	err = dev.RenameFilesystems(instance, newInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands, "sudo zfs rename z/test/a z/test/b")
+}
+
+func TestCreateFilesystemsClone(t *testing.T) {
+	instance := newTestInstance(t, "a")
+	origin, err := instance.NewInstance("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &RecordingRunner{}
+	dev := &DeviceConfigurer{Config: instance.Config, Host: host}
+	err = dev.CreateFilesystems(instance, origin, "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"sudo zfs clone -p z/test/t@copy z/test/a",
+		"sudo zfs clone -p z/test/t/log@copy z/test/a/log",
+	)
+}
+
+func TestSnapshotPools(t *testing.T) {
+	var config Config
+	config.Filesystems = map[string]*Filesystem{
+		"root": {Pattern: "z/test/(instance)"},
+		"home": {Pattern: "z/test/(instance)/home"},
+		"data": {Pattern: "y/data/(instance)"},
+	}
+	a, err := NewInstance(nil, &config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := a.NewInstance("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &RecordingRunner{}
+	set := &SnapshotSet{Host: host}
+	err = set.Create("s1", a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"sudo zfs snapshot y/data/a@s1 y/data/b@s1",
+		"sudo zfs snapshot z/test/a@s1 z/test/a/home@s1 z/test/b@s1 z/test/b/home@s1",
+	)
+}
+
+func TestSnapshotUndo(t *testing.T) {
+	var config Config
+	config.Filesystems = map[string]*Filesystem{
+		"root": {Pattern: "z/test/(instance)"},
+		"data": {Pattern: "y/data/(instance)"},
+	}
+	instance, err := NewInstance(nil, &config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &RecordingRunner{Errors: map[string]error{
+		"sudo zfs snapshot z/test/a@s1": errors.New("out of space"),
+	}}
+	set := &SnapshotSet{Host: host, Container: true}
+	err = set.Create("s1", instance)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	verifyCommands(t, host.Commands,
+		"lxc snapshot a s1",
+		"sudo zfs snapshot y/data/a@s1",
+		"sudo zfs snapshot z/test/a@s1",
+		"sudo zfs destroy y/data/a@s1",
+		"lxc delete a/s1",
+	)
+}
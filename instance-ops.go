@@ -50,6 +50,7 @@ func (t *InstanceOps) Filesystems(instance *Instance) error {
 	var fs *InstanceFS
 	writer.Columns(
 		table.NewColumn("FILESYSTEM", func() interface{} { return fs.Id }),
+		table.NewColumn("TYPE", func() interface{} { return fs.Type() }),
 		table.NewColumn("PATH", func() interface{} { return fs.Path }),
 		table.NewColumn("PATTERN", func() interface{} { return fs.Filesystem.Pattern }),
 	)
@@ -1,12 +1,12 @@
 package lxdops
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"melato.org/lxdops/util"
-	"melato.org/script"
 	"melato.org/table3"
 )
 
@@ -21,6 +21,8 @@ type Instance struct {
 	Properties       *util.PatternProperties
 	fspaths          map[string]*InstanceFS
 	sourceConfig     *Config
+	// file is the config file of the instance, if it was read from the command line
+	file string
 }
 
 func (t *Instance) substitute(e *error, pattern Pattern, defaultPattern Pattern) string {
@@ -103,6 +105,22 @@ func (t *Instance) ProfileName() string {
 	return t.profile
 }
 
+// ContainerProfiles returns the profiles that a launched container has, in order:
+// the config profiles, followed by the instance profile, if the config has devices.
+func (t *Instance) ContainerProfiles() []string {
+	var profiles []string
+	profiles = append(profiles, t.Config.Profiles...)
+	if t.Config.Devices != nil {
+		if len(profiles) == 0 {
+			profiles = append(profiles, "default")
+		}
+		if profileName := t.ProfileName(); profileName != "" {
+			profiles = append(profiles, profileName)
+		}
+	}
+	return profiles
+}
+
 func (t *Instance) Container() string {
 	return t.container
 }
@@ -115,7 +133,11 @@ func (t *Instance) Filesystems() (map[string]*InstanceFS, error) {
 			if err != nil {
 				return nil, err
 			}
-			fspaths[id] = &InstanceFS{Id: id, Path: path, Filesystem: fs}
+			pool, err := fs.Pool.Substitute(t.Properties)
+			if err != nil {
+				return nil, err
+			}
+			fspaths[id] = &InstanceFS{Id: id, Path: path, Pool: pool, Filesystem: fs}
 		}
 		t.fspaths = fspaths
 	}
@@ -135,15 +157,22 @@ func (t *Instance) FilesystemList() ([]*InstanceFS, error) {
 	return list, nil
 }
 
+// DeviceList returns the disk devices of the instance, sorted by source.
 func (t *Instance) DeviceList() ([]InstanceDevice, error) {
 	var devices []InstanceDevice
 	for name, device := range t.Config.Devices {
+		if !device.IsDisk() {
+			continue
+		}
 		d := InstanceDevice{Name: name, Device: device}
 		dir, err := t.DeviceDir(name, device)
 		if err != nil {
 			return nil, err
 		}
 		d.Source = dir
+		if fs := t.volume(device); fs != nil {
+			d.Source = fs.VolumeName()
+		}
 		devices = append(devices, d)
 	}
 
@@ -151,7 +180,26 @@ func (t *Instance) DeviceList() ([]InstanceDevice, error) {
 	return devices, nil
 }
 
+// volume returns the volume filesystem of a device, or nil if the device is not in a volume.
+func (t *Instance) volume(device *Device) *InstanceFS {
+	fspaths, err := t.Filesystems()
+	if err != nil {
+		return nil
+	}
+	fs, exists := fspaths[device.Filesystem]
+	if exists && fs.IsVolume() {
+		return fs
+	}
+	return nil
+}
+
+// DeviceDir returns the host directory of a device.
+// It returns "" for devices in volume filesystems, which are not accessible from the host,
+// and for devices that are not disk devices.
 func (t *Instance) DeviceDir(deviceId string, device *Device) (string, error) {
+	if !device.IsDisk() {
+		return "", nil
+	}
 	dir, err := device.Dir.Substitute(t.Properties)
 	if err != nil {
 		return "", err
@@ -170,7 +218,7 @@ func (t *Instance) DeviceDir(deviceId string, device *Device) (string, error) {
 		return "", err
 	}
 	fsPath, exists := fspaths[device.Filesystem]
-	if !exists {
+	if !exists || fsPath.IsVolume() {
 		return "", nil
 	}
 
@@ -181,34 +229,113 @@ func (t *Instance) DeviceDir(deviceId string, device *Device) (string, error) {
 	}
 }
 
-// Snapshot creates a snapshot of all ZFS filesystems of the instance
-func (instance *Instance) Snapshot(name string) error {
+// Snapshot creates a snapshot of all non-transient ZFS filesystems and btrfs subvolumes of the instance.
+// The ZFS filesystems of each pool are snapshotted atomically.  See SnapshotSet.
+func (instance *Instance) Snapshot(host HostRunner, name string) error {
+	set := &SnapshotSet{Host: host}
+	return set.Create(name, instance)
+}
+
+// Rollback calls zfs rollback -r on the non-transient ZFS filesystems of the instance.
+// It replaces non-transient btrfs subvolumes with a writable snapshot of their snapshot.
+func (instance *Instance) Rollback(host HostRunner, name string) error {
 	filesystems, err := instance.FilesystemList()
 	if err != nil {
 		return err
 	}
-	s := &script.Script{Trace: true}
 	for _, fs := range filesystems {
-		if fs.IsZfs() && !fs.Filesystem.Transient {
-			s.Run("sudo", "zfs", "snapshot", fs.Path+"@"+name)
+		if fs.Filesystem.Transient {
+			continue
+		}
+		var err error
+		if fs.IsZfs() {
+			err = host.Run("sudo", "zfs", "rollback", "-r", fs.SnapshotPath(name))
+		} else if fs.IsBtrfs() {
+			err = rollbackBtrfs(host, fs, nestedBtrfs(filesystems, fs), name)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	return s.Error()
+	return nil
 }
 
-// Rollback calls zfs rollback -r on the non-transient ZFS filesystems of the instance
-func (instance *Instance) Rollback(name string) error {
-	filesystems, err := instance.FilesystemList()
+// nestedBtrfs returns the btrfs subvolumes of filesystems that are directly nested in fs.
+func nestedBtrfs(filesystems []*InstanceFS, fs *InstanceFS) []*InstanceFS {
+	var nested []*InstanceFS
+	for _, child := range filesystems {
+		if !child.IsBtrfs() || child.Path == fs.Path || !Path(child.Path).IsDescendantOf(fs.Path) {
+			continue
+		}
+		direct := true
+		for _, parent := range filesystems {
+			if parent.IsBtrfs() && parent.Path != fs.Path && parent.Path != child.Path &&
+				Path(parent.Path).IsDescendantOf(fs.Path) && Path(child.Path).IsDescendantOf(parent.Path) {
+				direct = false
+				break
+			}
+		}
+		if direct {
+			nested = append(nested, child)
+		}
+	}
+	return nested
+}
+
+// rollbackBtrfs replaces a btrfs subvolume with a writable snapshot of its snapshot.
+// A btrfs snapshot does not include nested subvolumes, and a subvolume cannot be deleted while it has nested subvolumes,
+// so the subvolume is first moved aside, and the nested subvolumes, and their snapshots, are moved from it to the new subvolume.
+// Other nested subvolumes are not moved, so the old subvolume is not deleted, and rollbackBtrfs fails.
+func rollbackBtrfs(host HostRunner, fs *InstanceFS, nested []*InstanceFS, name string) error {
+	// btrfs has no rollback.  Verify that the snapshot exists, before deleting the subvolume
+	err := host.Run("sudo", "btrfs", "subvolume", "show", fs.SnapshotPath(name))
 	if err != nil {
 		return err
 	}
-	s := &script.Script{Trace: true}
-	for _, fs := range filesystems {
-		if fs.IsZfs() && !fs.Filesystem.Transient {
-			s.Run("sudo", "zfs", "rollback", "-r", fs.Path+"@"+name)
+	if len(nested) == 0 {
+		err = host.Run("sudo", "btrfs", "subvolume", "delete", fs.Path)
+		if err != nil {
+			return err
 		}
+		return host.Run("sudo", "btrfs", "subvolume", "snapshot", fs.SnapshotPath(name), fs.Path)
+	}
+	var paths []string
+	for _, child := range nested {
+		snapshots, err := filepath.Glob(child.SnapshotPath("*"))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, child.Path)
+		paths = append(paths, snapshots...)
+	}
+	old := fs.Path + ".rollback"
+	err = host.Run("sudo", "mv", "-T", fs.Path, old)
+	if err != nil {
+		return err
+	}
+	err = host.Run("sudo", "btrfs", "subvolume", "snapshot", fs.SnapshotPath(name), fs.Path)
+	if err != nil {
+		return fmt.Errorf("%w (the previous subvolume is %s)", err, old)
 	}
-	return s.Error()
+	for _, path := range paths {
+		if dir := filepath.Dir(path); dir != fs.Path {
+			err = host.Run("sudo", "mkdir", "-p", dir)
+			if err != nil {
+				return err
+			}
+		}
+		// the snapshot has an empty directory in the place of each subvolume that was nested when it was created,
+		// which mv -T replaces
+		err = host.Run("sudo", "mv", "-T", old+path[len(fs.Path):], path)
+		if err != nil {
+			return fmt.Errorf("%w (the previous subvolume is %s)", err, old)
+		}
+	}
+	err = host.Run("sudo", "btrfs", "subvolume", "delete", old)
+	if err != nil {
+		return fmt.Errorf("%w (the previous subvolume is %s)", err, old)
+	}
+	return nil
 }
 
 // GetSourceConfig returns the parsed configuration specified by Config.SourceConfig
@@ -232,15 +359,38 @@ func (t *Instance) GetSourceConfig() (*Config, error) {
 	return t.sourceConfig, nil
 }
 
+// NewDeviceMap returns the devices of the instance profile, with their LXD keys.
 func (t *Instance) NewDeviceMap() (map[string]map[string]string, error) {
 	devices := make(map[string]map[string]string)
 
 	for deviceName, device := range t.Config.Devices {
-		dir, err := t.DeviceDir(deviceName, device)
+		path, err := Pattern(device.Path).Substitute(t.Properties)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("device %s: %w", deviceName, err)
+		}
+		var d map[string]string
+		if !device.IsDisk() {
+			d = map[string]string{"type": device.Type}
+			if path != "" {
+				d["path"] = path
+			}
+		} else if fs := t.volume(device); fs != nil {
+			d = map[string]string{"type": "disk", "path": path, "pool": fs.Pool, "source": fs.Path}
+		} else {
+			dir, err := t.DeviceDir(deviceName, device)
+			if err != nil {
+				return nil, err
+			}
+			d = map[string]string{"type": "disk", "path": path, "source": dir}
+		}
+		for key, pattern := range device.Config {
+			value, err := pattern.Substitute(t.Properties)
+			if err != nil {
+				return nil, fmt.Errorf("device %s: %w", deviceName, err)
+			}
+			d[key] = value
 		}
-		devices[deviceName] = map[string]string{"type": "disk", "path": device.Path, "source": dir}
+		devices[deviceName] = d
 	}
 	return devices, nil
 }
@@ -0,0 +1,287 @@
+package lxdops
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// jobEnv is the environment variable that marks an lxdops process that runs one job of a parallel command.
+// Its value is the config file of the job.
+const jobEnv = "LXDOPS_JOB"
+
+// JobOptions runs the instances of several config or stack files concurrently.
+// Each instance runs in a separate lxdops process, with the same command line, except for the config files,
+// so that the output of each instance can be prefixed with the instance name.
+type JobOptions struct {
+	Jobs int `name:"j" usage:"number of instances to process concurrently, each in a separate lxdops process"`
+	// jobArgs are flags that are added to the command line of each job,
+	// for options whose default value would be different in each process.
+	jobArgs []string
+}
+
+// Job is one instance of a parallel command
+type Job struct {
+	// Label identifies the job in the summary
+	Label string
+	// Name is the instance name, which prefixes the output lines of the job
+	Name string
+	// Arg is the command line argument of the job: a config file, or a stack file
+	Arg string
+	// Env has environment variables that select the job instance, in the form key=value
+	Env []string
+	// Deps are the indexes of the jobs that should succeed before this job starts
+	Deps []int
+}
+
+// JobListFunc returns the jobs of the command line arguments
+type JobListFunc func(args []string) ([]*Job, error)
+
+// jobs returns a job for each instance of the command line arguments.
+func (t *ConfigOptions) jobs(args []string, deps func(instances []*Instance) ([][]int, error)) ([]*Job, error) {
+	instances, list, err := t.instanceList(false, args...)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, len(list))
+	labels := make([]string, len(list))
+	for i, arg := range list {
+		jobs[i] = &Job{Label: arg.Label, Name: instances[i].Name, Arg: arg.Arg}
+		if arg.Entry != nil {
+			jobs[i].Env = []string{stackInstanceEnv + "=" + arg.Entry.Name}
+		}
+		labels[i] = arg.Label
+	}
+	if deps == nil {
+		return jobs, nil
+	}
+	d, err := deps(instances)
+	if err != nil {
+		return nil, err
+	}
+	_, err = dependencyOrder(d, labels)
+	if err != nil {
+		return nil, err
+	}
+	for i, job := range jobs {
+		job.Deps = d[i]
+	}
+	return jobs, nil
+}
+
+// JobList returns the jobs of the command line arguments, in dependency order
+func (t *ConfigOptions) JobList(args []string) ([]*Job, error) {
+	return t.jobs(args, dependencies)
+}
+
+// ReverseJobList returns the jobs of the command line arguments, in reverse dependency order.
+// It is used for deleting instances, so that an instance is deleted after the instances that were copied or cloned from it.
+func (t *ConfigOptions) ReverseJobList(args []string) ([]*Job, error) {
+	return t.jobs(args, func(instances []*Instance) ([][]int, error) {
+		deps, err := dependencies(instances)
+		if err != nil {
+			return nil, err
+		}
+		return reverseDependencies(deps), nil
+	})
+}
+
+// IndependentJobList returns the jobs of the command line arguments, without dependencies
+func (t *ConfigOptions) IndependentJobList(args []string) ([]*Job, error) {
+	return t.jobs(args, nil)
+}
+
+// JobsFunc wraps a function that processes config files, so that it processes them concurrently, with -j N.
+// Without -j, or with a single instance, it calls f, which stops at the first error.
+// With -j, it runs all the instances, and prints a summary of the successes and failures.
+// An instance is started after the instances that it depends on have succeeded.
+// If any of them fails, it is skipped.
+func (t *JobOptions) JobsFunc(jobList JobListFunc, f func(configs []string) error) func(configs []string) error {
+	return func(configs []string) error {
+		if t.Jobs <= 1 || os.Getenv(jobEnv) != "" {
+			return f(configs)
+		}
+		jobs, err := jobList(configs)
+		if err != nil {
+			return err
+		}
+		if len(jobs) <= 1 {
+			return f(configs)
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		args, err := jobArgs(os.Args, configs)
+		if err != nil {
+			return err
+		}
+		args = append(args, t.jobArgs...)
+		deps := make([][]int, len(jobs))
+		for i, job := range jobs {
+			deps[i] = job.Deps
+		}
+		var mutex sync.Mutex
+		errs := runJobs(t.Jobs, deps, func(i int) error {
+			job := jobs[i]
+			stdout := &prefixWriter{Writer: os.Stdout, Prefix: job.Name + ": ", Mutex: &mutex}
+			stderr := &prefixWriter{Writer: os.Stderr, Prefix: job.Name + ": ", Mutex: &mutex}
+			cmd := exec.Command(executable, append(args[:len(args):len(args)], job.Arg)...)
+			cmd.Env = append(os.Environ(), jobEnv+"="+job.Label)
+			cmd.Env = append(cmd.Env, job.Env...)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			err := cmd.Run()
+			stdout.Flush()
+			stderr.Flush()
+			return err
+		})
+		labels := make([]string, len(jobs))
+		for i, job := range jobs {
+			labels[i] = job.Label
+		}
+		return jobsSummary(os.Stdout, labels, errs)
+	}
+}
+
+// jobArgs returns the command line arguments for running one config file,
+// without the program name and the config files, which are the last arguments.
+func jobArgs(args []string, configs []string) ([]string, error) {
+	n := len(args) - len(configs)
+	if n < 1 {
+		return nil, fmt.Errorf("cannot find the config files in the command line")
+	}
+	for i, config := range configs {
+		if args[n+i] != config {
+			return nil, fmt.Errorf("the config files should be the last arguments: %s", config)
+		}
+	}
+	return append([]string(nil), args[1:n]...), nil
+}
+
+// errDependencyFailed is the error of a job that was skipped, because a job that it depends on failed
+var errDependencyFailed = errors.New("skipped, because a dependency failed")
+
+// errDependencyCycle is the error of a job that was not started, because it is in a dependency cycle, or depends on one
+var errDependencyCycle = errors.New("not started, because of a dependency cycle")
+
+// runJobs calls job(i) for each i in deps, running at most n jobs concurrently.
+// deps[i] has the jobs that should succeed before job i starts.
+// It returns the error of each job.
+func runJobs(n int, deps [][]int, job func(i int) error) []error {
+	count := len(deps)
+	errs := make([]error, count)
+	started := make([]bool, count)
+	done := make([]bool, count)
+	finished := make(chan int)
+	var running, remaining int
+	for remaining = count; remaining > 0; {
+		for progress := true; progress && running < n; {
+			progress = false
+			for i := 0; i < count && running < n; i++ {
+				if started[i] {
+					continue
+				}
+				ready, failed := true, false
+				for _, d := range deps[i] {
+					if !done[d] {
+						ready = false
+					} else if errs[d] != nil {
+						failed = true
+					}
+				}
+				if failed {
+					started[i], done[i], errs[i] = true, true, errDependencyFailed
+					remaining--
+					progress = true
+				} else if ready {
+					started[i] = true
+					running++
+					go func(i int) {
+						err := job(i)
+						errs[i] = err
+						finished <- i
+					}(i)
+				}
+			}
+		}
+		if running == 0 {
+			// no job can start, which can only happen with a dependency cycle
+			for i := range errs {
+				if !started[i] {
+					errs[i] = errDependencyCycle
+				}
+			}
+			break
+		}
+		i := <-finished
+		running--
+		done[i] = true
+		remaining--
+	}
+	return errs
+}
+
+// jobsSummary prints the result of each job, and returns an error if any of them failed.
+func jobsSummary(w io.Writer, labels []string, errs []error) error {
+	var failed int
+	for i, label := range labels {
+		if errs[i] != nil {
+			failed++
+			fmt.Fprintf(w, "FAILED %s: %v\n", label, errs[i])
+		} else {
+			fmt.Fprintf(w, "ok %s\n", label)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d failed", failed, len(labels))
+	}
+	return nil
+}
+
+// prefixWriter writes each line with a prefix.
+// Writers that share a Mutex do not mix their lines.
+type prefixWriter struct {
+	Writer io.Writer
+	Prefix string
+	Mutex  *sync.Mutex
+	buf    []byte
+}
+
+func (t *prefixWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	i := bytes.LastIndexByte(t.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := strings.SplitAfter(string(t.buf[:i+1]), "\n")
+	t.buf = append(t.buf[:0], t.buf[i+1:]...)
+	var out strings.Builder
+	for _, line := range lines {
+		if line != "" {
+			out.WriteString(t.Prefix)
+			out.WriteString(line)
+		}
+	}
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	_, err := io.WriteString(t.Writer, out.String())
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line, if it does not end with a newline
+func (t *prefixWriter) Flush() error {
+	if len(t.buf) == 0 {
+		return nil
+	}
+	_, err := t.Write([]byte("\n"))
+	return err
+}
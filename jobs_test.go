@@ -0,0 +1,132 @@
+package lxdops
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"melato.org/lxdops/util"
+)
+
+func TestRunJobs(t *testing.T) {
+	var mutex sync.Mutex
+	var running, maxRunning int
+	started := make(chan int)
+	block := make(chan struct{})
+	done := make(chan []error)
+	go func() {
+		done <- runJobs(2, make([][]int, 5), func(i int) error {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			started <- i
+			<-block
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			if i == 3 {
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}()
+	// let a job finish only when two jobs are running
+	<-started
+	<-started
+	for i := 2; i < 5; i++ {
+		block <- struct{}{}
+		<-started
+	}
+	block <- struct{}{}
+	block <- struct{}{}
+	errs := <-done
+	if maxRunning != 2 {
+		t.Fatalf("max running: %d", maxRunning)
+	}
+	for i, err := range errs {
+		if (err != nil) != (i == 3) {
+			t.Fatalf("job %d: %v", i, err)
+		}
+	}
+}
+
+func TestJobsSummary(t *testing.T) {
+	var buf bytes.Buffer
+	err := jobsSummary(&buf, []string{"a.yaml", "b.yaml"}, []error{nil, errors.New("x")})
+	if err == nil || err.Error() != "1 of 2 failed" {
+		t.Fatalf("%v", err)
+	}
+	if buf.String() != "ok a.yaml\nFAILED b.yaml: x\n" {
+		t.Fatalf("%q", buf.String())
+	}
+}
+
+func TestJobArgs(t *testing.T) {
+	args, err := jobArgs([]string{"lxdops", "launch", "-j", "2", "a.yaml", "b.yaml"}, []string{"a.yaml", "b.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !util.StringSlice(args).Equals([]string{"launch", "-j", "2"}) {
+		t.Fatalf("%v", args)
+	}
+	_, err = jobArgs([]string{"lxdops", "launch", "a.yaml", "-j", "2", "b.yaml"}, []string{"a.yaml", "b.yaml"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var mutex sync.Mutex
+	w := &prefixWriter{Writer: &buf, Prefix: "a: ", Mutex: &mutex}
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\nthree"))
+	w.Flush()
+	if buf.String() != "a: one\na: two\na: three\n" {
+		t.Fatalf("%q", buf.String())
+	}
+}
+
+func TestRunJobsDependencies(t *testing.T) {
+	// 1 depends on 0, which fails, 2 depends on 1, 3 depends on 4
+	deps := [][]int{nil, {0}, {1}, {4}, nil}
+	var mutex sync.Mutex
+	var order []int
+	errs := runJobs(2, deps, func(i int) error {
+		mutex.Lock()
+		order = append(order, i)
+		mutex.Unlock()
+		if i == 0 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if errs[0] == nil || errs[1] != errDependencyFailed || errs[2] != errDependencyFailed || errs[3] != nil || errs[4] != nil {
+		t.Fatalf("%v", errs)
+	}
+	if len(order) != 3 {
+		t.Fatalf("%v", order)
+	}
+	position := make(map[int]int)
+	for k, i := range order {
+		position[i] = k
+	}
+	if position[3] < position[4] {
+		t.Fatalf("3 started before 4: %v", order)
+	}
+}
+
+func TestRunJobsCycle(t *testing.T) {
+	// 1 and 2 depend on each other
+	deps := [][]int{nil, {2}, {1}}
+	errs := runJobs(2, deps, func(i int) error {
+		return nil
+	})
+	if errs[0] != nil || errs[1] != errDependencyCycle || errs[2] != errDependencyCycle {
+		t.Fatalf("%v", errs)
+	}
+}
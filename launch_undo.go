@@ -0,0 +1,120 @@
+package lxdops
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
+)
+
+type undoStep struct {
+	Description string
+	Undo        func() error
+}
+
+// launchUndo records how to undo the completed steps of a launch, so that a failed launch can be undone.
+type launchUndo struct {
+	steps []*undoStep
+}
+
+// Add records how to undo a step
+func (t *launchUndo) Add(description string, undo func() error) {
+	t.steps = append(t.steps, &undoStep{Description: description, Undo: undo})
+}
+
+// Run undoes the recorded steps in reverse order.
+// It continues after errors, and returns all of them.
+func (t *launchUndo) Run() error {
+	var errs []string
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		step := t.steps[i]
+		fmt.Fprintf(os.Stderr, "undo: %s\n", step.Description)
+		err := step.Undo()
+		if err != nil {
+			errs = append(errs, step.Description+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Print prints the steps that Run would undo
+func (t *launchUndo) Print() {
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		fmt.Fprintf(os.Stderr, "keep: %s\n", t.steps[i].Description)
+	}
+}
+
+// deleteNewContainer stops and deletes a container that was created by a failed launch, if it exists.
+func (t *Launcher) deleteNewContainer(server lxd.InstanceServer, container string) error {
+	state, _, err := server.GetInstanceState(container)
+	if api.StatusErrorCheck(err, http.StatusNotFound) {
+		// the container was not created
+		return nil
+	}
+	if err != nil {
+		return lxdutil.AnnotateLXDError(container, err)
+	}
+	if state.StatusCode == api.Running {
+		err = (lxdutil.InstanceServer{Server: server}).StopContainer(container)
+		if err != nil {
+			return err
+		}
+	}
+	op, err := server.DeleteInstance(container)
+	if err == nil {
+		err = op.Wait()
+	}
+	return lxdutil.AnnotateLXDError(container, err)
+}
+
+// destroyNewFilesystems destroys the filesystems of an instance that were created or cloned by this launch,
+// which are marked IsNew.  Nested filesystems are destroyed before their parents.
+// It continues after errors, and returns the first one.
+func (t *Launcher) destroyNewFilesystems(instance *Instance) error {
+	filesystems, err := instance.FilesystemList()
+	if err != nil {
+		return err
+	}
+	InstanceFSList(filesystems).Sort()
+	var volumes *VolumeOps
+	var firstError error
+	for i := len(filesystems) - 1; i >= 0; i-- {
+		fs := filesystems[i]
+		if !fs.IsNew {
+			continue
+		}
+		switch fs.Type() {
+		case FilesystemZfs:
+			err = t.host().Run("sudo", "zfs", "destroy", "-r", fs.Path)
+		case FilesystemBtrfs:
+			err = t.destroyBtrfs(fs)
+		case FilesystemVolume:
+			if volumes == nil {
+				volumes, err = NewVolumeOps(t.Client, instance.Config.Project)
+				if err != nil {
+					return err
+				}
+				volumes.Trace = t.Trace
+			}
+			err = volumes.Delete(fs)
+		default:
+			err = t.host().Run("sudo", "rm", "-rf", fs.Dir())
+		}
+		if err != nil {
+			if firstError == nil {
+				firstError = err
+			}
+			continue
+		}
+		fs.IsNew = false
+	}
+	return firstError
+}
@@ -0,0 +1,97 @@
+package lxdops
+
+import (
+	"errors"
+	"testing"
+)
+
+// failingInitRunner is an lxcRunner whose "lxc init" creates the container, and then fails
+type failingInitRunner struct {
+	*lxcRunner
+}
+
+func (t *failingInitRunner) Run(name string, args ...string) error {
+	err := t.lxcRunner.Run(name, args...)
+	if err == nil && name == "lxc" && len(args) > 2 && args[2] == "init" {
+		err = errors.New("init failed")
+	}
+	return err
+}
+
+func TestLaunchUndo(t *testing.T) {
+	x := newLauncherTest()
+	x.Launcher.Host = &failingInitRunner{x.Host}
+	instance, err := NewInstance(nil, newLaunchConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err == nil {
+		t.Fatalf("launch did not fail")
+	}
+	verifyCommands(t, x.Host.Commands,
+		"sudo zfs create -p z/test/a",
+		"sudo mkdir -p /z/test/a/home",
+		"lxc --project default init images:alpine/3.18 -p base -p a.lxdops a",
+		"sudo zfs destroy -r z/test/a",
+	)
+	if x.Server.Instance("a") != nil {
+		t.Errorf("container was not deleted")
+	}
+	if x.Server.Profile("a.lxdops") != nil {
+		t.Errorf("profile was not deleted")
+	}
+
+	x.Host.Commands = nil
+	x.Launcher.KeepOnFailure = true
+	instance, err = NewInstance(nil, newLaunchConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err == nil {
+		t.Fatalf("launch did not fail")
+	}
+	verifyCommands(t, x.Host.Commands,
+		"sudo zfs create -p z/test/a",
+		"sudo mkdir -p /z/test/a/home",
+		"lxc --project default init images:alpine/3.18 -p base -p a.lxdops a",
+	)
+	if x.Server.Instance("a") == nil || x.Server.Profile("a.lxdops") == nil {
+		t.Errorf("container or profile was deleted")
+	}
+
+	// a launch that fails because the container exists does not delete it
+	x.Host.Commands = nil
+	x.Launcher.KeepOnFailure = false
+	x.Launcher.Host = x.Host
+	x.Server.Instance("a").Profiles = []string{"base"}
+	err = x.Server.DeleteProfile("a.lxdops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err = NewInstance(nil, newLaunchConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err == nil {
+		t.Fatalf("launched existing container")
+	}
+	if x.Server.Instance("a") == nil {
+		t.Errorf("existing container was deleted")
+	}
+}
+
+func TestDeleteNewContainer(t *testing.T) {
+	x := newLauncherTest()
+	err := x.Launcher.deleteNewContainer(x.Server, "a")
+	if err != nil {
+		t.Errorf("missing container: %v", err)
+	}
+	// an error other than not found is reported, instead of assuming that the container was not created
+	err = x.Launcher.deleteNewContainer(&failingServer{Server: x.Server, Methods: []string{"GetInstanceState"}}, "a")
+	if err == nil {
+		t.Errorf("ignored error")
+	}
+}
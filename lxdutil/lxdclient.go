@@ -16,6 +16,8 @@ type LxdClient struct {
 	Http   bool `usage:"connect to LXD using http"`
 	Unix   bool `usage:"connect to LXD using unix socket"`
 	//Project        string `name:"project" usage:"the LXD project to use.  Overrides Config.Project"`
+	// remote is the lxc remote to connect to over http.  If empty, use the default remote.
+	remote        string
 	rootServer    lxd.InstanceServer
 	projectServer lxd.InstanceServer
 	LxcConfig
@@ -71,14 +73,18 @@ func (t *LxdClient) connectHttp() (lxd.InstanceServer, error) {
 	if err != nil {
 		return nil, err
 	}
-	if cfg.DefaultRemote == "" {
+	remoteName := t.remote
+	if remoteName == "" {
+		remoteName = cfg.DefaultRemote
+	}
+	if remoteName == "" {
 		return nil, fmt.Errorf("missing default remote")
 	}
-	remote, found := cfg.Remotes[cfg.DefaultRemote]
+	remote, found := cfg.Remotes[remoteName]
 	if !found {
-		return nil, fmt.Errorf("missing remote: %s", cfg.DefaultRemote)
+		return nil, fmt.Errorf("missing remote: %s", remoteName)
 	}
-	serverCrt, err := t.readConfigFile(fmt.Sprintf("servercerts/%s.crt", cfg.DefaultRemote))
+	serverCrt, err := t.readConfigFile(fmt.Sprintf("servercerts/%s.crt", remoteName))
 	if err != nil {
 		return nil, err
 	}
@@ -124,6 +130,17 @@ func (t *LxdClient) RootServer() (lxd.InstanceServer, error) {
 	return t.rootServer, nil
 }
 
+// RemoteClient returns a client for another remote of the lxc configuration, which it connects to over http.
+func (t *LxdClient) RemoteClient(remote string) *LxdClient {
+	return &LxdClient{Http: true, remote: remote, LxcConfig: t.LxcConfig}
+}
+
+// SetRootServer specifies the server to use, instead of connecting to LXD.
+// It is used for testing with a fake server.
+func (t *LxdClient) SetRootServer(server lxd.InstanceServer) {
+	t.rootServer = server
+}
+
 func (t *LxdClient) ProjectServer(project string) (lxd.InstanceServer, error) {
 	var err error
 	if project == "" {
@@ -0,0 +1,90 @@
+package lxdtest
+
+import (
+	"encoding/json"
+	"io"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+)
+
+// The backup files of the fake server are json encoded api.InstancePut.
+// They do not include the instance snapshots.
+
+func (t *Server) CreateInstanceBackup(instanceName string, post api.InstanceBackupsPost) (lxd.Operation, error) {
+	instance, err := t.getInstance(instanceName)
+	if err != nil {
+		return nil, err
+	}
+	if instance.Backups == nil {
+		instance.Backups = make(map[string]*api.InstanceBackup)
+	}
+	if _, exists := instance.Backups[post.Name]; exists {
+		return nil, conflict("backup already exists: %s/%s", instanceName, post.Name)
+	}
+	instance.Backups[post.Name] = &api.InstanceBackup{Name: post.Name, ExpiresAt: post.ExpiresAt,
+		InstanceOnly: post.InstanceOnly, OptimizedStorage: post.OptimizedStorage}
+	return &operation{}, nil
+}
+
+func (t *Server) GetInstanceBackupNames(instanceName string) ([]string, error) {
+	instance, err := t.getInstance(instanceName)
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(instance.Backups), nil
+}
+
+func (t *Server) GetInstanceBackupFile(instanceName string, name string, req *lxd.BackupFileRequest) (*lxd.BackupFileResponse, error) {
+	instance, err := t.getInstance(instanceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := instance.Backups[name]; !exists {
+		return nil, notFound("backup", instanceName+"/"+name)
+	}
+	data, err := json.Marshal(instance.InstancePut)
+	if err != nil {
+		return nil, err
+	}
+	n, err := req.BackupFile.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	return &lxd.BackupFileResponse{Size: int64(n)}, nil
+}
+
+func (t *Server) DeleteInstanceBackup(instanceName string, name string) (lxd.Operation, error) {
+	instance, err := t.getInstance(instanceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := instance.Backups[name]; !exists {
+		return nil, notFound("backup", instanceName+"/"+name)
+	}
+	delete(instance.Backups, name)
+	return &operation{}, nil
+}
+
+// CreateInstanceFromBackup creates a stopped instance from a backup file of the fake server.
+func (t *Server) CreateInstanceFromBackup(args lxd.InstanceBackupArgs) (lxd.Operation, error) {
+	data, err := io.ReadAll(args.BackupFile)
+	if err != nil {
+		return nil, err
+	}
+	var put api.InstancePut
+	err = json.Unmarshal(data, &put)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := t.Project().Instances[args.Name]; exists {
+		return nil, conflict("instance already exists: %s", args.Name)
+	}
+	for _, profile := range put.Profiles {
+		if _, exists := t.Project().Profiles[profile]; !exists {
+			return nil, notFound("profile", profile)
+		}
+	}
+	t.AddInstance(args.Name, put)
+	return &operation{}, nil
+}
@@ -0,0 +1,640 @@
+// Package lxdtest provides an in-memory fake LXD server, for testing.
+package lxdtest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+)
+
+// Server is an in-memory fake lxd.InstanceServer.
+// It implements the part of lxd.InstanceServer that lxdops uses:
+// profiles, instances, instance snapshots, instance backups, instance state, custom storage volumes, and operations.
+// The other methods of lxd.InstanceServer panic.
+// Servers returned by UseProject share the same data, but see only their own project.
+type Server struct {
+	lxd.InstanceServer
+	data    *serverData
+	project string
+}
+
+type serverData struct {
+	projects map[string]*Project
+	hwaddr   int
+	address  int
+}
+
+// Project holds the profiles, instances, and custom volumes of an LXD project
+type Project struct {
+	Profiles  map[string]*Profile
+	Instances map[string]*Instance
+	// Volumes are keyed by <pool>/<volume>
+	Volumes map[string]*Volume
+}
+
+// Profile is a profile stored in the fake server
+type Profile struct {
+	api.ProfilePut
+	Version int
+}
+
+// Instance is an instance stored in the fake server
+type Instance struct {
+	api.InstancePut
+	Status    string
+	CreatedAt time.Time
+	Network   map[string]api.InstanceStateNetwork
+	Snapshots map[string]*api.InstanceSnapshot
+	Backups   map[string]*api.InstanceBackup
+	Version   int
+}
+
+// NewServer creates a Server with a "default" project that has an empty "default" profile.
+func NewServer() *Server {
+	t := &Server{data: &serverData{projects: make(map[string]*Project)}, project: "default"}
+	t.Project().Profiles["default"] = &Profile{ProfilePut: api.ProfilePut{
+		Config:  map[string]string{},
+		Devices: map[string]map[string]string{}}}
+	return t
+}
+
+func notFound(kind, name string) error {
+	return api.StatusErrorf(http.StatusNotFound, "%s not found: %s", kind, name)
+}
+
+func conflict(format string, a ...any) error {
+	return api.StatusErrorf(http.StatusConflict, format, a...)
+}
+
+func etag(version int) string {
+	return strconv.Itoa(version)
+}
+
+func checkETag(version int, tag string) error {
+	if tag != "" && tag != etag(version) {
+		return api.StatusErrorf(http.StatusPreconditionFailed, "ETag doesn't match: %s vs %s", tag, etag(version))
+	}
+	return nil
+}
+
+func copyMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for key, value := range m {
+		c[key] = value
+	}
+	return c
+}
+
+func copyDevices(devices map[string]map[string]string) map[string]map[string]string {
+	c := make(map[string]map[string]string, len(devices))
+	for name, device := range devices {
+		c[name] = copyMap(device)
+	}
+	return c
+}
+
+func copyStrings(list []string) []string {
+	return append([]string(nil), list...)
+}
+
+func copyProfilePut(p api.ProfilePut) api.ProfilePut {
+	p.Config = copyMap(p.Config)
+	p.Devices = copyDevices(p.Devices)
+	return p
+}
+
+func copyInstancePut(p api.InstancePut) api.InstancePut {
+	p.Config = copyMap(p.Config)
+	p.Devices = copyDevices(p.Devices)
+	p.Profiles = copyStrings(p.Profiles)
+	return p
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Project returns the data of the server's project, creating it if it does not exist.
+func (t *Server) Project() *Project {
+	p, exists := t.data.projects[t.project]
+	if !exists {
+		p = &Project{Profiles: make(map[string]*Profile), Instances: make(map[string]*Instance), Volumes: make(map[string]*Volume)}
+		t.data.projects[t.project] = p
+	}
+	return p
+}
+
+// Instance returns the stored instance with the given name, or nil.
+func (t *Server) Instance(name string) *Instance {
+	return t.Project().Instances[name]
+}
+
+// Profile returns the stored profile with the given name, or nil.
+func (t *Server) Profile(name string) *Profile {
+	return t.Project().Profiles[name]
+}
+
+// AddProfile adds a profile, for setting up tests.
+func (t *Server) AddProfile(name string, put api.ProfilePut) {
+	t.Project().Profiles[name] = &Profile{ProfilePut: copyProfilePut(put)}
+}
+
+// AddInstance adds a stopped instance, for setting up tests.
+func (t *Server) AddInstance(name string, put api.InstancePut) {
+	t.Project().Instances[name] = &Instance{
+		InstancePut: copyInstancePut(put),
+		Status:      api.Stopped.String(),
+		CreatedAt:   time.Now(),
+		Snapshots:   make(map[string]*api.InstanceSnapshot),
+	}
+}
+
+func (t *Server) getInstance(name string) (*Instance, error) {
+	instance, exists := t.Project().Instances[name]
+	if !exists {
+		return nil, notFound("instance", name)
+	}
+	return instance, nil
+}
+
+func (t *Server) UseProject(name string) lxd.InstanceServer {
+	if name == "" {
+		name = "default"
+	}
+	return &Server{data: t.data, project: name}
+}
+
+// profiles
+
+func (t *Server) GetProfileNames() ([]string, error) {
+	return sortedKeys(t.Project().Profiles), nil
+}
+
+func (t *Server) usedBy(profile string) []string {
+	var instances []string
+	p := t.Project()
+	for _, name := range sortedKeys(p.Instances) {
+		for _, used := range p.Instances[name].Profiles {
+			if used == profile {
+				instances = append(instances, "/1.0/instances/"+name)
+				break
+			}
+		}
+	}
+	return instances
+}
+
+func (t *Server) GetProfile(name string) (*api.Profile, string, error) {
+	p, exists := t.Project().Profiles[name]
+	if !exists {
+		return nil, "", notFound("profile", name)
+	}
+	return &api.Profile{Name: name, ProfilePut: copyProfilePut(p.ProfilePut), UsedBy: t.usedBy(name)}, etag(p.Version), nil
+}
+
+func (t *Server) GetProfiles() ([]api.Profile, error) {
+	var profiles []api.Profile
+	for _, name := range sortedKeys(t.Project().Profiles) {
+		profile, _, _ := t.GetProfile(name)
+		profiles = append(profiles, *profile)
+	}
+	return profiles, nil
+}
+
+func (t *Server) CreateProfile(profile api.ProfilesPost) error {
+	if _, exists := t.Project().Profiles[profile.Name]; exists {
+		return conflict("profile already exists: %s", profile.Name)
+	}
+	t.AddProfile(profile.Name, profile.ProfilePut)
+	return nil
+}
+
+func (t *Server) UpdateProfile(name string, profile api.ProfilePut, ETag string) error {
+	p, exists := t.Project().Profiles[name]
+	if !exists {
+		return notFound("profile", name)
+	}
+	if err := checkETag(p.Version, ETag); err != nil {
+		return err
+	}
+	p.ProfilePut = copyProfilePut(profile)
+	p.Version++
+	return nil
+}
+
+func (t *Server) DeleteProfile(name string) error {
+	if _, exists := t.Project().Profiles[name]; !exists {
+		return notFound("profile", name)
+	}
+	if used := t.usedBy(name); len(used) > 0 {
+		return conflict("profile is currently in use: %s", name)
+	}
+	delete(t.Project().Profiles, name)
+	return nil
+}
+
+// instances
+
+func (t *Server) expand(instance *Instance) (map[string]string, map[string]map[string]string) {
+	config := make(map[string]string)
+	devices := make(map[string]map[string]string)
+	for _, name := range instance.Profiles {
+		profile, exists := t.Project().Profiles[name]
+		if !exists {
+			continue
+		}
+		for key, value := range profile.Config {
+			config[key] = value
+		}
+		for key, device := range profile.Devices {
+			devices[key] = copyMap(device)
+		}
+	}
+	for key, value := range instance.Config {
+		config[key] = value
+	}
+	for key, device := range instance.Devices {
+		devices[key] = copyMap(device)
+	}
+	return config, devices
+}
+
+func (t *Server) apiInstance(name string, instance *Instance) *api.Instance {
+	c := &api.Instance{
+		InstancePut: copyInstancePut(instance.InstancePut),
+		Name:        name,
+		Status:      instance.Status,
+		StatusCode:  api.StatusCodeFromString(instance.Status),
+		CreatedAt:   instance.CreatedAt,
+		Type:        string(api.InstanceTypeContainer),
+		Project:     t.project,
+	}
+	c.ExpandedConfig, c.ExpandedDevices = t.expand(instance)
+	return c
+}
+
+func (t *Server) GetInstanceNames(instanceType api.InstanceType) ([]string, error) {
+	return sortedKeys(t.Project().Instances), nil
+}
+
+func (t *Server) GetInstances(instanceType api.InstanceType) ([]api.Instance, error) {
+	var instances []api.Instance
+	for _, name := range sortedKeys(t.Project().Instances) {
+		instances = append(instances, *t.apiInstance(name, t.Project().Instances[name]))
+	}
+	return instances, nil
+}
+
+func (t *Server) GetInstance(name string) (*api.Instance, string, error) {
+	instance, err := t.getInstance(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return t.apiInstance(name, instance), etag(instance.Version), nil
+}
+
+func (t *Server) CreateInstance(post api.InstancesPost) (lxd.Operation, error) {
+	if _, exists := t.Project().Instances[post.Name]; exists {
+		return nil, conflict("instance already exists: %s", post.Name)
+	}
+	for _, profile := range post.Profiles {
+		if _, exists := t.Project().Profiles[profile]; !exists {
+			return nil, notFound("profile", profile)
+		}
+	}
+	put := post.InstancePut
+	if put.Profiles == nil {
+		put.Profiles = []string{"default"}
+	}
+	t.AddInstance(post.Name, put)
+	return &operation{}, nil
+}
+
+func (t *Server) UpdateInstance(name string, put api.InstancePut, ETag string) (lxd.Operation, error) {
+	instance, err := t.getInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkETag(instance.Version, ETag); err != nil {
+		return nil, err
+	}
+	for _, profile := range put.Profiles {
+		if _, exists := t.Project().Profiles[profile]; !exists {
+			return nil, notFound("profile", profile)
+		}
+	}
+	instance.InstancePut = copyInstancePut(put)
+	instance.Version++
+	return &operation{}, nil
+}
+
+func (t *Server) RenameInstance(name string, post api.InstancePost) (lxd.Operation, error) {
+	instance, err := t.getInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	if instance.Status == api.Running.String() {
+		return nil, conflict("renaming of running instance not allowed: %s", name)
+	}
+	if _, exists := t.Project().Instances[post.Name]; exists {
+		return nil, conflict("instance already exists: %s", post.Name)
+	}
+	delete(t.Project().Instances, name)
+	t.Project().Instances[post.Name] = instance
+	return &operation{}, nil
+}
+
+func (t *Server) DeleteInstance(name string) (lxd.Operation, error) {
+	instance, err := t.getInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	if instance.Status == api.Running.String() {
+		return nil, api.StatusErrorf(http.StatusBadRequest, "instance is running: %s", name)
+	}
+	delete(t.Project().Instances, name)
+	return &operation{}, nil
+}
+
+// state
+
+func (t *Server) GetInstanceState(name string) (*api.InstanceState, string, error) {
+	instance, err := t.getInstance(name)
+	if err != nil {
+		return nil, "", err
+	}
+	state := &api.InstanceState{
+		Status:     instance.Status,
+		StatusCode: api.StatusCodeFromString(instance.Status),
+		Network:    make(map[string]api.InstanceStateNetwork),
+	}
+	for network, net := range instance.Network {
+		state.Network[network] = net
+	}
+	return state, etag(instance.Version), nil
+}
+
+func (t *Server) start(instance *Instance) {
+	instance.Status = api.Running.String()
+	key := "volatile.eth0.hwaddr"
+	hwaddr := instance.Config[key]
+	if hwaddr == "" {
+		t.data.hwaddr++
+		hwaddr = fmt.Sprintf("00:16:3e:00:00:%02x", t.data.hwaddr)
+		if instance.Config == nil {
+			instance.Config = make(map[string]string)
+		}
+		instance.Config[key] = hwaddr
+	}
+	t.data.address++
+	instance.Network = map[string]api.InstanceStateNetwork{
+		"eth0": {
+			Hwaddr: hwaddr,
+			State:  "up",
+			Type:   "broadcast",
+			Addresses: []api.InstanceStateNetworkAddress{
+				{Family: "inet", Scope: "global", Address: fmt.Sprintf("10.0.0.%d", t.data.address), Netmask: "24"},
+			},
+		},
+	}
+}
+
+func (t *Server) stop(instance *Instance) {
+	instance.Status = api.Stopped.String()
+	instance.Network = nil
+}
+
+func (t *Server) UpdateInstanceState(name string, state api.InstanceStatePut, ETag string) (lxd.Operation, error) {
+	instance, err := t.getInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	running := instance.Status == api.Running.String()
+	switch state.Action {
+	case "start":
+		if running {
+			return nil, api.StatusErrorf(http.StatusBadRequest, "instance is already running: %s", name)
+		}
+		t.start(instance)
+	case "stop":
+		if !running {
+			return nil, api.StatusErrorf(http.StatusBadRequest, "instance is not running: %s", name)
+		}
+		t.stop(instance)
+	case "restart":
+		t.stop(instance)
+		t.start(instance)
+	default:
+		return nil, api.StatusErrorf(http.StatusBadRequest, "unknown action: %s", state.Action)
+	}
+	return &operation{}, nil
+}
+
+// snapshots
+
+func (t *Server) GetInstanceSnapshotNames(instanceName string) ([]string, error) {
+	instance, err := t.getInstance(instanceName)
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(instance.Snapshots), nil
+}
+
+func (t *Server) GetInstanceSnapshots(instanceName string) ([]api.InstanceSnapshot, error) {
+	instance, err := t.getInstance(instanceName)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []api.InstanceSnapshot
+	for _, name := range sortedKeys(instance.Snapshots) {
+		snapshots = append(snapshots, *instance.Snapshots[name])
+	}
+	return snapshots, nil
+}
+
+func (t *Server) GetInstanceSnapshot(instanceName string, name string) (*api.InstanceSnapshot, string, error) {
+	instance, err := t.getInstance(instanceName)
+	if err != nil {
+		return nil, "", err
+	}
+	snapshot, exists := instance.Snapshots[name]
+	if !exists {
+		return nil, "", notFound("snapshot", instanceName+"/"+name)
+	}
+	c := *snapshot
+	return &c, "", nil
+}
+
+func (t *Server) CreateInstanceSnapshot(instanceName string, post api.InstanceSnapshotsPost) (lxd.Operation, error) {
+	instance, err := t.getInstance(instanceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := instance.Snapshots[post.Name]; exists {
+		return nil, conflict("snapshot already exists: %s/%s", instanceName, post.Name)
+	}
+	instance.Snapshots[post.Name] = &api.InstanceSnapshot{
+		Name:      post.Name,
+		CreatedAt: time.Now(),
+		Config:    copyMap(instance.Config),
+		Devices:   copyDevices(instance.Devices),
+		Profiles:  copyStrings(instance.Profiles),
+	}
+	return &operation{}, nil
+}
+
+func (t *Server) DeleteInstanceSnapshot(instanceName string, name string) (lxd.Operation, error) {
+	instance, err := t.getInstance(instanceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := instance.Snapshots[name]; !exists {
+		return nil, notFound("snapshot", instanceName+"/"+name)
+	}
+	delete(instance.Snapshots, name)
+	return &operation{}, nil
+}
+
+// CopyInstanceSnapshot creates a new instance from a snapshot.  The source must be a *Server.
+func (t *Server) CopyInstanceSnapshot(source lxd.InstanceServer, instanceName string, snapshot api.InstanceSnapshot, args *lxd.InstanceSnapshotCopyArgs) (lxd.RemoteOperation, error) {
+	sourceServer, ok := source.(*Server)
+	if !ok {
+		return nil, fmt.Errorf("unsupported source server: %T", source)
+	}
+	if _, err := sourceServer.getInstance(instanceName); err != nil {
+		return nil, err
+	}
+	name := instanceName
+	if args != nil && args.Name != "" {
+		name = args.Name
+	}
+	if _, exists := t.Project().Instances[name]; exists {
+		return nil, conflict("instance already exists: %s", name)
+	}
+	put := api.InstancePut{Config: make(map[string]string), Devices: snapshot.Devices, Profiles: snapshot.Profiles}
+	for key, value := range snapshot.Config {
+		// LXD does not copy volatile keys
+		if len(key) < 9 || key[0:9] != "volatile." {
+			put.Config[key] = value
+		}
+	}
+	t.AddInstance(name, put)
+	return &remoteOperation{}, nil
+}
+
+// containers, for older parts of the API
+
+func (t *Server) GetContainer(name string) (*api.Container, string, error) {
+	c, etag, err := t.GetInstance(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return &api.Container{
+		ContainerPut: api.ContainerPut{
+			Architecture: c.Architecture,
+			Config:       c.Config,
+			Devices:      c.Devices,
+			Ephemeral:    c.Ephemeral,
+			Profiles:     c.Profiles,
+			Stateful:     c.Stateful,
+			Description:  c.Description,
+		},
+		CreatedAt:       c.CreatedAt,
+		ExpandedConfig:  c.ExpandedConfig,
+		ExpandedDevices: c.ExpandedDevices,
+		Name:            c.Name,
+		Status:          c.Status,
+		StatusCode:      c.StatusCode,
+	}, etag, nil
+}
+
+func (t *Server) GetContainers() ([]api.Container, error) {
+	var containers []api.Container
+	for _, name := range sortedKeys(t.Project().Instances) {
+		c, _, _ := t.GetContainer(name)
+		containers = append(containers, *c)
+	}
+	return containers, nil
+}
+
+func (t *Server) UpdateContainer(name string, put api.ContainerPut, ETag string) (lxd.Operation, error) {
+	return t.UpdateInstance(name, api.InstancePut{
+		Architecture: put.Architecture,
+		Config:       put.Config,
+		Devices:      put.Devices,
+		Ephemeral:    put.Ephemeral,
+		Profiles:     put.Profiles,
+		Stateful:     put.Stateful,
+		Description:  put.Description,
+	}, ETag)
+}
+
+func (t *Server) RenameContainer(name string, post api.ContainerPost) (lxd.Operation, error) {
+	return t.RenameInstance(name, api.InstancePost{Name: post.Name})
+}
+
+func (t *Server) GetContainerState(name string) (*api.ContainerState, string, error) {
+	state, etag, err := t.GetInstanceState(name)
+	if err != nil {
+		return nil, "", err
+	}
+	c := &api.ContainerState{
+		Status:     state.Status,
+		StatusCode: state.StatusCode,
+		Network:    make(map[string]api.ContainerStateNetwork),
+	}
+	for network, net := range state.Network {
+		cnet := api.ContainerStateNetwork{Hwaddr: net.Hwaddr, State: net.State, Type: net.Type}
+		for _, a := range net.Addresses {
+			cnet.Addresses = append(cnet.Addresses, api.ContainerStateNetworkAddress{
+				Family: a.Family, Address: a.Address, Netmask: a.Netmask, Scope: a.Scope})
+		}
+		c.Network[network] = cnet
+	}
+	return c, etag, nil
+}
+
+func (t *Server) CreateContainerSnapshot(containerName string, post api.ContainerSnapshotsPost) (lxd.Operation, error) {
+	return t.CreateInstanceSnapshot(containerName, api.InstanceSnapshotsPost{Name: post.Name, Stateful: post.Stateful})
+}
+
+// operations
+
+// operation is a completed lxd.Operation
+type operation struct {
+	lxd.Operation
+}
+
+func (op *operation) Get() api.Operation {
+	return api.Operation{Status: api.Success.String(), StatusCode: api.Success}
+}
+
+func (op *operation) Wait() error {
+	return nil
+}
+
+func (op *operation) WaitContext(ctx context.Context) error {
+	return nil
+}
+
+// remoteOperation is a completed lxd.RemoteOperation
+type remoteOperation struct {
+	lxd.RemoteOperation
+}
+
+func (op *remoteOperation) Wait() error {
+	return nil
+}
+
+var _ lxd.InstanceServer = (*Server)(nil)
@@ -0,0 +1,222 @@
+package lxdtest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+)
+
+// Volume is a custom storage volume stored in the fake server
+type Volume struct {
+	api.StorageVolumePut
+	// Source is the <pool>/<volume>[/<snapshot>] that the volume was copied from, if any.
+	Source string
+	// Restored is the last snapshot that the volume was restored from, if any.
+	Restored  string
+	Snapshots map[string]*api.StorageVolumeSnapshot
+	Version   int
+}
+
+func volumeKey(pool, name string) string {
+	return pool + "/" + name
+}
+
+// Volume returns the stored custom volume with the given pool and name, or nil.
+func (t *Server) Volume(pool, name string) *Volume {
+	return t.Project().Volumes[volumeKey(pool, name)]
+}
+
+// AddVolume adds a custom volume, for setting up tests.
+func (t *Server) AddVolume(pool, name string, put api.StorageVolumePut) *Volume {
+	put.Config = copyMap(put.Config)
+	v := &Volume{StorageVolumePut: put, Snapshots: make(map[string]*api.StorageVolumeSnapshot)}
+	t.Project().Volumes[volumeKey(pool, name)] = v
+	return v
+}
+
+func checkCustom(volType string) error {
+	if volType != "custom" {
+		return api.StatusErrorf(http.StatusBadRequest, "unsupported volume type: %s", volType)
+	}
+	return nil
+}
+
+func (t *Server) getVolume(pool, volType, name string) (*Volume, error) {
+	if err := checkCustom(volType); err != nil {
+		return nil, err
+	}
+	v, exists := t.Project().Volumes[volumeKey(pool, name)]
+	if !exists {
+		return nil, notFound("storage volume", volumeKey(pool, name))
+	}
+	return v, nil
+}
+
+func (t *Server) GetStoragePoolVolumeNames(pool string) ([]string, error) {
+	var names []string
+	for _, key := range sortedKeys(t.Project().Volumes) {
+		if strings.HasPrefix(key, pool+"/") {
+			names = append(names, key[len(pool)+1:])
+		}
+	}
+	return names, nil
+}
+
+func (t *Server) GetStoragePoolVolume(pool string, volType string, name string) (*api.StorageVolume, string, error) {
+	v, err := t.getVolume(pool, volType, name)
+	if err != nil {
+		return nil, "", err
+	}
+	put := v.StorageVolumePut
+	put.Config = copyMap(put.Config)
+	return &api.StorageVolume{StorageVolumePut: put, Name: name, Type: volType, ContentType: "filesystem", Project: t.project}, etag(v.Version), nil
+}
+
+func (t *Server) CreateStoragePoolVolume(pool string, volume api.StorageVolumesPost) error {
+	if err := checkCustom(volume.Type); err != nil {
+		return err
+	}
+	if t.Volume(pool, volume.Name) != nil {
+		return conflict("storage volume already exists: %s", volumeKey(pool, volume.Name))
+	}
+	t.AddVolume(pool, volume.Name, volume.StorageVolumePut)
+	return nil
+}
+
+// UpdateStoragePoolVolume updates the volume configuration, or restores a snapshot, if volume.Restore is set.
+func (t *Server) UpdateStoragePoolVolume(pool string, volType string, name string, volume api.StorageVolumePut, ETag string) error {
+	v, err := t.getVolume(pool, volType, name)
+	if err != nil {
+		return err
+	}
+	if err := checkETag(v.Version, ETag); err != nil {
+		return err
+	}
+	if volume.Restore != "" {
+		if _, exists := v.Snapshots[volume.Restore]; !exists {
+			return notFound("storage volume snapshot", volumeKey(pool, name)+"/"+volume.Restore)
+		}
+		v.Restored = volume.Restore
+	}
+	v.Config = copyMap(volume.Config)
+	v.Description = volume.Description
+	v.Version++
+	return nil
+}
+
+func (t *Server) DeleteStoragePoolVolume(pool string, volType string, name string) error {
+	if _, err := t.getVolume(pool, volType, name); err != nil {
+		return err
+	}
+	delete(t.Project().Volumes, volumeKey(pool, name))
+	return nil
+}
+
+func (t *Server) RenameStoragePoolVolume(pool string, volType string, name string, volume api.StorageVolumePost) error {
+	v, err := t.getVolume(pool, volType, name)
+	if err != nil {
+		return err
+	}
+	if t.Volume(pool, volume.Name) != nil {
+		return conflict("storage volume already exists: %s", volumeKey(pool, volume.Name))
+	}
+	delete(t.Project().Volumes, volumeKey(pool, name))
+	t.Project().Volumes[volumeKey(pool, volume.Name)] = v
+	return nil
+}
+
+// CopyStoragePoolVolume copies a volume, or a volume snapshot named <volume>/<snapshot>.
+// The source must be a *Server.  Snapshots are not copied.
+func (t *Server) CopyStoragePoolVolume(pool string, source lxd.InstanceServer, sourcePool string, volume api.StorageVolume, args *lxd.StoragePoolVolumeCopyArgs) (lxd.RemoteOperation, error) {
+	sourceServer, ok := source.(*Server)
+	if !ok {
+		return nil, fmt.Errorf("unsupported source server: %T", source)
+	}
+	sourceName, snapshot, isSnapshot := strings.Cut(volume.Name, "/")
+	v, err := sourceServer.getVolume(sourcePool, volume.Type, sourceName)
+	if err != nil {
+		return nil, err
+	}
+	if isSnapshot {
+		if _, exists := v.Snapshots[snapshot]; !exists {
+			return nil, notFound("storage volume snapshot", volumeKey(sourcePool, volume.Name))
+		}
+	}
+	name := volume.Name
+	if args != nil && args.Name != "" {
+		name = args.Name
+	}
+	if t.Volume(pool, name) != nil {
+		return nil, conflict("storage volume already exists: %s", volumeKey(pool, name))
+	}
+	c := t.AddVolume(pool, name, v.StorageVolumePut)
+	c.Source = volumeKey(sourcePool, volume.Name)
+	return &remoteOperation{}, nil
+}
+
+func (t *Server) GetStoragePoolVolumeSnapshotNames(pool string, volumeType string, volumeName string) ([]string, error) {
+	v, err := t.getVolume(pool, volumeType, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(v.Snapshots), nil
+}
+
+func (t *Server) GetStoragePoolVolumeSnapshots(pool string, volumeType string, volumeName string) ([]api.StorageVolumeSnapshot, error) {
+	v, err := t.getVolume(pool, volumeType, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []api.StorageVolumeSnapshot
+	for _, name := range sortedKeys(v.Snapshots) {
+		snapshots = append(snapshots, *v.Snapshots[name])
+	}
+	return snapshots, nil
+}
+
+func (t *Server) GetStoragePoolVolumeSnapshot(pool string, volumeType string, volumeName string, snapshotName string) (*api.StorageVolumeSnapshot, string, error) {
+	v, err := t.getVolume(pool, volumeType, volumeName)
+	if err != nil {
+		return nil, "", err
+	}
+	snapshot, exists := v.Snapshots[snapshotName]
+	if !exists {
+		return nil, "", notFound("storage volume snapshot", volumeKey(pool, volumeName)+"/"+snapshotName)
+	}
+	c := *snapshot
+	return &c, "", nil
+}
+
+func (t *Server) CreateStoragePoolVolumeSnapshot(pool string, volumeType string, volumeName string, snapshot api.StorageVolumeSnapshotsPost) (lxd.Operation, error) {
+	v, err := t.getVolume(pool, volumeType, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := v.Snapshots[snapshot.Name]; exists {
+		return nil, conflict("storage volume snapshot already exists: %s/%s", volumeKey(pool, volumeName), snapshot.Name)
+	}
+	v.Snapshots[snapshot.Name] = &api.StorageVolumeSnapshot{
+		StorageVolumeSnapshotPut: api.StorageVolumeSnapshotPut{Description: v.Description},
+		Name:                     snapshot.Name,
+		Config:                   copyMap(v.Config),
+		ContentType:              "filesystem",
+		CreatedAt:                time.Now(),
+	}
+	return &operation{}, nil
+}
+
+func (t *Server) DeleteStoragePoolVolumeSnapshot(pool string, volumeType string, volumeName string, snapshotName string) (lxd.Operation, error) {
+	v, err := t.getVolume(pool, volumeType, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := v.Snapshots[snapshotName]; !exists {
+		return nil, notFound("storage volume snapshot", volumeKey(pool, volumeName)+"/"+snapshotName)
+	}
+	delete(v.Snapshots, snapshotName)
+	return &operation{}, nil
+}
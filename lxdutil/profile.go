@@ -16,13 +16,17 @@ type ProfileOps struct {
 	Dir    string     `name:"d" usage:"export directory"`
 }
 
-func (t *ProfileOps) ExportProfile(server lxd.InstanceServer, name string) error {
+// MarshalProfile returns a profile in the yaml format of ExportProfile
+func MarshalProfile(server lxd.InstanceServer, name string) ([]byte, error) {
 	profile, _, err := server.GetProfile(name)
 	if err != nil {
-		return fmt.Errorf("%w: %s", err, name)
+		return nil, fmt.Errorf("%w: %s", err, name)
 	}
+	return yaml.Marshal(&profile.ProfilePut)
+}
 
-	data, err := yaml.Marshal(&profile.ProfilePut)
+func (t *ProfileOps) ExportProfile(server lxd.InstanceServer, name string) error {
+	data, err := MarshalProfile(server, name)
 	if err != nil {
 		return err
 	}
@@ -50,12 +54,16 @@ func (t *ProfileOps) ImportProfile(server lxd.InstanceServer, file string, exist
 	if err != nil {
 		return err
 	}
+	return t.ImportProfileData(server, filepath.Base(file), data, existingProfiles)
+}
+
+// ImportProfileData creates or updates a profile from its yaml, in the format of ExportProfile
+func (t *ProfileOps) ImportProfileData(server lxd.InstanceServer, name string, data []byte, existingProfiles map[string]bool) error {
 	var profile api.ProfilePut
-	err = yaml.Unmarshal(data, &profile)
+	err := yaml.Unmarshal(data, &profile)
 	if err != nil {
 		return err
 	}
-	name := filepath.Base(file)
 	_, exists := existingProfiles[name]
 	if exists {
 		return server.UpdateProfile(name, profile, "")
@@ -3,6 +3,7 @@ package main
 import (
 	_ "embed"
 	"fmt"
+	"strings"
 
 	"melato.org/cloudconfig/ostype"
 	"melato.org/command"
@@ -16,6 +17,7 @@ func main() {
 	lxdops.OSTypes["alpine"] = &ostype.Alpine{}
 	lxdops.OSTypes["debian"] = &ostype.Debian{}
 	lxdops.OSTypes["ubuntu"] = &ostype.Debian{}
+	lxdops.Version = strings.TrimSpace(version)
 	cmd := lxdops.RootCommand()
 	cmd.Command("version").NoConfig().RunMethod(func() { fmt.Println(version) }).Short("print program version")
 	command.Main(cmd)
@@ -2,13 +2,25 @@ package lxdops
 
 import (
 	"errors"
+	"fmt"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
-	"melato.org/script"
+	"melato.org/lxdops/util"
 )
 
+// StreamOptions specify how zfs filesystems are sent to another host
+type StreamOptions struct {
+	Intermediate bool   `name:"I" usage:"send all intermediate snapshots, in incremental sends"`
+	Raw          bool   `name:"raw" usage:"send raw streams (zfs send -w), for encrypted filesystems"`
+	Compressed   bool   `name:"compressed" usage:"send compressed blocks as they are stored (zfs send -c)"`
+	Pipe         string `name:"pipe" usage:"a command to insert between zfs send and zfs receive, such as mbuffer"`
+	Progress     bool   `name:"progress" usage:"print progress, with zfs send -v"`
+}
+
 type Migrate struct {
 	PropertyOptions
 	FromHost      string
@@ -18,7 +30,10 @@ type Migrate struct {
 	Container     string
 	Snapshot      string `name:"s" usage:"snapshot name"`
 	DryRun        bool   `name:"dry-run" usage:"show the commands to run, but do not change anything"`
-	makeSnapshot  bool
+	StreamOptions
+	// Host runs host commands.  If nil, a ScriptRunner is used.
+	Host         HostRunner `name:"-"`
+	makeSnapshot bool
 }
 
 func (t *Migrate) Init() error {
@@ -27,7 +42,7 @@ func (t *Migrate) Init() error {
 
 func (t *Migrate) Configured() error {
 	if len(t.Snapshot) == 0 {
-		t.Snapshot = time.Now().UTC().Format("20060102150405")
+		t.Snapshot = time.Now().UTC().Format(SnapshotTimeFormat)
 		t.makeSnapshot = true
 	}
 	if (t.FromHost == "") == (t.ToHost == "") {
@@ -48,6 +63,13 @@ func (t *Migrate) Configured() error {
 	return t.PropertyOptions.Configured()
 }
 
+func (t *Migrate) host() HostRunner {
+	if t.Host == nil {
+		return &ScriptRunner{Trace: true, DryRun: t.DryRun}
+	}
+	return t.Host
+}
+
 func (t *Migrate) hostCommand(host, command string, args ...string) *exec.Cmd {
 	if host != "" {
 		return exec.Command("ssh", append([]string{host, command}, args...)...)
@@ -82,9 +104,11 @@ func (t *Migrate) CopyFilesystems() error {
 	if err != nil {
 		return err
 	}
-	s := script.Script{Trace: true, DryRun: t.DryRun}
 	if t.makeSnapshot {
-		s.RunCmd(t.hostCommand(t.FromHost, "lxdops", "snapshot", "-s", t.Snapshot, "--name", t.FromContainer, t.ConfigFile))
+		err := t.host().RunCmd(t.hostCommand(t.FromHost, "lxdops", "snapshot", "-s", t.Snapshot, "--name", t.FromContainer, t.ConfigFile))
+		if err != nil {
+			return err
+		}
 	}
 	for _, fs := range filesystems {
 		if fs.IsZfs() && !fs.Filesystem.Transient {
@@ -92,10 +116,167 @@ func (t *Migrate) CopyFilesystems() error {
 			if !ok {
 				continue
 			}
-			send := t.hostCommand(t.FromHost, "sudo", "zfs", "send", fromFS.Path+"@"+t.Snapshot)
-			receive := t.hostCommand(t.ToHost, "sudo", "zfs", "receive", fs.Path)
-			s.RunCmd(send, receive)
+			err := t.copyFilesystem(fromFS, fs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// zfsSnapshot is a zfs snapshot name, without the filesystem, and its guid.
+// The guid identifies the same snapshot in different hosts.
+type zfsSnapshot struct {
+	Name string
+	Guid string
+}
+
+// hostLines runs a query command on a host, via ssh, or locally if host is empty.
+func (t *Migrate) hostLines(host, command string, args ...string) ([]string, error) {
+	if host != "" {
+		return t.host().Lines("ssh", append([]string{host, command}, args...)...)
+	}
+	return t.host().Lines(command, args...)
+}
+
+// zfsSnapshots returns the snapshots of a zfs filesystem in a host, in creation order.
+// It returns an error if the filesystem does not exist.
+func (t *Migrate) zfsSnapshots(host, path string) ([]zfsSnapshot, error) {
+	lines, err := t.hostLines(host, "zfs", "list", "-H", "-p", "-t", "snapshot", "-o", "name,guid", "-d", "1", path)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []zfsSnapshot
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		_, name, found := strings.Cut(fields[0], "@")
+		if found {
+			snapshots = append(snapshots, zfsSnapshot{Name: name, Guid: fields[1]})
+		}
+	}
+	return snapshots, nil
+}
+
+// commonSnapshot returns the latest snapshot in from, up to snapshot, that is also in to.
+// It also returns true if to already has snapshot.
+func commonSnapshot(from, to []zfsSnapshot, snapshot string) (string, bool) {
+	guids := make(map[string]bool)
+	for _, s := range to {
+		guids[s.Guid] = true
+	}
+	var common string
+	for _, s := range from {
+		if guids[s.Guid] {
+			if s.Name == snapshot {
+				return s.Name, true
+			}
+			common = s.Name
+		}
+		if s.Name == snapshot {
+			break
+		}
+	}
+	return common, false
+}
+
+// resumeToken returns the receive_resume_token of a partially received filesystem, or "".
+func (t *Migrate) resumeToken(fs *InstanceFS) string {
+	lines, err := t.hostLines(t.ToHost, "zfs", "get", "-H", "-o", "value", "receive_resume_token", fs.Path)
+	if err != nil || len(lines) == 0 || lines[0] == "-" {
+		return ""
+	}
+	return lines[0]
+}
+
+// estimateSize returns the estimated size of a send stream, or -1 if it is not known.
+func (t *Migrate) estimateSize(args []string) int64 {
+	lines, _ := t.hostLines(t.FromHost, "sudo", append([]string{"zfs", "send", "-n", "-P"}, args...)...)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "size" {
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err == nil {
+				return size
+			}
+		}
+	}
+	return -1
+}
+
+// send runs zfs send | [pipe] | zfs receive -s, so that an interrupted receive can be resumed.
+// args are the zfs send arguments that specify the stream.
+func (t *Migrate) send(fs *InstanceFS, args []string, receiveArgs ...string) error {
+	resume := len(args) > 0 && args[0] == "-t"
+	var options []string
+	if !resume {
+		// a resumed stream uses the options of the original stream
+		if t.Raw {
+			options = append(options, "-w")
+		}
+		if t.Compressed {
+			options = append(options, "-c")
+		}
+	}
+	args = append(options, args...)
+	description := fs.Path
+	if !resume {
+		description = args[len(args)-1]
+	}
+	if size := t.estimateSize(args); size >= 0 {
+		description += " (" + util.FormatSize(size) + ")"
+	}
+	fmt.Printf("send %s\n", description)
+	if t.Progress {
+		args = append([]string{"-v"}, args...)
+	}
+	cmds := []*exec.Cmd{t.hostCommand(t.FromHost, "sudo", append([]string{"zfs", "send"}, args...)...)}
+	if pipe := strings.Fields(t.Pipe); len(pipe) > 0 {
+		cmds = append(cmds, exec.Command(pipe[0], pipe[1:]...))
+	}
+	receiveArgs = append(append([]string{"zfs", "receive", "-s"}, receiveArgs...), fs.Path)
+	cmds = append(cmds, t.hostCommand(t.ToHost, "sudo", receiveArgs...))
+	return t.host().RunCmd(cmds...)
+}
+
+// copyFilesystem sends the snapshot of fromFS to fs, with zfs send/receive.
+// It first resumes any interrupted receive of fs.
+// If fs already exists, it sends an incremental stream from the latest snapshot that the two have in common,
+// so that copy-filesystems can be repeated, to keep a copy in sync.
+func (t *Migrate) copyFilesystem(fromFS, fs *InstanceFS) error {
+	if token := t.resumeToken(fs); token != "" {
+		err := t.send(fs, []string{"-t", token})
+		if err != nil {
+			return err
+		}
+	}
+	var sendArgs, receiveArgs []string
+	toSnapshots, err := t.zfsSnapshots(t.ToHost, fs.Path)
+	if err == nil {
+		// the destination exists
+		fromSnapshots, err := t.zfsSnapshots(t.FromHost, fromFS.Path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fromFS.Path, err)
+		}
+		common, upToDate := commonSnapshot(fromSnapshots, toSnapshots, t.Snapshot)
+		if upToDate {
+			fmt.Printf("%s is up to date\n", fs.SnapshotPath(t.Snapshot))
+			return nil
+		}
+		if common == "" {
+			return fmt.Errorf("%s exists, but has no snapshots in common with %s", fs.Path, fromFS.Path)
+		}
+		option := "-i"
+		if t.Intermediate {
+			option = "-I"
 		}
+		sendArgs = append(sendArgs, option, "@"+common)
+		// discard any changes in the destination, since the common snapshot
+		receiveArgs = append(receiveArgs, "-F")
 	}
-	return s.Error()
+	sendArgs = append(sendArgs, fromFS.SnapshotPath(t.Snapshot))
+	return t.send(fs, sendArgs, receiveArgs...)
 }
@@ -0,0 +1,410 @@
+package lxdops
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
+	"melato.org/lxdops/util"
+)
+
+// MigrateInstance moves an instance to another LXD host:
+// its filesystems, with zfs send/receive over ssh, its lxdops profile, and its container.
+// The source container is stopped only before the final incremental pass,
+// and is left stopped, so that it can be deleted when the target is verified.
+// If the migration fails before the target container is started, the source container is started again.
+type MigrateInstance struct {
+	ConfigOptions
+	DryRun           bool     `name:"dry-run" usage:"show the commands to run, but do not change anything"`
+	Remote           string   `name:"remote" usage:"the target LXD remote, from the lxc configuration"`
+	ToHost           string   `name:"to-host" usage:"the ssh destination of the target host, for zfs receive"`
+	TargetProperties []string `name:"target-P" usage:"a property of the target instance, in the form <key>=<value>.  Target properties override instance and global properties"`
+	Relaunch         bool     `name:"relaunch" usage:"launch a new container from the config image, instead of copying the container"`
+	StreamOptions
+	// Host runs host commands.  If nil, a ScriptRunner is used.
+	Host   HostRunner         `name:"-"`
+	Client *lxdutil.LxdClient `name:"-"`
+	// Target is the client of the target LXD server.  If nil, it connects to Remote.
+	Target *lxdutil.LxdClient `name:"-"`
+	// Now is the time used in the names of the migration snapshots.  If it is zero, the current time is used.
+	Now time.Time `name:"-"`
+}
+
+func (t *MigrateInstance) Init() error {
+	return t.ConfigOptions.Init()
+}
+
+func (t *MigrateInstance) Configured() error {
+	if t.Remote == "" {
+		return errors.New("missing remote")
+	}
+	if t.ToHost == "" {
+		return errors.New("missing target host")
+	}
+	for _, property := range t.TargetProperties {
+		if !strings.Contains(property, "=") {
+			return errors.New("missing value from property: " + property)
+		}
+	}
+	return t.ConfigOptions.Configured()
+}
+
+func (t *MigrateInstance) host() HostRunner {
+	if t.Host == nil {
+		return &ScriptRunner{Trace: true, DryRun: t.DryRun}
+	}
+	return t.Host
+}
+
+func (t *MigrateInstance) target() *lxdutil.LxdClient {
+	if t.Target == nil {
+		t.Target = t.Client.RemoteClient(t.Remote)
+	}
+	return t.Target
+}
+
+// targetRun runs a command on the target host, via ssh
+func (t *MigrateInstance) targetRun(name string, args ...string) error {
+	return t.host().Run("ssh", append([]string{t.ToHost, name}, args...)...)
+}
+
+// TargetInstance returns the instance on the target host, which has the target properties.
+func (t *MigrateInstance) TargetInstance(instance *Instance) (*Instance, error) {
+	if len(t.TargetProperties) == 0 {
+		return instance, nil
+	}
+	config := *instance.Config
+	config.Properties = make(map[string]string)
+	for key, value := range instance.Config.Properties {
+		config.Properties[key] = value
+	}
+	globalProperties := make(map[string]string)
+	for key, value := range instance.GlobalProperties {
+		globalProperties[key] = value
+	}
+	for _, property := range t.TargetProperties {
+		key, value, _ := strings.Cut(property, "=")
+		config.Properties[key] = value
+		globalProperties[key] = value
+	}
+	return newInstance(globalProperties, &config, instance.Name, false)
+}
+
+// migrationFilesystems returns the filesystems to replicate, and the transient filesystems to create.
+// Only zfs filesystems can be replicated.
+func (t *MigrateInstance) migrationFilesystems(instance *Instance) ([]*InstanceFS, []*InstanceFS, error) {
+	filesystems, err := instance.FilesystemList()
+	if err != nil {
+		return nil, nil, err
+	}
+	var replicated, transient []*InstanceFS
+	for _, fs := range filesystems {
+		if fs.Filesystem.Transient && (fs.IsZfs() || fs.IsDir()) {
+			transient = append(transient, fs)
+		} else if fs.IsZfs() {
+			replicated = append(replicated, fs)
+		} else {
+			return nil, nil, fmt.Errorf("cannot migrate %s filesystem %s", fs.Type(), fs.Id)
+		}
+	}
+	return replicated, transient, nil
+}
+
+// replicate snapshots the replicated filesystems of the instance and sends them to the target host.
+func (t *MigrateInstance) replicate(instance, target *Instance, snapshot string) error {
+	fmt.Printf("replicate %s@%s\n", instance.Name, snapshot)
+	set := &SnapshotSet{Host: t.host()}
+	err := set.Create(snapshot, instance)
+	if err != nil {
+		return err
+	}
+	replicated, _, err := t.migrationFilesystems(instance)
+	if err != nil {
+		return err
+	}
+	targetFilesystems, err := target.Filesystems()
+	if err != nil {
+		return err
+	}
+	copier := &Migrate{ToHost: t.ToHost, Snapshot: snapshot, DryRun: t.DryRun, StreamOptions: t.StreamOptions, Host: t.Host}
+	for _, fs := range replicated {
+		err := copier.copyFilesystem(fs, targetFilesystems[fs.Id])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createParents creates the parents of the top replicated filesystems in the target host,
+// so that they can be received.
+func (t *MigrateInstance) createParents(instance, target *Instance) error {
+	replicated, _, err := t.migrationFilesystems(instance)
+	if err != nil {
+		return err
+	}
+	targetFilesystems, err := target.Filesystems()
+	if err != nil {
+		return err
+	}
+	var list []*InstanceFS
+	for _, fs := range replicated {
+		list = append(list, targetFilesystems[fs.Id])
+	}
+	for _, parent := range InstanceFSList(list).ParentPaths() {
+		err := t.targetRun("sudo", "zfs", "create", "-p", parent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTransient creates the transient filesystems of the target, and their device directories.
+func (t *MigrateInstance) createTransient(instance, target *Instance) error {
+	_, transient, err := t.migrationFilesystems(instance)
+	if err != nil {
+		return err
+	}
+	targetFilesystems, err := target.Filesystems()
+	if err != nil {
+		return err
+	}
+	owner, err := target.Config.DeviceOwner.Substitute(target.Properties)
+	if err != nil {
+		return err
+	}
+	for _, fs := range transient {
+		fs = targetFilesystems[fs.Id]
+		if fs.IsZfs() {
+			args := []string{"zfs", "create", "-p"}
+			keys := make([]string, 0, len(fs.Filesystem.Zfsproperties))
+			for key := range fs.Filesystem.Zfsproperties {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				args = append(args, "-o", key+"="+fs.Filesystem.Zfsproperties[key])
+			}
+			err = t.targetRun("sudo", append(args, fs.Path)...)
+		} else {
+			err = t.targetRun("sudo", "mkdir", "-p", fs.Dir())
+		}
+		if err != nil {
+			return err
+		}
+		for _, d := range SortDevices(target.Config.Devices) {
+			if d.Device.Filesystem != fs.Id {
+				continue
+			}
+			dir, err := target.DeviceDir(d.Name, d.Device)
+			if err != nil {
+				return err
+			}
+			err = t.targetRun("sudo", "mkdir", "-p", dir)
+			if err == nil && owner != "" {
+				err = t.targetRun("sudo", "chown", owner, dir)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hwaddresses returns the volatile hwaddr configuration of a container
+func hwaddresses(config map[string]string) map[string]string {
+	result := make(map[string]string)
+	for key, value := range config {
+		if strings.HasPrefix(key, "volatile.") && strings.HasSuffix(key, ".hwaddr") {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// createContainer copies the stopped source container to the target, or launches a new one,
+// with the profiles and hwaddr of the source container.
+func (t *MigrateInstance) createContainer(instance *Instance, profiles []string, hwaddr map[string]string, targetServer lxd.InstanceServer) error {
+	config := instance.Config
+	container := instance.Container()
+	var args []string
+	if config.Project != "" {
+		args = append(args, "--project", config.Project)
+	}
+	if t.Relaunch {
+		image, err := config.OS.Image.Substitute(instance.Properties)
+		if err != nil {
+			return err
+		}
+		if image == "" {
+			return errors.New("Please provide image or version")
+		}
+		args = append(args, "init", image)
+		for _, profile := range profiles {
+			args = append(args, "-p", profile)
+		}
+		args = append(args, config.LxcOptions...)
+		args = append(args, t.Remote+":"+container)
+	} else {
+		args = append(args, "copy", "--instance-only", container, t.Remote+":"+container)
+		if config.Project != "" {
+			args = append(args, "--target-project", config.Project)
+		}
+	}
+	err := t.host().Run("lxc", args...)
+	if err != nil {
+		return err
+	}
+	for key, value := range hwaddr {
+		fmt.Printf("set config %s: %s\n", key, value)
+	}
+	if t.DryRun {
+		return nil
+	}
+	c, etag, err := targetServer.GetInstance(container)
+	if err != nil {
+		return lxdutil.AnnotateLXDError(container, err)
+	}
+	c.Profiles = profiles
+	if c.Config == nil {
+		c.Config = make(map[string]string)
+	}
+	for key, value := range hwaddr {
+		c.Config[key] = value
+	}
+	op, err := targetServer.UpdateInstance(container, c.InstancePut, etag)
+	if err == nil {
+		err = op.Wait()
+	}
+	return lxdutil.AnnotateLXDError(container, err)
+}
+
+func (t *MigrateInstance) Run(instance *Instance) (err error) {
+	target, err := t.TargetInstance(instance)
+	if err != nil {
+		return err
+	}
+	container := instance.Container()
+	project := instance.Config.Project
+	server, err := t.Client.ProjectServer(project)
+	if err != nil {
+		return err
+	}
+	targetServer, err := t.target().ProjectServer(project)
+	if err != nil {
+		return err
+	}
+	c, _, err := server.GetInstance(container)
+	if err != nil {
+		return lxdutil.AnnotateLXDError(container, err)
+	}
+	if _, _, err := targetServer.GetInstance(container); err == nil {
+		return fmt.Errorf("container %s already exists in %s", container, t.Remote)
+	}
+	targetProfiles, err := targetServer.GetProfileNames()
+	if err != nil {
+		return err
+	}
+	profileName := instance.ProfileName()
+	missing := util.StringSlice(c.Profiles).Diff(append(targetProfiles, profileName))
+	if len(missing) > 0 {
+		return fmt.Errorf("missing profiles in %s: %v", t.Remote, missing)
+	}
+	if _, _, err := t.migrationFilesystems(instance); err != nil {
+		return err
+	}
+	hwaddr := hwaddresses(c.Config)
+	state, _, err := server.GetInstanceState(container)
+	if err != nil {
+		return lxdutil.AnnotateLXDError(container, err)
+	}
+	running := state.StatusCode == api.Running
+
+	now := t.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	snapshot := "migrate-" + now.UTC().Format(SnapshotTimeFormat)
+	err = t.createParents(instance, target)
+	if err != nil {
+		return err
+	}
+	// sourceStopped is true while the source container is stopped and the target container is not started,
+	// so that the source container is started again, if the migration fails.
+	var sourceStopped bool
+	defer func() {
+		if err != nil && sourceStopped {
+			fmt.Printf("start %s\n", container)
+			if err := (lxdutil.InstanceServer{Server: server}).StartContainer(container); err != nil {
+				fmt.Fprintf(os.Stderr, "start %s: %v\n", container, err)
+			}
+		}
+	}()
+	if running {
+		// copy most of the data while the container is running
+		err = t.replicate(instance, target, snapshot+"-warm")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("stop %s\n", container)
+		if !t.DryRun {
+			err = (lxdutil.InstanceServer{Server: server}).StopContainer(container)
+			if err != nil {
+				return err
+			}
+			sourceStopped = true
+		}
+	}
+	err = t.replicate(instance, target, snapshot)
+	if err != nil {
+		return err
+	}
+	err = t.createTransient(instance, target)
+	if err != nil {
+		return err
+	}
+	if len(util.StringSlice([]string{profileName}).Diff(c.Profiles)) == 0 {
+		// the source container uses the lxdops profile
+		dev, err := NewDeviceConfigurer(target)
+		if err != nil {
+			return err
+		}
+		dev.Trace = true
+		dev.DryRun = t.DryRun
+		err = dev.CreateProfile(t.target(), target)
+		if err != nil {
+			return err
+		}
+	}
+	err = t.createContainer(target, c.Profiles, hwaddr, targetServer)
+	if err != nil {
+		return err
+	}
+	if running || t.Relaunch {
+		fmt.Printf("start %s:%s\n", t.Remote, container)
+		if !t.DryRun {
+			err = (lxdutil.InstanceServer{Server: targetServer}).StartContainer(container)
+			if err != nil {
+				return err
+			}
+			sourceStopped = false
+		}
+	}
+	if t.Relaunch {
+		configurer := &Configurer{Client: t.target(), Trace: true, DryRun: t.DryRun}
+		err = configurer.ConfigureContainer(target)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("migrated %s to %s.  The source container is stopped\n", container, t.Remote)
+	return nil
+}
@@ -0,0 +1,163 @@
+package lxdops
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
+	"melato.org/lxdops/lxdutil/lxdtest"
+)
+
+// migrateRunner is a RecordingRunner that keeps track of the zfs snapshots of one filesystem
+// in the source and target hosts, and applies "lxc copy" to the target LXD server.
+type migrateRunner struct {
+	RecordingRunner
+	Target          *lxdtest.Server
+	SourceSnapshots []string
+	TargetSnapshots []string
+}
+
+func (t *migrateRunner) Run(name string, args ...string) error {
+	err := t.RecordingRunner.Run(name, args...)
+	if err != nil {
+		return err
+	}
+	command := commandString(name, args...)
+	if strings.HasPrefix(command, "sudo zfs snapshot ") {
+		_, snapshot, _ := strings.Cut(args[len(args)-1], "@")
+		t.SourceSnapshots = append(t.SourceSnapshots, snapshot)
+	}
+	if name == "lxc" && strings.Contains(command, " copy ") {
+		t.Target.AddInstance("a", api.InstancePut{Profiles: []string{"base", "a.lxdops"}})
+	}
+	return nil
+}
+
+func (t *migrateRunner) RunCmd(cmds ...*exec.Cmd) error {
+	err := t.RecordingRunner.RunCmd(cmds...)
+	if err != nil {
+		return err
+	}
+	send := cmds[0].Args
+	_, snapshot, _ := strings.Cut(send[len(send)-1], "@")
+	t.TargetSnapshots = append(t.TargetSnapshots, snapshot)
+	return nil
+}
+
+func (t *migrateRunner) Lines(name string, args ...string) ([]string, error) {
+	t.RecordingRunner.Lines(name, args...)
+	if args[len(args)-2] != "1" {
+		// not zfs list -d 1
+		return nil, nil
+	}
+	path := args[len(args)-1]
+	snapshots := t.SourceSnapshots
+	if name == "ssh" {
+		snapshots = t.TargetSnapshots
+		if len(snapshots) == 0 {
+			return nil, errors.New("dataset does not exist")
+		}
+	}
+	var lines []string
+	for _, snapshot := range snapshots {
+		lines = append(lines, path+"@"+snapshot+"\t"+snapshot)
+	}
+	return lines, nil
+}
+
+func TestMigrateInstance(t *testing.T) {
+	x := newLauncherTest()
+	config := newLaunchConfig()
+	config.Properties = map[string]string{"pool": "z"}
+	config.Filesystems["root"].Pattern = "(pool)/test/(instance)"
+	instance, err := NewInstance(nil, config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hwaddr := x.Server.Instance("a").Config["volatile.eth0.hwaddr"]
+
+	target := lxdtest.NewServer()
+	target.AddProfile("base", api.ProfilePut{})
+	targetClient := &lxdutil.LxdClient{}
+	targetClient.SetRootServer(target)
+	host := &migrateRunner{Target: target}
+	migrate := &MigrateInstance{Remote: "t", ToHost: "h2", TargetProperties: []string{"pool=y"},
+		Host: host, Client: x.Launcher.Client, Target: targetClient,
+		Now: time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)}
+	err = migrate.Run(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"ssh h2 sudo zfs create -p y/test",
+		"sudo zfs snapshot z/test/a@migrate-20230101120000-warm",
+		"sudo zfs send z/test/a@migrate-20230101120000-warm | ssh h2 sudo zfs receive -s y/test/a",
+		"sudo zfs snapshot z/test/a@migrate-20230101120000",
+		"sudo zfs send -i @migrate-20230101120000-warm z/test/a@migrate-20230101120000 | ssh h2 sudo zfs receive -s -F y/test/a",
+		"lxc --project default copy --instance-only a t:a --target-project default",
+	)
+	if x.Server.Instance("a").Status != api.Stopped.String() {
+		t.Errorf("source container is %s", x.Server.Instance("a").Status)
+	}
+	c := target.Instance("a")
+	if c.Status != api.Running.String() {
+		t.Errorf("target container is %s", c.Status)
+	}
+	if c.Config["volatile.eth0.hwaddr"] != hwaddr {
+		t.Errorf("hwaddr was not preserved")
+	}
+	profile := target.Profile("a.lxdops")
+	if profile == nil {
+		t.Fatalf("missing target profile")
+	}
+	if profile.Devices["home"]["source"] != "/y/test/a/home" {
+		t.Errorf("home device: %v", profile.Devices["home"])
+	}
+
+	err = migrate.Run(instance)
+	if err == nil {
+		t.Errorf("migrated to an existing container")
+	}
+}
+
+func TestMigrateInstanceFailure(t *testing.T) {
+	x := newLauncherTest()
+	instance, err := NewInstance(nil, newLaunchConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := lxdtest.NewServer()
+	target.AddProfile("base", api.ProfilePut{})
+	targetClient := &lxdutil.LxdClient{}
+	targetClient.SetRootServer(target)
+	host := &migrateRunner{Target: target}
+	host.Errors = map[string]error{
+		"sudo zfs send -i @migrate-20230101120000-warm z/test/a@migrate-20230101120000 | ssh h2 sudo zfs receive -s -F z/test/a": errors.New("receive failed"),
+	}
+	migrate := &MigrateInstance{Remote: "t", ToHost: "h2",
+		Host: host, Client: x.Launcher.Client, Target: targetClient,
+		Now: time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)}
+	err = migrate.Run(instance)
+	if err == nil {
+		t.Fatalf("migrated with a failed replication")
+	}
+	if x.Server.Instance("a").Status != api.Running.String() {
+		t.Errorf("source container is %s", x.Server.Instance("a").Status)
+	}
+	if target.Instance("a") != nil {
+		t.Errorf("created target container")
+	}
+}
@@ -0,0 +1,106 @@
+package lxdops
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCommonSnapshot(t *testing.T) {
+	from := []zfsSnapshot{{"s1", "1"}, {"s2", "2"}, {"s3", "3"}, {"s4", "4"}}
+	cases := []struct {
+		To       []zfsSnapshot
+		Snapshot string
+		Common   string
+		UpToDate bool
+	}{
+		{[]zfsSnapshot{{"s1", "1"}, {"s2", "2"}}, "s4", "s2", false},
+		{[]zfsSnapshot{{"s1", "1"}, {"s2", "x"}}, "s4", "s1", false},
+		{[]zfsSnapshot{{"s3", "3"}}, "s2", "", false},
+		{[]zfsSnapshot{{"s1", "1"}, {"s3", "3"}}, "s3", "s3", true},
+		{nil, "s4", "", false},
+	}
+	for i, c := range cases {
+		common, upToDate := commonSnapshot(from, c.To, c.Snapshot)
+		if common != c.Common || upToDate != c.UpToDate {
+			t.Errorf("%d: %s %v", i, common, upToDate)
+		}
+	}
+}
+
+func TestCopyFilesystemIncremental(t *testing.T) {
+	instance := newTestInstance(t, "a")
+	fs, err := instance.FilesystemList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := fs[0]
+	fromQuery := "ssh h1 zfs list -H -p -t snapshot -o name,guid -d 1 z/test/a"
+	toQuery := "zfs list -H -p -t snapshot -o name,guid -d 1 z/test/a"
+	host := &RecordingRunner{
+		Output: map[string][]string{
+			fromQuery: {"z/test/a@s1\t1", "z/test/a@s2\t2", "z/test/a@s3\t3"},
+			toQuery:   {"z/test/a@s1\t1", "z/test/a@s2\t2"},
+		},
+		Errors: map[string]error{},
+	}
+	migrate := &Migrate{Host: host, FromHost: "h1", Snapshot: "s3"}
+	err = migrate.copyFilesystem(root, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate.Intermediate = true
+	err = migrate.copyFilesystem(root, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Errors[toQuery] = errors.New("dataset does not exist")
+	err = migrate.copyFilesystem(root, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"ssh h1 sudo zfs send -i @s2 z/test/a@s3 | sudo zfs receive -s -F z/test/a",
+		"ssh h1 sudo zfs send -I @s2 z/test/a@s3 | sudo zfs receive -s -F z/test/a",
+		"ssh h1 sudo zfs send z/test/a@s3 | sudo zfs receive -s z/test/a",
+	)
+
+	host.Commands = nil
+	delete(host.Errors, toQuery)
+	host.Output[toQuery] = []string{"z/test/a@s3\t3"}
+	err = migrate.copyFilesystem(root, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Output[toQuery] = []string{"z/test/a@x\t9"}
+	err = migrate.copyFilesystem(root, root)
+	if err == nil {
+		t.Errorf("copied to a filesystem with no common snapshots")
+	}
+	verifyCommands(t, host.Commands)
+}
+
+func TestCopyFilesystemResume(t *testing.T) {
+	instance := newTestInstance(t, "a")
+	fs, err := instance.FilesystemList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := fs[0]
+	host := &RecordingRunner{
+		Output: map[string][]string{
+			"zfs get -H -o value receive_resume_token z/test/a":            {"1-abc"},
+			"ssh h1 zfs list -H -p -t snapshot -o name,guid -d 1 z/test/a": {"z/test/a@s1\t1", "z/test/a@s2\t2"},
+			"zfs list -H -p -t snapshot -o name,guid -d 1 z/test/a":        {"z/test/a@s1\t1"},
+		},
+	}
+	migrate := &Migrate{Host: host, FromHost: "h1", Snapshot: "s2"}
+	migrate.StreamOptions = StreamOptions{Raw: true, Progress: true, Pipe: "mbuffer -q"}
+	err = migrate.copyFilesystem(root, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"ssh h1 sudo zfs send -v -t 1-abc | mbuffer -q | sudo zfs receive -s z/test/a",
+		"ssh h1 sudo zfs send -v -w -i @s1 z/test/a@s2 | mbuffer -q | sudo zfs receive -s -F z/test/a",
+	)
+}
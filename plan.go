@@ -0,0 +1,310 @@
+package lxdops
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
+	"melato.org/lxdops/util"
+)
+
+// Plan actions
+const (
+	PlanCreate = "create"
+	PlanUpdate = "update"
+	PlanDelete = "delete"
+)
+
+// PlanAction is a change that is needed to bring an instance to the state of its config
+type PlanAction struct {
+	// Action is create, update, or delete
+	Action string
+	// Kind is the kind of the object: filesystem, device, profile, profile-device, profile-config, container, or snapshot
+	Kind string
+	Name string
+	// Detail describes the change
+	Detail string
+}
+
+func (t *PlanAction) String() string {
+	var sign string
+	switch t.Action {
+	case PlanCreate:
+		sign = "+"
+	case PlanUpdate:
+		sign = "~"
+	case PlanDelete:
+		sign = "-"
+	}
+	s := sign + " " + t.Kind + " " + t.Name
+	if t.Detail != "" {
+		s += ": " + t.Detail
+	}
+	return s
+}
+
+// InstancePlan is the list of changes for one instance
+type InstancePlan struct {
+	Instance string
+	Actions  []*PlanAction
+}
+
+func (t *InstancePlan) add(action, kind, name, detail string) {
+	t.Actions = append(t.Actions, &PlanAction{Action: action, Kind: kind, Name: name, Detail: detail})
+}
+
+// Count returns the number of actions of the given type
+func (t *InstancePlan) Count(action string) int {
+	var n int
+	for _, a := range t.Actions {
+		if a.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// Plan compares the config of instances with the actual state of their filesystems, devices, profile, and container,
+// and prints the changes that are needed, without changing anything.
+type Plan struct {
+	Client *lxdutil.LxdClient `name:"-"`
+	ConfigOptions
+}
+
+func (t *Plan) Init() error {
+	return t.ConfigOptions.Init()
+}
+
+func (t *Plan) Configured() error {
+	return t.ConfigOptions.Configured()
+}
+
+// diffMap compares the desired and the actual entries of a map, and adds an action for each difference.
+// The name of each entry is <name>/<key>.
+func (t *InstancePlan) diffMap(kind, name string, desired, actual map[string]string) {
+	for _, key := range util.MapKeys(desired) {
+		value, exists := actual[key]
+		if !exists {
+			t.add(PlanCreate, kind, name+"/"+key, desired[key])
+		} else if value != desired[key] {
+			t.add(PlanUpdate, kind, name+"/"+key, value+" -> "+desired[key])
+		}
+	}
+	for _, key := range util.MapKeys(actual) {
+		if _, exists := desired[key]; !exists {
+			t.add(PlanDelete, kind, name+"/"+key, actual[key])
+		}
+	}
+}
+
+// DiffProfile compares the desired and the actual devices and config of a profile
+func (t *InstancePlan) DiffProfile(name string, desired, actual api.ProfilePut) {
+	for _, device := range util.MapKeys(desired.Devices) {
+		d, exists := actual.Devices[device]
+		if !exists {
+			t.add(PlanCreate, "profile-device", name+"/"+device, formatDevice(desired.Devices[device]))
+			continue
+		}
+		var changes []string
+		for _, key := range util.MapKeys(desired.Devices[device]) {
+			if d[key] != desired.Devices[device][key] {
+				changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, d[key], desired.Devices[device][key]))
+			}
+		}
+		for _, key := range util.MapKeys(d) {
+			if _, exists := desired.Devices[device][key]; !exists {
+				changes = append(changes, fmt.Sprintf("%s: %s -> ", key, d[key]))
+			}
+		}
+		if len(changes) > 0 {
+			t.add(PlanUpdate, "profile-device", name+"/"+device, strings.Join(changes, ", "))
+		}
+	}
+	for _, device := range util.MapKeys(actual.Devices) {
+		if _, exists := desired.Devices[device]; !exists {
+			t.add(PlanDelete, "profile-device", name+"/"+device, formatDevice(actual.Devices[device]))
+		}
+	}
+	t.diffMap("profile-config", name, desired.Config, actual.Config)
+}
+
+func formatDevice(device map[string]string) string {
+	var entries []string
+	for _, key := range util.MapKeys(device) {
+		entries = append(entries, key+"="+device[key])
+	}
+	return strings.Join(entries, " ")
+}
+
+// InstanceProfile returns the devices and config of the instance profile, as configured.
+func (t *Instance) InstanceProfile() (api.ProfilePut, error) {
+	devices, err := t.NewDeviceMap()
+	if err != nil {
+		return api.ProfilePut{}, err
+	}
+	return api.ProfilePut{Devices: devices, Config: t.Config.ProfileConfig, Description: "lxdops profile"}, nil
+}
+
+func (t *Plan) planFilesystems(instance *Instance, plan *InstancePlan) error {
+	filesystems, err := instance.FilesystemList()
+	if err != nil {
+		return err
+	}
+	InstanceFSList(filesystems).Sort()
+	var volumes *VolumeOps
+	newFS := make(map[string]bool)
+	for _, fs := range filesystems {
+		var exists bool
+		if fs.IsVolume() {
+			if volumes == nil {
+				volumes, err = NewVolumeOps(t.Client, instance.Config.Project)
+				if err != nil {
+					return err
+				}
+			}
+			exists, err = volumes.Exists(fs)
+			if err != nil {
+				return err
+			}
+		} else {
+			exists = util.DirExists(fs.Dir())
+		}
+		if exists {
+			continue
+		}
+		newFS[fs.Id] = true
+		detail := fs.Type() + " " + fs.Path
+		source := instance.DeviceSource()
+		if source.IsDefined() && source.Clone && !fs.Filesystem.Transient {
+			detail += ", cloned from " + source.Instance.Name + "@" + source.Snapshot
+		}
+		plan.add(PlanCreate, "filesystem", fs.Id, detail)
+	}
+	for _, d := range SortDevices(instance.Config.Devices) {
+		dir, err := instance.DeviceDir(d.Name, d.Device)
+		if err != nil {
+			return err
+		}
+		if dir == "" || newFS[d.Device.Filesystem] || util.DirExists(dir) {
+			continue
+		}
+		plan.add(PlanCreate, "device", d.Name, dir)
+	}
+	return nil
+}
+
+func (t *Plan) planProfile(instance *Instance, server lxd.InstanceServer, plan *InstancePlan) error {
+	profileName := instance.ProfileName()
+	if profileName == "" || instance.Config.Devices == nil {
+		return nil
+	}
+	desired, err := instance.InstanceProfile()
+	if err != nil {
+		return err
+	}
+	profile, _, err := server.GetProfile(profileName)
+	if api.StatusErrorCheck(err, http.StatusNotFound) {
+		plan.add(PlanCreate, "profile", profileName, fmt.Sprintf("%d devices", len(desired.Devices)))
+		return nil
+	}
+	if err != nil {
+		return lxdutil.AnnotateLXDError(profileName, err)
+	}
+	plan.DiffProfile(profileName, desired, profile.ProfilePut)
+	return nil
+}
+
+func (t *Plan) planContainer(instance *Instance, server lxd.InstanceServer, plan *InstancePlan) error {
+	config := instance.Config
+	container := instance.Container()
+	profiles := instance.ContainerProfiles()
+	c, _, err := server.GetInstance(container)
+	if err != nil && !api.StatusErrorCheck(err, http.StatusNotFound) {
+		return lxdutil.AnnotateLXDError(container, err)
+	}
+	if err != nil {
+		source := instance.ContainerSource()
+		var detail string
+		if source.IsDefined() {
+			detail = "copy from " + source.Container
+			if source.Snapshot != "" {
+				detail += "/" + source.Snapshot
+			}
+		} else if config.OS != nil {
+			image, err := config.OS.Image.Substitute(instance.Properties)
+			if err != nil {
+				return err
+			}
+			detail = "launch " + image
+		}
+		detail += ", profiles " + strings.Join(profiles, ",")
+		plan.add(PlanCreate, "container", container, detail)
+		if config.Snapshot != "" {
+			plan.add(PlanCreate, "snapshot", container+"/"+config.Snapshot, "")
+		}
+		return nil
+	}
+	if !util.StringSlice(profiles).Equals(c.Profiles) {
+		plan.add(PlanUpdate, "container", container, fmt.Sprintf("profiles %s -> %s", strings.Join(c.Profiles, ","), strings.Join(profiles, ",")))
+	}
+	if config.Snapshot != "" {
+		snapshots, err := server.GetInstanceSnapshotNames(container)
+		if err != nil {
+			return lxdutil.AnnotateLXDError(container, err)
+		}
+		if !util.StringSlice(snapshots).ToSet().Contains(config.Snapshot) {
+			plan.add(PlanCreate, "snapshot", container+"/"+config.Snapshot, "")
+		}
+	}
+	return nil
+}
+
+// InstancePlan computes the changes for an instance.
+// It returns an error if the config profiles do not exist, since they are not managed by lxdops.
+func (t *Plan) InstancePlan(instance *Instance) (*InstancePlan, error) {
+	server, err := t.Client.ProjectServer(instance.Config.Project)
+	if err != nil {
+		return nil, err
+	}
+	launcher := &Launcher{}
+	err = launcher.verifyProfiles(server, instance.Config.Profiles)
+	if err != nil {
+		return nil, err
+	}
+	plan := &InstancePlan{Instance: instance.Name}
+	err = t.planFilesystems(instance, plan)
+	if err != nil {
+		return nil, err
+	}
+	err = t.planProfile(instance, server, plan)
+	if err != nil {
+		return nil, err
+	}
+	err = t.planContainer(instance, server, plan)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// Print prints the plan of an instance
+func (t *Plan) Print(instance *Instance) error {
+	plan, err := t.InstancePlan(instance)
+	if err != nil {
+		return err
+	}
+	if len(plan.Actions) == 0 {
+		fmt.Printf("%s: no changes\n", instance.Name)
+		return nil
+	}
+	fmt.Printf("%s:\n", instance.Name)
+	for _, action := range plan.Actions {
+		fmt.Printf("  %s\n", action)
+	}
+	fmt.Printf("%s: %d to create, %d to update, %d to delete\n", instance.Name,
+		plan.Count(PlanCreate), plan.Count(PlanUpdate), plan.Count(PlanDelete))
+	return nil
+}
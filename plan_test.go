@@ -0,0 +1,104 @@
+package lxdops
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/lxd/shared/api"
+)
+
+func planActions(plan *InstancePlan) []string {
+	var actions []string
+	for _, action := range plan.Actions {
+		actions = append(actions, action.String())
+	}
+	return actions
+}
+
+func TestPlan(t *testing.T) {
+	x := newLauncherTest()
+	dir := t.TempDir()
+	config := newLaunchConfig()
+	config.Filesystems["root"].Pattern = Pattern(dir + "/(instance)")
+	plan := &Plan{Client: x.Launcher.Client}
+
+	instance, err := NewInstance(nil, config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := plan.InstancePlan(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, planActions(p),
+		"+ filesystem root: dir "+dir+"/a",
+		"+ profile a.lxdops: 1 devices",
+		"+ container a: launch images:alpine/3.18, profiles base,a.lxdops",
+	)
+
+	err = x.Launcher.LaunchContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fake host does not create directories
+	err = os.MkdirAll(filepath.Join(dir, "a", "home"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = plan.InstancePlan(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, planActions(p))
+
+	config.Devices["log"] = &Device{Path: "/var/log", Filesystem: "root"}
+	config.ProfileConfig = map[string]string{"boot.autostart": "false"}
+	x.Server.AddProfile("extra", api.ProfilePut{})
+	c := x.Server.Instance("a")
+	c.Profiles = []string{"a.lxdops", "base", "extra"}
+	profile := x.Server.Profile("a.lxdops")
+	profile.Devices["home"]["readonly"] = "true"
+	profile.Devices["tmp"] = map[string]string{"type": "disk", "path": "/tmp", "source": "/tmp"}
+	instance, err = NewInstance(nil, config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = plan.InstancePlan(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, planActions(p),
+		"+ device log: "+dir+"/a/log",
+		"~ profile-device a.lxdops/home: readonly: true -> ",
+		"+ profile-device a.lxdops/log: path=/var/log source="+dir+"/a/log type=disk",
+		"- profile-device a.lxdops/tmp: path=/tmp source=/tmp type=disk",
+		"+ profile-config a.lxdops/boot.autostart: false",
+		"~ container a: profiles a.lxdops,base,extra -> base,a.lxdops",
+	)
+	if p.Count(PlanCreate) != 3 || p.Count(PlanUpdate) != 2 || p.Count(PlanDelete) != 1 {
+		t.Errorf("counts: %d %d %d", p.Count(PlanCreate), p.Count(PlanUpdate), p.Count(PlanDelete))
+	}
+
+	config.Profiles = []string{"base", "missing"}
+	_, err = plan.InstancePlan(instance)
+	if err == nil {
+		t.Errorf("planned with a missing profile")
+	}
+}
+
+func TestPlanServerError(t *testing.T) {
+	for _, method := range []string{"GetProfile", "GetInstance"} {
+		x := newLauncherTest()
+		x.Launcher.Client.SetRootServer(&failingServer{Server: x.Server, Methods: []string{method}})
+		instance, err := NewInstance(nil, newLaunchConfig(), "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan := &Plan{Client: x.Launcher.Client}
+		_, err = plan.InstancePlan(instance)
+		if err == nil {
+			t.Errorf("%s: plan treated a server error as a missing resource", method)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package lxdops
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotTimeFormat is the format of timestamped snapshot names, in UTC
+const SnapshotTimeFormat = "20060102150405"
+
+// ParseSnapshotTime parses a timestamped snapshot name.
+func ParseSnapshotTime(name string) (time.Time, bool) {
+	t, err := time.ParseInLocation(SnapshotTimeFormat, name, time.UTC)
+	return t, err == nil
+}
+
+// parseAge parses a Go duration, or a number of days or weeks, such as 14d or 4w
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			count, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+			if err != nil {
+				return 0, fmt.Errorf("invalid age: %s", s)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+func (t *Retention) Verify() error {
+	if t.Hourly < 0 || t.Daily < 0 || t.Weekly < 0 || t.Monthly < 0 {
+		return errors.New("negative count")
+	}
+	if t.MaxAge != "" {
+		_, err := parseAge(t.MaxAge)
+		if err != nil {
+			return err
+		}
+	}
+	if t.Hourly == 0 && t.Daily == 0 && t.Weekly == 0 && t.Monthly == 0 && t.MaxAge == "" {
+		return errors.New("no rules")
+	}
+	return nil
+}
+
+type retentionRule struct {
+	Count  int
+	Period func(t time.Time) string
+}
+
+func (t *Retention) rules() []retentionRule {
+	return []retentionRule{
+		{t.Hourly, func(t time.Time) string { return t.Format("2006010215") }},
+		{t.Daily, func(t time.Time) string { return t.Format("20060102") }},
+		{t.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{t.Monthly, func(t time.Time) string { return t.Format("200601") }},
+	}
+}
+
+// Prune returns the timestamped snapshot names that the retention policy does not keep, at time now, sorted.
+// Names that are not timestamps are ignored.
+func (t *Retention) Prune(names []string, now time.Time) ([]string, error) {
+	err := t.Verify()
+	if err != nil {
+		return nil, err
+	}
+	var maxAge time.Duration
+	if t.MaxAge != "" {
+		maxAge, _ = parseAge(t.MaxAge)
+	}
+	times := make(map[string]time.Time)
+	var sorted []string
+	for _, name := range names {
+		if tm, ok := ParseSnapshotTime(name); ok {
+			times[name] = tm
+			sorted = append(sorted, name)
+		}
+	}
+	// latest first
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+	keep := make(map[string]bool)
+	for _, rule := range t.rules() {
+		periods := make(map[string]bool)
+		for _, name := range sorted {
+			if len(periods) >= rule.Count {
+				break
+			}
+			period := rule.Period(times[name])
+			if !periods[period] {
+				periods[period] = true
+				keep[name] = true
+			}
+		}
+	}
+	if maxAge > 0 {
+		for _, name := range sorted {
+			if now.Sub(times[name]) < maxAge {
+				keep[name] = true
+			}
+		}
+	}
+	var prune []string
+	for _, name := range sorted {
+		if !keep[name] {
+			prune = append(prune, name)
+		}
+	}
+	sort.Strings(prune)
+	return prune, nil
+}
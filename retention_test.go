@@ -0,0 +1,115 @@
+package lxdops
+
+import (
+	"testing"
+	"time"
+
+	"melato.org/lxdops/util"
+)
+
+func TestRetentionPrune(t *testing.T) {
+	names := []string{
+		"20230101120000",
+		"20230102090000",
+		"20230102180000",
+		"20230103090000",
+		"20230103100000",
+		"copy",
+	}
+	now := time.Date(2023, 1, 3, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		Retention Retention
+		Prune     []string
+	}{
+		{Retention{Daily: 2}, []string{"20230101120000", "20230102090000", "20230103090000"}},
+		{Retention{Hourly: 1, Monthly: 1}, []string{"20230101120000", "20230102090000", "20230102180000", "20230103090000"}},
+		{Retention{MaxAge: "1d"}, []string{"20230101120000", "20230102090000"}},
+		{Retention{Daily: 1, MaxAge: "30h"}, []string{"20230101120000"}},
+	}
+	for i, c := range cases {
+		prune, err := c.Retention.Prune(names, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !util.StringSlice(prune).Equals(c.Prune) {
+			t.Errorf("%d: %v expected: %v", i, prune, c.Prune)
+		}
+	}
+}
+
+func TestRetentionVerify(t *testing.T) {
+	if (&Retention{}).Verify() == nil {
+		t.Errorf("accepted empty retention")
+	}
+	if (&Retention{MaxAge: "2x"}).Verify() == nil {
+		t.Errorf("accepted invalid max-age")
+	}
+	age, err := parseAge("2w")
+	if err != nil || age != 14*24*time.Hour {
+		t.Errorf("2w: %v %v", age, err)
+	}
+}
+
+func TestSnapshotPrune(t *testing.T) {
+	instance := newTestInstance(t, "a")
+	instance.Config.Retention = &Retention{Daily: 1}
+	host := &RecordingRunner{Output: map[string][]string{
+		"zfs list -H -p -t snapshot -o name,used,creation,clones -d 1 z/test/a": {
+			"z/test/a@20230101120000\t0\t1672574400\t-",
+			"z/test/a@20230102120000\t0\t1672660800\tz/test/b",
+			"z/test/a@20230103120000\t0\t1672747200\t-",
+		},
+	}}
+	prune := &SnapshotPrune{Host: host}
+	err := prune.Prune(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands, "sudo zfs destroy z/test/a@20230101120000")
+
+	host.Commands = nil
+	prune.Recursive = true
+	err = prune.Prune(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"sudo zfs destroy -R z/test/a@20230101120000",
+		"sudo zfs destroy -R z/test/a@20230102120000",
+	)
+}
+
+func TestSnapshotPruneNested(t *testing.T) {
+	instance := newTestInstance(t, "a")
+	instance.Config.Filesystems["var"] = &Filesystem{Pattern: "z/test/(instance)/var"}
+	instance, err := NewInstance(nil, instance.Config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Config.Retention = &Retention{Daily: 1}
+	host := &RecordingRunner{Output: map[string][]string{}}
+	for _, fs := range []string{"z/test/a", "z/test/a/var"} {
+		host.Output["zfs list -H -p -t snapshot -o name,used,creation,clones -d 1 "+fs] = []string{
+			fs + "@20230101120000\t0\t1672574400\t-",
+			fs + "@20230102120000\t0\t1672660800\t-",
+		}
+	}
+	prune := &SnapshotPrune{Host: host, Recursive: true}
+	err = prune.Prune(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// zfs destroy -R z/test/a@s also destroys z/test/a/var@s
+	verifyCommands(t, host.Commands, "sudo zfs destroy -R z/test/a@20230101120000")
+
+	host.Commands = nil
+	prune.Recursive = false
+	err = prune.Prune(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands,
+		"sudo zfs destroy z/test/a@20230101120000",
+		"sudo zfs destroy z/test/a/var@20230101120000",
+	)
+}
@@ -2,8 +2,14 @@ package lxdops
 
 import (
 	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
 
-	"melato.org/script"
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
 )
 
 type Rollback struct {
@@ -11,6 +17,12 @@ type Rollback struct {
 	DryRun    bool   `name:"dry-run" usage:"show the commands to run, but do not change anything"`
 	Snapshot  string `name:"s" usage:"short snapshot name"`
 	Container bool   `name:"c" usage:"also restore container snapshot"`
+	Stop      bool   `name:"stop" usage:"stop the container before the rollback, if it is running, and start it afterwards"`
+	Safety    bool   `name:"safety" usage:"take a safety snapshot before the rollback, so that the rollback can be undone"`
+	// Host runs host commands.  If nil, a ScriptRunner is used.
+	Host HostRunner `name:"-"`
+	// Client is used for the container and for volume filesystems
+	Client *lxdutil.LxdClient `name:"-"`
 }
 
 func (t *Rollback) Init() error {
@@ -24,17 +36,189 @@ func (t *Rollback) Configured() error {
 	return t.ConfigOptions.Configured()
 }
 
-func (t *Rollback) Run(instance *Instance) error {
-	err := instance.Rollback(t.Snapshot)
+func (t *Rollback) host() HostRunner {
+	if t.Host == nil {
+		return &ScriptRunner{Trace: true, DryRun: t.DryRun}
+	}
+	return t.Host
+}
+
+// volumeOps returns a VolumeOps, or nil if the instance has no volumes
+func (t *Rollback) volumeOps(instance *Instance) (*VolumeOps, error) {
+	volumes, err := instance.VolumeList()
+	if err != nil || len(volumes) == 0 {
+		return nil, err
+	}
+	ops, err := NewVolumeOps(t.Client, instance.Config.Project)
+	if err != nil {
+		return nil, err
+	}
+	ops.Trace = true
+	ops.DryRun = t.DryRun
+	return ops, nil
+}
+
+// Check verifies that the snapshot exists in every non-transient filesystem of the instance,
+// and in the container, if -c was specified.
+// It returns the zfs snapshots that are newer than the snapshot, which zfs rollback -r will destroy.
+func (t *Rollback) Check(instance *Instance, server lxd.InstanceServer) ([]string, error) {
+	finder := &SnapshotFinder{Host: t.host(), Client: t.Client}
+	snapshots, err := finder.FilesystemSnapshots(instance)
+	if err != nil {
+		return nil, err
+	}
+	filesystems, err := instance.SnapshotFilesystems()
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	var destroyed []string
+	for _, fs := range filesystems {
+		found := false
+		for _, s := range snapshots[fs.Id] {
+			if found && fs.IsZfs() {
+				// zfs lists snapshots in creation order
+				destroyed = append(destroyed, fs.SnapshotPath(s.Name))
+			}
+			if s.Name == t.Snapshot {
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, fs.Id)
+		}
+	}
+	if t.Container {
+		_, _, err := server.GetInstanceSnapshot(instance.Container(), t.Snapshot)
+		if err != nil {
+			missing = append(missing, ContainerSnapshotId)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("snapshot %s is missing from: %s", t.Snapshot, strings.Join(missing, ", "))
+	}
+	return destroyed, nil
+}
+
+func (t *Rollback) isRunning(server lxd.InstanceServer, container string) bool {
+	state, _, err := server.GetInstanceState(container)
+	return err == nil && state.StatusCode == api.Running
+}
+
+// safetySnapshot snapshots the instance, before the rollback.
+// Since zfs rollback -r destroys snapshots that are newer than the rollback snapshot,
+// including the safety snapshot, the safety snapshot of each zfs filesystem is also copied to a new filesystem,
+// with zfs send/receive.  The copy of <root>/<path> is <root>-<safety>/<path>,
+// where <root> is the top filesystem of <path>, among the non-transient zfs filesystems of the instance.
+func (t *Rollback) safetySnapshot(instance *Instance) (string, error) {
+	safety := "rollback-" + time.Now().UTC().Format(SnapshotTimeFormat)
+	fmt.Printf("safety snapshot: %s\n", safety)
+	set := &SnapshotSet{Host: t.host(), Volumes: t.volumeOps, Container: t.Container}
+	err := set.Create(safety, instance)
+	if err != nil {
+		return "", err
+	}
+	filesystems, err := instance.SnapshotFilesystems()
+	if err != nil {
+		return "", err
+	}
+	var zfsFilesystems []*InstanceFS
+	for _, fs := range filesystems {
+		if fs.IsZfs() {
+			zfsFilesystems = append(zfsFilesystems, fs)
+		}
+	}
+	roots := InstanceFSList(zfsFilesystems).Roots()
+	for _, fs := range zfsFilesystems {
+		var copyPath string
+		for _, root := range roots {
+			if Path(fs.Path).IsDescendantOf(root.Path) {
+				copyPath = root.Path + "-" + safety + fs.Path[len(root.Path):]
+				break
+			}
+		}
+		send := exec.Command("sudo", "zfs", "send", fs.SnapshotPath(safety))
+		receive := exec.Command("sudo", "zfs", "receive", "-u", copyPath)
+		err := t.host().RunCmd(send, receive)
+		if err != nil {
+			return "", err
+		}
+	}
+	return safety, nil
+}
+
+func (t *Rollback) rollback(instance *Instance) error {
+	err := instance.Rollback(t.host(), t.Snapshot)
+	if err != nil {
+		return err
+	}
+	volumes, err := t.volumeOps(instance)
 	if err != nil {
 		return err
 	}
+	if volumes != nil {
+		err = volumes.RestoreInstance(instance, t.Snapshot)
+		if err != nil {
+			return err
+		}
+	}
 	if t.Container {
-		s := &script.Script{Trace: true}
-		s.Run("lxc", "restore", instance.Container(), t.Snapshot)
-		if s.HasError() {
-			return s.Error()
+		err := t.host().Run("lxc", "restore", instance.Container(), t.Snapshot)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+func (t *Rollback) Run(instance *Instance) error {
+	if t.Client == nil {
+		return errors.New("missing LXD client")
+	}
+	server, err := t.Client.ProjectServer(instance.Config.Project)
+	if err != nil {
+		return err
+	}
+	destroyed, err := t.Check(instance, server)
+	if err != nil {
+		return err
+	}
+	if len(destroyed) > 0 {
+		fmt.Println("zfs rollback -r will destroy these snapshots:")
+		for _, snapshot := range destroyed {
+			fmt.Printf("  %s\n", snapshot)
+		}
+	}
+	container := instance.Container()
+	running := t.isRunning(server, container)
+	if running && !t.Stop {
+		return fmt.Errorf("container %s is running.  Stop it, or use --stop", container)
+	}
+	if t.Safety {
+		safety, err := t.safetySnapshot(instance)
+		if err != nil {
+			return err
+		}
+		defer fmt.Printf("to undo the rollback, use safety snapshot %s\n", safety)
+	}
+	if running {
+		fmt.Printf("stop %s\n", container)
+		if !t.DryRun {
+			err := (lxdutil.InstanceServer{Server: server}).StopContainer(container)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = t.rollback(instance)
+	if running {
+		fmt.Printf("start %s\n", container)
+		if !t.DryRun {
+			startErr := (lxdutil.InstanceServer{Server: server}).StartContainer(container)
+			if err == nil {
+				err = startErr
+			}
+		}
+	}
+	return err
+}
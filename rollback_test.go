@@ -0,0 +1,91 @@
+package lxdops
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/util"
+)
+
+func newRollbackTest(t *testing.T) (*launcherTest, *Instance, *RecordingRunner) {
+	x := newLauncherTest()
+	x.Server.AddInstance("a", api.InstancePut{})
+	instance := newTestInstance(t, "a")
+	host := &RecordingRunner{Output: map[string][]string{
+		"zfs list -H -p -t snapshot -o name,used,creation,clones -d 1 z/test/a": {
+			"z/test/a@s1\t0\t1690000000\t-",
+			"z/test/a@s2\t0\t1690000100\t-",
+		},
+	}}
+	return x, instance, host
+}
+
+func TestRollbackCheck(t *testing.T) {
+	x, instance, host := newRollbackTest(t)
+	rollback := &Rollback{Host: host, Client: x.Launcher.Client, Snapshot: "s1"}
+	destroyed, err := rollback.Check(instance, x.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !util.StringSlice(destroyed).Equals([]string{"z/test/a@s2"}) {
+		t.Errorf("destroyed: %v", destroyed)
+	}
+
+	rollback.Snapshot = "s3"
+	err = rollback.Run(instance)
+	if err == nil || !strings.Contains(err.Error(), "root") {
+		t.Errorf("missing snapshot: %v", err)
+	}
+
+	rollback.Snapshot = "s1"
+	rollback.Container = true
+	_, err = rollback.Check(instance, x.Server)
+	if err == nil || !strings.Contains(err.Error(), ContainerSnapshotId) {
+		t.Errorf("missing container snapshot: %v", err)
+	}
+	verifyCommands(t, host.Commands)
+}
+
+func TestRollbackRunning(t *testing.T) {
+	x, instance, host := newRollbackTest(t)
+	x.Server.UpdateInstanceState("a", api.InstanceStatePut{Action: "start"}, "")
+	rollback := &Rollback{Host: host, Client: x.Launcher.Client, Snapshot: "s1"}
+	err := rollback.Run(instance)
+	if err == nil {
+		t.Fatalf("rolled back running container")
+	}
+	verifyCommands(t, host.Commands)
+
+	rollback.Stop = true
+	err = rollback.Run(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands, "sudo zfs rollback -r z/test/a@s1")
+	state, _, _ := x.Server.GetInstanceState("a")
+	if state.StatusCode != api.Running {
+		t.Errorf("container was not restarted: %s", state.Status)
+	}
+}
+
+func TestRollbackSafety(t *testing.T) {
+	x, instance, host := newRollbackTest(t)
+	rollback := &Rollback{Host: host, Client: x.Launcher.Client, Snapshot: "s1", Safety: true}
+	err := rollback.Run(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(host.Commands) != 3 {
+		t.Fatalf("commands: %v", host.Commands)
+	}
+	snapshot := strings.TrimPrefix(host.Commands[0], "sudo zfs snapshot z/test/a@")
+	if !strings.HasPrefix(snapshot, "rollback-") {
+		t.Fatalf("safety snapshot: %s", host.Commands[0])
+	}
+	verifyCommands(t, host.Commands,
+		"sudo zfs snapshot z/test/a@"+snapshot,
+		"sudo zfs send z/test/a@"+snapshot+" | sudo zfs receive -u z/test/a-"+snapshot,
+		"sudo zfs rollback -r z/test/a@s1",
+	)
+}
@@ -4,7 +4,7 @@ import (
 	"errors"
 	"time"
 
-	"melato.org/script"
+	"melato.org/lxdops/lxdutil"
 )
 
 type SnapshotParams struct {
@@ -13,15 +13,21 @@ type SnapshotParams struct {
 	Container bool   `name:"c" usage:"also create container snapshot"`
 	Destroy   bool   `name:"d" usage:"destroy snapshots"`
 	Recursive bool   `name:"R" usage:"zfs destroy -R: Recursively destroy all dependents, including cloned datasets"`
+	Together  bool   `name:"together" usage:"snapshot all instances together, with one zfs snapshot command per pool"`
 }
 
 type Snapshot struct {
 	ConfigOptions
+	JobOptions
 	SnapshotParams
+	// Host runs host commands.  If nil, a ScriptRunner is used.
+	Host HostRunner `name:"-"`
+	// Client is used for volume filesystems
+	Client *lxdutil.LxdClient `name:"-"`
 }
 
 func (t *Snapshot) Init() error {
-	t.SnapshotParams.Snapshot = time.Now().UTC().Format("20060102150405")
+	t.SnapshotParams.Snapshot = time.Now().UTC().Format(SnapshotTimeFormat)
 	return t.ConfigOptions.Init()
 }
 
@@ -32,39 +38,125 @@ func (t *Snapshot) Configured() error {
 	if t.Recursive && !t.Destroy {
 		return errors.New("cannot use -R without -d")
 	}
+	if t.Together && t.Destroy {
+		return errors.New("cannot use -together with -d")
+	}
+	if t.Together && t.Jobs > 1 {
+		return errors.New("cannot use -together with -j")
+	}
+	// all the jobs should use the same snapshot name
+	t.jobArgs = []string{"-s", t.SnapshotParams.Snapshot}
 	return t.ConfigOptions.Configured()
 }
 
+func (t *Snapshot) host() HostRunner {
+	if t.Host == nil {
+		return &ScriptRunner{Trace: true, DryRun: t.DryRun}
+	}
+	return t.Host
+}
+
+// volumeOps returns a VolumeOps, or nil if the instance has no volumes
+func (t *Snapshot) volumeOps(instance *Instance) (*VolumeOps, error) {
+	volumes, err := instance.VolumeList()
+	if err != nil || len(volumes) == 0 {
+		return nil, err
+	}
+	ops, err := NewVolumeOps(t.Client, instance.Config.Project)
+	if err != nil {
+		return nil, err
+	}
+	ops.Trace = true
+	ops.DryRun = t.DryRun
+	return ops, nil
+}
+
 func (t *Snapshot) DestroySnapshot(instance *Instance) error {
-	filesystems, err := instance.FilesystemList()
+	volumes, err := t.volumeOps(instance)
 	if err != nil {
 		return err
 	}
-	s := &script.Script{Trace: true}
-	if t.Recursive {
-		roots := InstanceFSList(filesystems).Roots()
-		for _, fs := range roots {
-			s.Run("sudo", "zfs", "destroy", "-R", fs.Path+"@"+t.Snapshot)
+	list, err := instance.FilesystemList()
+	if err != nil {
+		return err
+	}
+	var filesystems []*InstanceFS
+	for _, fs := range list {
+		if !fs.IsVolume() {
+			filesystems = append(filesystems, fs)
+		} else if !fs.Filesystem.Transient {
+			err := volumes.DeleteSnapshot(fs, t.Snapshot)
+			if err != nil {
+				return err
+			}
 		}
-	} else {
-		for _, fs := range filesystems {
-			s.Run("sudo", "zfs", "destroy", fs.Path+"@"+t.Snapshot)
+	}
+	for _, fs := range t.destroyList(filesystems) {
+		err := t.destroyHostSnapshot(fs, t.Snapshot)
+		if err != nil {
+			return err
 		}
 	}
-	return s.Error()
+	return nil
+}
+
+// destroyList returns the filesystems whose snapshots should be destroyed, in order to destroy a snapshot of filesystems.
+// With -R, zfs destroy -R also destroys the snapshots of descendant filesystems, so only the roots of the zfs filesystems are listed.
+// btrfs snapshots are per subvolume, so every btrfs subvolume is listed.
+func (t *Snapshot) destroyList(filesystems []*InstanceFS) []*InstanceFS {
+	var zfs []*InstanceFS
+	for _, fs := range filesystems {
+		if fs.IsZfs() {
+			zfs = append(zfs, fs)
+		}
+	}
+	roots := make(map[*InstanceFS]bool)
+	for _, fs := range InstanceFSList(zfs).Roots() {
+		roots[fs] = true
+	}
+	var list []*InstanceFS
+	for _, fs := range filesystems {
+		if fs.IsZfs() && t.Recursive && !roots[fs] {
+			continue
+		}
+		list = append(list, fs)
+	}
+	return list
+}
+
+// destroyHostSnapshot destroys a snapshot of a zfs filesystem or btrfs subvolume
+func (t *Snapshot) destroyHostSnapshot(fs *InstanceFS, snapshot string) error {
+	if fs.IsBtrfs() {
+		// btrfs snapshots do not have dependents
+		return t.host().Run("sudo", "btrfs", "subvolume", "delete", fs.SnapshotPath(snapshot))
+	} else if t.Recursive {
+		return t.host().Run("sudo", "zfs", "destroy", "-R", fs.SnapshotPath(snapshot))
+	} else {
+		return t.host().Run("sudo", "zfs", "destroy", fs.SnapshotPath(snapshot))
+	}
+}
+
+func (t *Snapshot) snapshotSet() *SnapshotSet {
+	return &SnapshotSet{Host: t.host(), Volumes: t.volumeOps, Container: t.Container}
 }
 
 func (t *Snapshot) Run(instance *Instance) error {
 	if t.Destroy {
 		return t.DestroySnapshot(instance)
 	} else {
-		if t.Container {
-			s := &script.Script{Trace: true}
-			s.Run("lxc", "snapshot", instance.Container(), t.Snapshot)
-			if s.HasError() {
-				return s.Error()
-			}
-		}
-		return instance.Snapshot(t.Snapshot)
+		return t.snapshotSet().Create(t.Snapshot, instance)
+	}
+}
+
+// RunConfigs runs the snapshot command for the instances of the given config files.
+// With -together, it creates the snapshots of all the instances together.
+func (t *Snapshot) RunConfigs(configs []string) error {
+	if !t.Together {
+		return t.RunInstances(t.Run, false, configs...)
+	}
+	instances, err := t.InstanceList(false, configs...)
+	if err != nil {
+		return err
 	}
+	return t.snapshotSet().Create(t.Snapshot, instances...)
 }
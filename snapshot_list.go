@@ -0,0 +1,324 @@
+package lxdops
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"melato.org/lxdops/lxdutil"
+	"melato.org/lxdops/util"
+	"melato.org/table3"
+)
+
+// ContainerSnapshotId is the id that is used for container snapshots, in place of a filesystem id
+const ContainerSnapshotId = "(container)"
+
+// FSSnapshot is a snapshot of an instance filesystem, or of an instance container
+type FSSnapshot struct {
+	// Name is the short snapshot name
+	Name string
+	// Size is the space used by the snapshot, in bytes, or -1 if it is not known
+	Size    int64
+	Created time.Time
+	// Clones are the zfs filesystems that are cloned from the snapshot
+	Clones []string
+}
+
+// SnapshotFinder finds the snapshots of instance filesystems and containers
+type SnapshotFinder struct {
+	Host   HostRunner
+	Client *lxdutil.LxdClient
+}
+
+// SnapshotFilesystems returns the non-transient filesystems of the instance that support snapshots.
+func (instance *Instance) SnapshotFilesystems() ([]*InstanceFS, error) {
+	filesystems, err := instance.FilesystemList()
+	if err != nil {
+		return nil, err
+	}
+	var result []*InstanceFS
+	for _, fs := range filesystems {
+		if fs.IsSnapshotable() && !fs.Filesystem.Transient {
+			result = append(result, fs)
+		}
+	}
+	return result, nil
+}
+
+// FilesystemSnapshots returns the snapshots of the non-transient filesystems of an instance, by filesystem id.
+// Filesystems that do not exist have no snapshots.
+func (t *SnapshotFinder) FilesystemSnapshots(instance *Instance) (map[string][]*FSSnapshot, error) {
+	filesystems, err := instance.SnapshotFilesystems()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]*FSSnapshot)
+	var volumes *VolumeOps
+	for _, fs := range filesystems {
+		var snapshots []*FSSnapshot
+		var err error
+		if fs.IsZfs() {
+			snapshots, err = t.zfsSnapshots(fs)
+		} else if fs.IsBtrfs() {
+			snapshots, err = t.btrfsSnapshots(fs)
+		} else if fs.IsVolume() {
+			if volumes == nil {
+				volumes, err = NewVolumeOps(t.Client, instance.Config.Project)
+				if err != nil {
+					return nil, err
+				}
+			}
+			snapshots, err = t.volumeSnapshots(volumes, fs)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[fs.Id] = snapshots
+	}
+	return result, nil
+}
+
+// zfsExists returns true if a zfs filesystem exists.
+// It returns an error only if zfs cannot run.
+func (t *SnapshotFinder) zfsExists(path string) (bool, error) {
+	_, err := t.Host.Lines("zfs", "list", "-H", "-o", "name", path)
+	var exitError *exec.ExitError
+	if err != nil && !errors.As(err, &exitError) {
+		return false, err
+	}
+	return err == nil, nil
+}
+
+// zfsSnapshots returns the snapshots of a zfs filesystem.
+// A filesystem that does not exist has no snapshots.
+func (t *SnapshotFinder) zfsSnapshots(fs *InstanceFS) ([]*FSSnapshot, error) {
+	lines, err := t.Host.Lines("zfs", "list", "-H", "-p", "-t", "snapshot", "-o", "name,used,creation,clones", "-d", "1", fs.Path)
+	if err != nil {
+		exists, err2 := t.zfsExists(fs.Path)
+		if err2 != nil {
+			return nil, fmt.Errorf("%s: %w", fs.Path, err2)
+		}
+		if exists {
+			return nil, fmt.Errorf("%s: %w", fs.Path, err)
+		}
+		return nil, nil
+	}
+	var snapshots []*FSSnapshot
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			continue
+		}
+		path, name, found := strings.Cut(fields[0], "@")
+		if !found || path != fs.Path {
+			continue
+		}
+		snapshot := &FSSnapshot{Name: name, Size: -1}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil {
+			snapshot.Size = size
+		}
+		created, err := strconv.ParseInt(fields[2], 10, 64)
+		if err == nil {
+			snapshot.Created = time.Unix(created, 0)
+		}
+		if fields[3] != "" && fields[3] != "-" {
+			snapshot.Clones = strings.Split(fields[3], ",")
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+func (t *SnapshotFinder) btrfsSnapshots(fs *InstanceFS) ([]*FSSnapshot, error) {
+	paths, err := filepath.Glob(fs.SnapshotPath("*"))
+	if err != nil {
+		return nil, err
+	}
+	prefix := fs.SnapshotPath("")
+	var snapshots []*FSSnapshot
+	for _, path := range paths {
+		snapshot := &FSSnapshot{Name: path[len(prefix):], Size: -1}
+		lines, _ := t.Host.Lines("sudo", "btrfs", "subvolume", "show", path)
+		for _, line := range lines {
+			key, value, _ := strings.Cut(strings.TrimSpace(line), ":")
+			if key == "Creation time" {
+				created, err := time.Parse("2006-01-02 15:04:05 -0700", strings.TrimSpace(value))
+				if err == nil {
+					snapshot.Created = created
+				}
+			}
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+func (t *SnapshotFinder) volumeSnapshots(volumes *VolumeOps, fs *InstanceFS) ([]*FSSnapshot, error) {
+	exists, err := volumes.Exists(fs)
+	if err != nil || !exists {
+		return nil, err
+	}
+	list, err := volumes.Server.GetStoragePoolVolumeSnapshots(fs.Pool, customVolume, fs.Path)
+	if err != nil {
+		return nil, lxdutil.AnnotateLXDError(fs.VolumeName(), err)
+	}
+	snapshots := make([]*FSSnapshot, len(list))
+	for i, s := range list {
+		// the API may return the full name: <volume>/<snapshot>
+		name := s.Name[strings.LastIndex(s.Name, "/")+1:]
+		snapshots[i] = &FSSnapshot{Name: name, Size: -1, Created: s.CreatedAt}
+	}
+	return snapshots, nil
+}
+
+// ContainerSnapshots returns the LXD snapshots of the instance container.
+func (t *SnapshotFinder) ContainerSnapshots(instance *Instance) ([]*FSSnapshot, error) {
+	server, err := t.Client.ProjectServer(instance.Config.Project)
+	if err != nil {
+		return nil, err
+	}
+	list, err := server.GetInstanceSnapshots(instance.Container())
+	if err != nil {
+		return nil, lxdutil.AnnotateLXDError(instance.Container(), err)
+	}
+	snapshots := make([]*FSSnapshot, len(list))
+	for i, s := range list {
+		name := s.Name[strings.LastIndex(s.Name, "/")+1:]
+		snapshots[i] = &FSSnapshot{Name: name, Size: s.Size, Created: s.CreatedAt}
+	}
+	return snapshots, nil
+}
+
+// SnapshotSummary describes a snapshot across the filesystems of an instance
+type SnapshotSummary struct {
+	Name string
+	// Created is the earliest creation time of the snapshot
+	Created time.Time
+	// Size is the total known size of the snapshot, or -1 if no sizes are known
+	Size int64
+	// Present are the ids of the filesystems that have the snapshot
+	Present []string
+	// Missing are the ids of the filesystems that do not have the snapshot
+	Missing []string
+	// Clones are the zfs filesystems that are cloned from the snapshot
+	Clones []string
+}
+
+// SummarizeSnapshots combines the snapshots of several filesystems into one summary per snapshot name,
+// sorted by creation time.
+func SummarizeSnapshots(snapshots map[string][]*FSSnapshot) []*SnapshotSummary {
+	ids := util.MapKeys(snapshots)
+	summaries := make(map[string]*SnapshotSummary)
+	for _, id := range ids {
+		for _, s := range snapshots[id] {
+			summary, exists := summaries[s.Name]
+			if !exists {
+				summary = &SnapshotSummary{Name: s.Name, Created: s.Created, Size: -1}
+				summaries[s.Name] = summary
+			}
+			if !s.Created.IsZero() && (summary.Created.IsZero() || s.Created.Before(summary.Created)) {
+				summary.Created = s.Created
+			}
+			if s.Size >= 0 {
+				if summary.Size < 0 {
+					summary.Size = 0
+				}
+				summary.Size += s.Size
+			}
+			summary.Present = append(summary.Present, id)
+			summary.Clones = append(summary.Clones, s.Clones...)
+		}
+	}
+	var list []*SnapshotSummary
+	for _, summary := range summaries {
+		summary.Missing = util.StringSlice(ids).Diff(summary.Present)
+		list = append(list, summary)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.Before(list[j].Created)
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// SnapshotList lists the snapshots of instances
+type SnapshotList struct {
+	ConfigOptions
+	Container bool `name:"c" usage:"also list container snapshots"`
+	// Host runs host commands.  If nil, a ScriptRunner is used.
+	Host   HostRunner         `name:"-"`
+	Client *lxdutil.LxdClient `name:"-"`
+}
+
+func (t *SnapshotList) Init() error {
+	return t.ConfigOptions.Init()
+}
+
+func (t *SnapshotList) Configured() error {
+	return t.ConfigOptions.Configured()
+}
+
+func (t *SnapshotList) host() HostRunner {
+	if t.Host == nil {
+		return &ScriptRunner{}
+	}
+	return t.Host
+}
+
+func (t *SnapshotList) Summaries(instance *Instance) ([]*SnapshotSummary, error) {
+	finder := &SnapshotFinder{Host: t.host(), Client: t.Client}
+	snapshots, err := finder.FilesystemSnapshots(instance)
+	if err != nil {
+		return nil, err
+	}
+	if t.Container {
+		snapshots[ContainerSnapshotId], err = finder.ContainerSnapshots(instance)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return SummarizeSnapshots(snapshots), nil
+}
+
+func (t *SnapshotList) List(instance *Instance) error {
+	summaries, err := t.Summaries(instance)
+	if err != nil {
+		return err
+	}
+	writer := &table.FixedWriter{Writer: os.Stdout}
+	var s *SnapshotSummary
+	writer.Columns(
+		table.NewColumn("INSTANCE", func() interface{} { return instance.Name }),
+		table.NewColumn("SNAPSHOT", func() interface{} { return s.Name }),
+		table.NewColumn("CREATED", func() interface{} {
+			if s.Created.IsZero() {
+				return "-"
+			}
+			return s.Created.Local().Format("2006-01-02 15:04:05")
+		}),
+		table.NewColumn("SIZE", func() interface{} {
+			if s.Size < 0 {
+				return "-"
+			}
+			return util.FormatSize(s.Size)
+		}),
+		table.NewColumn("FILESYSTEMS", func() interface{} {
+			return fmt.Sprintf("%d/%d", len(s.Present), len(s.Present)+len(s.Missing))
+		}),
+		table.NewColumn("MISSING", func() interface{} { return strings.Join(s.Missing, ",") }),
+	)
+	for _, s = range summaries {
+		writer.WriteRow()
+	}
+	writer.End()
+	return nil
+}
@@ -0,0 +1,99 @@
+package lxdops
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/util"
+)
+
+func TestSummarizeSnapshots(t *testing.T) {
+	t1 := time.Unix(1000, 0)
+	t2 := time.Unix(2000, 0)
+	summaries := SummarizeSnapshots(map[string][]*FSSnapshot{
+		"a": {{Name: "s1", Size: 10, Created: t1}, {Name: "s2", Size: 5, Created: t2}},
+		"b": {{Name: "s1", Size: -1, Created: t1.Add(time.Second)}},
+		"c": nil,
+	})
+	if len(summaries) != 2 {
+		t.Fatalf("summaries: %d", len(summaries))
+	}
+	s1, s2 := summaries[0], summaries[1]
+	if s1.Name != "s1" || !s1.Created.Equal(t1) || s1.Size != 10 {
+		t.Errorf("s1: %v", s1)
+	}
+	if !util.StringSlice(s1.Present).Equals([]string{"a", "b"}) || !util.StringSlice(s1.Missing).Equals([]string{"c"}) {
+		t.Errorf("s1 present: %v missing: %v", s1.Present, s1.Missing)
+	}
+	if s2.Name != "s2" || !util.StringSlice(s2.Missing).Equals([]string{"b", "c"}) {
+		t.Errorf("s2: %v", s2)
+	}
+}
+
+func TestSnapshotList(t *testing.T) {
+	x := newLauncherTest()
+	x.Server.AddInstance("a", api.InstancePut{})
+	x.Server.CreateInstanceSnapshot("a", api.InstanceSnapshotsPost{Name: "s1"})
+	x.Server.AddVolume("p", "a-data", api.StorageVolumePut{}).Snapshots["s2"] = &api.StorageVolumeSnapshot{Name: "s2"}
+	instance, err := NewInstance(nil, newVolumeConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &RecordingRunner{Output: map[string][]string{
+		"zfs list -H -p -t snapshot -o name,used,creation,clones -d 1 z/test/a": {
+			"z/test/a@s1\t1024\t1690000000\t-",
+			"z/test/a@s2\t2048\t1690000100\tz/test/b",
+		},
+	}}
+	list := &SnapshotList{Host: host, Client: x.Launcher.Client, Container: true}
+	summaries, err := list.Summaries(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("summaries: %d", len(summaries))
+	}
+	for _, s := range summaries {
+		switch s.Name {
+		case "s1":
+			if !util.StringSlice(s.Missing).Equals([]string{"data"}) || s.Size != 1024 {
+				t.Errorf("s1: %v", s)
+			}
+		case "s2":
+			if !util.StringSlice(s.Missing).Equals([]string{ContainerSnapshotId}) {
+				t.Errorf("s2: %v", s)
+			}
+		default:
+			t.Errorf("unexpected snapshot: %s", s.Name)
+		}
+	}
+}
+
+func TestZfsSnapshotsError(t *testing.T) {
+	instance := newTestInstance(t, "a")
+	query := "zfs list -H -p -t snapshot -o name,used,creation,clones -d 1 z/test/a"
+	exists := "zfs list -H -o name z/test/a"
+	finder := &SnapshotFinder{}
+	for _, c := range []struct {
+		Errors map[string]error
+		Fail   bool
+	}{
+		// the filesystem does not exist
+		{map[string]error{query: &exec.ExitError{}, exists: &exec.ExitError{}}, false},
+		// the filesystem exists, so the query error is not about a missing filesystem
+		{map[string]error{query: &exec.ExitError{}}, true},
+		// zfs cannot run
+		{map[string]error{query: exec.ErrNotFound, exists: exec.ErrNotFound}, true},
+	} {
+		finder.Host = &RecordingRunner{Errors: c.Errors}
+		snapshots, err := finder.FilesystemSnapshots(instance)
+		if c.Fail != (err != nil) {
+			t.Errorf("%v: %v", c.Errors, err)
+		}
+		if err == nil && len(snapshots["root"]) != 0 {
+			t.Errorf("snapshots: %v", snapshots)
+		}
+	}
+}
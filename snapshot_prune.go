@@ -0,0 +1,114 @@
+package lxdops
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"melato.org/lxdops/lxdutil"
+)
+
+// SnapshotPrune destroys the timestamped snapshots of instances that their retention policy does not keep
+type SnapshotPrune struct {
+	ConfigOptions
+	DryRun    bool `name:"dry-run" usage:"show the snapshots to destroy, but do not destroy them"`
+	Container bool `name:"c" usage:"also prune container snapshots"`
+	Recursive bool `name:"R" usage:"zfs destroy -R: also destroy the clones of pruned snapshots.  Without -R, snapshots that have clones are kept"`
+	// Host runs host commands.  If nil, a ScriptRunner is used.
+	Host   HostRunner         `name:"-"`
+	Client *lxdutil.LxdClient `name:"-"`
+	// Now is the time that max-age is computed from.  If it is zero, the current time is used.
+	Now time.Time `name:"-"`
+}
+
+func (t *SnapshotPrune) Init() error {
+	return t.ConfigOptions.Init()
+}
+
+func (t *SnapshotPrune) Configured() error {
+	return t.ConfigOptions.Configured()
+}
+
+func (t *SnapshotPrune) deleteContainerSnapshot(instance *Instance, snapshot string) error {
+	container := instance.Container()
+	fmt.Printf("delete container snapshot %s/%s\n", container, snapshot)
+	if t.DryRun {
+		return nil
+	}
+	server, err := t.Client.ProjectServer(instance.Config.Project)
+	if err != nil {
+		return err
+	}
+	op, err := server.DeleteInstanceSnapshot(container, snapshot)
+	if err == nil {
+		err = op.Wait()
+	}
+	return lxdutil.AnnotateLXDError(container+"/"+snapshot, err)
+}
+
+func (t *SnapshotPrune) Prune(instance *Instance) error {
+	retention := instance.Config.Retention
+	if retention == nil {
+		fmt.Printf("skipping %s: no retention policy\n", instance.Name)
+		return nil
+	}
+	list := &SnapshotList{Container: t.Container, Host: t.Host, Client: t.Client}
+	summaries, err := list.Summaries(instance)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]*SnapshotSummary)
+	var names []string
+	for _, s := range summaries {
+		byName[s.Name] = s
+		names = append(names, s.Name)
+	}
+	now := t.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	prune, err := retention.Prune(names, now)
+	if err != nil {
+		return err
+	}
+	snapshot := &Snapshot{Host: t.Host, Client: t.Client}
+	snapshot.DryRun = t.DryRun
+	snapshot.Recursive = t.Recursive
+	volumes, err := snapshot.volumeOps(instance)
+	if err != nil {
+		return err
+	}
+	filesystems, err := instance.Filesystems()
+	if err != nil {
+		return err
+	}
+	for _, name := range prune {
+		summary := byName[name]
+		if len(summary.Clones) > 0 && !t.Recursive {
+			fmt.Printf("skipping %s@%s: it has clones: %s\n", instance.Name, name, strings.Join(summary.Clones, ","))
+			continue
+		}
+		var hostFilesystems []*InstanceFS
+		for _, id := range summary.Present {
+			var err error
+			if id == ContainerSnapshotId {
+				err = t.deleteContainerSnapshot(instance, name)
+			} else if fs := filesystems[id]; fs.IsVolume() {
+				err = volumes.DeleteSnapshot(fs, name)
+			} else {
+				hostFilesystems = append(hostFilesystems, fs)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// with -R, the snapshots of descendant zfs filesystems are destroyed with the snapshot of their root
+		for _, fs := range snapshot.destroyList(hostFilesystems) {
+			err := snapshot.destroyHostSnapshot(fs, name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
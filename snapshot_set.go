@@ -0,0 +1,143 @@
+package lxdops
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SnapshotSet creates the same snapshot of the filesystems of one or more instances.
+// The zfs filesystems of each pool are snapshotted atomically, with a single "zfs snapshot" command.
+// If any snapshot fails, SnapshotSet destroys the snapshots that it has already created,
+// so that it does not leave a partial set of snapshots behind.
+type SnapshotSet struct {
+	Host HostRunner
+	// Volumes returns a VolumeOps for the volumes of an instance, or nil if it has no volumes.
+	// If Volumes is nil, volumes are not snapshotted.
+	Volumes func(instance *Instance) (*VolumeOps, error)
+	// Container specifies that container snapshots are also created, with "lxc snapshot"
+	Container bool
+	undo      []func() error
+}
+
+// zfsPool returns the pool of a zfs filesystem
+func zfsPool(path string) string {
+	pool, _, _ := strings.Cut(path, "/")
+	return pool
+}
+
+// Create creates snapshot name of the non-transient filesystems of the instances.
+func (t *SnapshotSet) Create(name string, instances ...*Instance) error {
+	t.undo = nil
+	err := t.create(name, instances)
+	if err != nil {
+		t.rollback()
+	}
+	return err
+}
+
+func (t *SnapshotSet) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		err := t.undo[i]()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+	t.undo = nil
+}
+
+func (t *SnapshotSet) create(name string, instances []*Instance) error {
+	if t.Container {
+		for _, instance := range instances {
+			container := instance.Container()
+			err := t.Host.Run("lxc", "snapshot", container, name)
+			if err != nil {
+				return err
+			}
+			t.undo = append(t.undo, func() error {
+				return t.Host.Run("lxc", "delete", container+"/"+name)
+			})
+		}
+	}
+	pools := make(map[string][]string)
+	var btrfs []*InstanceFS
+	for _, instance := range instances {
+		filesystems, err := instance.FilesystemList()
+		if err != nil {
+			return err
+		}
+		for _, fs := range filesystems {
+			if fs.Filesystem.Transient {
+				continue
+			}
+			if fs.IsZfs() {
+				pool := zfsPool(fs.Path)
+				pools[pool] = append(pools[pool], fs.SnapshotPath(name))
+			} else if fs.IsBtrfs() {
+				btrfs = append(btrfs, fs)
+			}
+		}
+	}
+	poolNames := make([]string, 0, len(pools))
+	for pool := range pools {
+		poolNames = append(poolNames, pool)
+	}
+	sort.Strings(poolNames)
+	for _, pool := range poolNames {
+		snapshots := pools[pool]
+		err := t.Host.Run("sudo", append([]string{"zfs", "snapshot"}, snapshots...)...)
+		if err != nil {
+			return err
+		}
+		t.undo = append(t.undo, func() error {
+			for _, snapshot := range snapshots {
+				err := t.Host.Run("sudo", "zfs", "destroy", snapshot)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	for _, fs := range btrfs {
+		snapshot := fs.SnapshotPath(name)
+		err := t.Host.Run("sudo", "btrfs", "subvolume", "snapshot", "-r", fs.Path, snapshot)
+		if err != nil {
+			return err
+		}
+		t.undo = append(t.undo, func() error {
+			return t.Host.Run("sudo", "btrfs", "subvolume", "delete", snapshot)
+		})
+	}
+	if t.Volumes == nil {
+		return nil
+	}
+	for _, instance := range instances {
+		volumes, err := t.Volumes(instance)
+		if err != nil {
+			return err
+		}
+		if volumes == nil {
+			continue
+		}
+		list, err := instance.VolumeList()
+		if err != nil {
+			return err
+		}
+		for _, fs := range list {
+			if fs.Filesystem.Transient {
+				continue
+			}
+			err := volumes.Snapshot(fs, name)
+			if err != nil {
+				return err
+			}
+			fs := fs
+			t.undo = append(t.undo, func() error {
+				return volumes.DeleteSnapshot(fs, name)
+			})
+		}
+	}
+	return nil
+}
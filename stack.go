@@ -0,0 +1,165 @@
+package lxdops
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"melato.org/lxdops/util"
+	"melato.org/lxdops/yaml"
+)
+
+// StackComment is the first line of a stack file
+const StackComment = "#lxdops-stack"
+
+// stackInstanceEnv is the environment variable that selects one instance of a stack file,
+// in the lxdops process that runs one job of a parallel command.
+const stackInstanceEnv = "LXDOPS_STACK_INSTANCE"
+
+// Stack is a set of instances, that can be operated on as one unit, by passing the stack file
+// to a command instead of config files.
+// A stack file starts with the line #lxdops-stack
+type Stack struct {
+	Description string `yaml:"description,omitempty"`
+	// Project is the default project of the stack instances
+	Project string `yaml:"project,omitempty"`
+	// Properties are applied to all the stack instances.
+	// They override config properties.
+	Properties map[string]string `yaml:"properties,omitempty"`
+	Instances  []*StackInstance  `yaml:"instances"`
+}
+
+// StackInstance is an instance of a stack
+type StackInstance struct {
+	// Config is the config file of the instance.
+	// It is either absolute or relative to the directory of the stack file.
+	Config HostPath `yaml:"config"`
+	// Name is the instance name.  It defaults to the base name of the config file.
+	Name string `yaml:"name,omitempty"`
+	// Project overrides the project of the stack and the config.
+	Project string `yaml:"project,omitempty"`
+	// Properties override the properties of the stack and the config.
+	Properties map[string]string `yaml:"properties,omitempty"`
+}
+
+// IsStackFile returns true if the file is a stack file
+func IsStackFile(file string) bool {
+	data, err := os.ReadFile(file)
+	return err == nil && yaml.FirstLineIs(data, StackComment)
+}
+
+// ReadStack reads a stack file, resolves the config files, and sets the default instance names
+func ReadStack(file string) (*Stack, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !yaml.FirstLineIs(data, StackComment) {
+		return nil, fmt.Errorf("%s: first line should be: %s", file, StackComment)
+	}
+	var stack Stack
+	err = yaml.Unmarshal(data, &stack)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	dir := filepath.Dir(file)
+	names := make(util.Set[string])
+	for _, instance := range stack.Instances {
+		if instance.Config == "" {
+			return nil, fmt.Errorf("%s: missing instance config", file)
+		}
+		instance.Config = instance.Config.Resolve(dir)
+		if instance.Name == "" {
+			instance.Name = BaseName(string(instance.Config))
+		}
+		if names.Contains(instance.Name) {
+			return nil, fmt.Errorf("%s: duplicate instance: %s", file, instance.Name)
+		}
+		names.Put(instance.Name)
+	}
+	return &stack, nil
+}
+
+// update applies the project and properties of the stack and the instance to the instance config
+func (t *StackInstance) update(stack *Stack, config *Config) {
+	project := t.Project
+	if project == "" {
+		project = stack.Project
+	}
+	if project != "" {
+		config.Project = project
+	}
+	for _, properties := range []map[string]string{stack.Properties, t.Properties} {
+		for key, value := range properties {
+			if config.Properties == nil {
+				config.Properties = make(map[string]string)
+			}
+			config.Properties[key] = value
+		}
+	}
+}
+
+// instanceArg is an instance specified by a command line argument,
+// which is either a config file, or a stack file with one or more instances.
+type instanceArg struct {
+	// Arg is the command line argument
+	Arg string
+	// File is the config file
+	File string
+	// Label identifies the instance in messages.  It is the config file, or the instance name of a stack instance.
+	Label string
+	Stack *Stack
+	// Entry is the stack instance, or nil
+	Entry *StackInstance
+}
+
+// instanceArgs expands the stack files of the command line arguments to their instances
+func (t *ConfigOptions) instanceArgs(args []string) ([]*instanceArg, error) {
+	var list []*instanceArg
+	selected := os.Getenv(stackInstanceEnv)
+	for _, arg := range args {
+		if !IsStackFile(arg) {
+			list = append(list, &instanceArg{Arg: arg, File: arg, Label: arg})
+			continue
+		}
+		if t.Name != "" {
+			return nil, errors.New("--name cannot be used with a stack file")
+		}
+		stack, err := ReadStack(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range stack.Instances {
+			if selected != "" && entry.Name != selected {
+				continue
+			}
+			list = append(list, &instanceArg{Arg: arg, File: string(entry.Config), Label: entry.Name, Stack: stack, Entry: entry})
+		}
+	}
+	return list, nil
+}
+
+// argInstance creates the instance of a command line argument
+func (t *ConfigOptions) argInstance(arg *instanceArg, includeSource bool) (*Instance, error) {
+	if arg.Entry == nil {
+		instance, err := t.Instance2(arg.File, includeSource)
+		if err != nil {
+			return nil, err
+		}
+		instance.file = arg.File
+		return instance, nil
+	}
+	config, err := t.readConfig(arg.File, func(config *Config) {
+		arg.Entry.update(arg.Stack, config)
+	})
+	if err != nil {
+		return nil, err
+	}
+	instance, err := newInstance(t.GlobalProperties, config, arg.Entry.Name, includeSource)
+	if err != nil {
+		return nil, err
+	}
+	instance.file = arg.File
+	return instance, nil
+}
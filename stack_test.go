@@ -0,0 +1,96 @@
+package lxdops
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, file string, content string) {
+	t.Helper()
+	err := os.WriteFile(file, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStack(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "app.yaml"), `#lxdops
+depends-on: [db]
+properties:
+  size: small
+  color: red
+`)
+	writeTestFile(t, filepath.Join(dir, "db.yaml"), `#lxdops
+properties:
+  size: small
+`)
+	stackFile := filepath.Join(dir, "stack.yaml")
+	writeTestFile(t, stackFile, `#lxdops-stack
+project: p
+properties:
+  size: large
+instances:
+- config: app.yaml
+  name: app1
+  properties:
+    color: blue
+- config: db.yaml
+  project: q
+`)
+	options := &ConfigOptions{Properties: []string{"size=huge"}}
+	instances, err := options.InstanceList(false, stackFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("%d instances", len(instances))
+	}
+	app, db := instances[0], instances[1]
+	if app.Name != "app1" || db.Name != "db" {
+		t.Fatalf("names: %s %s", app.Name, db.Name)
+	}
+	if app.Config.Project != "p" || db.Config.Project != "q" {
+		t.Fatalf("projects: %s %s", app.Config.Project, db.Config.Project)
+	}
+	if app.Config.Properties["color"] != "blue" {
+		t.Fatalf("color: %s", app.Config.Properties["color"])
+	}
+	// command-line properties override stack properties
+	if app.Config.Properties["size"] != "huge" {
+		t.Fatalf("size: %s", app.Config.Properties["size"])
+	}
+	jobs, err := options.JobList([]string{stackFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Arg != stackFile || len(jobs[0].Deps) != 1 || jobs[0].Deps[0] != 1 {
+		t.Fatalf("jobs: %v", jobs)
+	}
+	if len(jobs[1].Env) != 1 || jobs[1].Env[0] != stackInstanceEnv+"=db" {
+		t.Fatalf("env: %v", jobs[1].Env)
+	}
+	t.Setenv(stackInstanceEnv, "db")
+	instances, err = options.InstanceList(false, stackFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].Name != "db" {
+		t.Fatalf("selected: %v", instances)
+	}
+}
+
+func TestStackDuplicateName(t *testing.T) {
+	dir := t.TempDir()
+	stackFile := filepath.Join(dir, "stack.yaml")
+	writeTestFile(t, stackFile, `#lxdops-stack
+instances:
+- config: a.yaml
+- config: x/a.yaml
+`)
+	_, err := ReadStack(stackFile)
+	if err == nil {
+		t.Fatal("expected duplicate instance error")
+	}
+}
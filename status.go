@@ -0,0 +1,285 @@
+package lxdops
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
+	"melato.org/lxdops/yaml"
+	"melato.org/table3"
+)
+
+// Instance status values
+const (
+	// StatusOK means that the instance matches its config
+	StatusOK = "OK"
+	// StatusDrift means that the instance exists, but it differs from its config
+	StatusDrift = "DRIFT"
+	// StatusMissing means that the container, its instance profile, or some of its filesystems do not exist
+	StatusMissing = "MISSING"
+)
+
+// InstanceStatus compares an instance with its config
+type InstanceStatus struct {
+	Instance  string `json:"instance" yaml:"instance"`
+	Project   string `json:"project" yaml:"project"`
+	Container string `json:"container" yaml:"container"`
+	// Status is OK, DRIFT, or MISSING
+	Status string `json:"status" yaml:"status"`
+	// State is the container status, such as Running or Stopped, or empty if the container does not exist
+	State string `json:"state" yaml:"state"`
+	IPv4  string `json:"ipv4,omitempty" yaml:"ipv4,omitempty"`
+	// ProfilesOK is true if the container has the config profiles, in order, as "profile diff" computes them
+	ProfilesOK              bool     `json:"profiles-ok" yaml:"profiles-ok"`
+	ProfilesOnlyInConfig    []string `json:"profiles-only-in-config,omitempty" yaml:"profiles-only-in-config,omitempty"`
+	ProfilesOnlyInContainer []string `json:"profiles-only-in-container,omitempty" yaml:"profiles-only-in-container,omitempty"`
+	// DevicesOK is true if the devices of the instance profile are the configured devices
+	DevicesOK bool `json:"devices-ok" yaml:"devices-ok"`
+	// DeviceChanges describe the differences between the configured devices and the devices of the instance profile
+	DeviceChanges []string `json:"device-changes,omitempty" yaml:"device-changes,omitempty"`
+	// MissingFilesystems are the ids of the filesystems that do not exist
+	MissingFilesystems []string `json:"missing-filesystems,omitempty" yaml:"missing-filesystems,omitempty"`
+	// MissingDevices are the names of the devices whose directories do not exist
+	MissingDevices []string `json:"missing-devices,omitempty" yaml:"missing-devices,omitempty"`
+	// Snapshot is the name of the latest snapshot of the instance filesystems or container
+	Snapshot        string     `json:"snapshot,omitempty" yaml:"snapshot,omitempty"`
+	SnapshotCreated *time.Time `json:"snapshot-created,omitempty" yaml:"snapshot-created,omitempty"`
+}
+
+// Status prints the status of instances: whether their containers, filesystems, devices, and profiles match their config.
+type Status struct {
+	ConfigOptions
+	Format string `name:"format" usage:"output format: table | yaml | json"`
+	// Host runs host commands.  If nil, a ScriptRunner is used.
+	Host   HostRunner         `name:"-"`
+	Client *lxdutil.LxdClient `name:"-"`
+	// Now is used for computing snapshot ages.  If zero, the current time is used.
+	Now time.Time `name:"-"`
+}
+
+func (t *Status) Init() error {
+	t.Format = "table"
+	return t.ConfigOptions.Init()
+}
+
+func (t *Status) Configured() error {
+	switch t.Format {
+	case "table", "yaml", "json":
+	default:
+		return fmt.Errorf("unrecognized format: %s", t.Format)
+	}
+	return t.ConfigOptions.Configured()
+}
+
+func (t *Status) host() HostRunner {
+	if t.Host == nil {
+		return &ScriptRunner{}
+	}
+	return t.Host
+}
+
+// ipv4 returns the first global inet address of a container
+func ipv4(state *api.InstanceState) string {
+	for _, net := range state.Network {
+		for _, a := range net.Addresses {
+			if a.Family == "inet" && a.Scope == "global" {
+				return a.Address
+			}
+		}
+	}
+	return ""
+}
+
+// InstanceStatus computes the status of an instance
+func (t *Status) InstanceStatus(instance *Instance) (*InstanceStatus, error) {
+	server, err := t.Client.ProjectServer(instance.Config.Project)
+	if err != nil {
+		return nil, err
+	}
+	container := instance.Container()
+	status := &InstanceStatus{Instance: instance.Name, Project: instance.Config.Project, Container: container,
+		ProfilesOK: true, DevicesOK: true}
+	missing := false
+
+	plan := &Plan{Client: t.Client}
+	fsPlan := &InstancePlan{}
+	err = plan.planFilesystems(instance, fsPlan)
+	if err != nil {
+		return nil, err
+	}
+	for _, action := range fsPlan.Actions {
+		switch action.Kind {
+		case "filesystem":
+			status.MissingFilesystems = append(status.MissingFilesystems, action.Name)
+		case "device":
+			status.MissingDevices = append(status.MissingDevices, action.Name)
+		}
+	}
+	if len(status.MissingFilesystems) > 0 {
+		missing = true
+	}
+
+	profileName := instance.ProfileName()
+	if profileName != "" && instance.Config.Devices != nil {
+		devices, err := instance.NewDeviceMap()
+		if err != nil {
+			return nil, err
+		}
+		profile, _, err := server.GetProfile(profileName)
+		if api.StatusErrorCheck(err, http.StatusNotFound) {
+			missing = true
+			status.DevicesOK = false
+		} else if err != nil {
+			return nil, lxdutil.AnnotateLXDError(profileName, err)
+		} else {
+			devicePlan := &InstancePlan{}
+			devicePlan.DiffProfile(profileName, api.ProfilePut{Devices: devices}, api.ProfilePut{Devices: profile.Devices})
+			for _, action := range devicePlan.Actions {
+				status.DeviceChanges = append(status.DeviceChanges, action.String())
+			}
+			status.DevicesOK = len(status.DeviceChanges) == 0
+		}
+	}
+
+	c, _, err := server.GetInstance(container)
+	if api.StatusErrorCheck(err, http.StatusNotFound) {
+		missing = true
+		status.ProfilesOK = false
+	} else if err != nil {
+		return nil, lxdutil.AnnotateLXDError(container, err)
+	} else {
+		status.State = c.Status
+		state, _, err := server.GetInstanceState(container)
+		if err == nil {
+			status.IPv4 = ipv4(state)
+		}
+		// compare with the profiles that launch and apply give the container
+		diff := diffProfiles(instance.ContainerProfiles(), c.Profiles)
+		status.ProfilesOK = diff.Equal()
+		status.ProfilesOnlyInConfig = diff.OnlyInConfig
+		status.ProfilesOnlyInContainer = diff.OnlyInContainer
+	}
+
+	finder := &SnapshotFinder{Host: t.host(), Client: t.Client}
+	snapshots, err := finder.FilesystemSnapshots(instance)
+	if err != nil {
+		return nil, err
+	}
+	if status.State != "" {
+		snapshots[ContainerSnapshotId], err = finder.ContainerSnapshots(instance)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if summaries := SummarizeSnapshots(snapshots); len(summaries) > 0 {
+		latest := summaries[len(summaries)-1]
+		status.Snapshot = latest.Name
+		if !latest.Created.IsZero() {
+			status.SnapshotCreated = &latest.Created
+		}
+	}
+
+	switch {
+	case missing:
+		status.Status = StatusMissing
+	case !status.ProfilesOK || !status.DevicesOK || len(status.MissingDevices) > 0:
+		status.Status = StatusDrift
+	default:
+		status.Status = StatusOK
+	}
+	return status, nil
+}
+
+// snapshotAge formats the age of a snapshot, in days, hours, or minutes
+func snapshotAge(created *time.Time, now time.Time) string {
+	if created == nil {
+		return "-"
+	}
+	age := now.Sub(*created)
+	switch {
+	case age >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(age.Hours()/24))
+	case age >= time.Hour:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	}
+}
+
+func (t *Status) writeTable(w io.Writer, list []*InstanceStatus) {
+	now := t.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	writer := &table.FixedWriter{Writer: w}
+	var s *InstanceStatus
+	check := func(ok bool) string {
+		if ok {
+			return "ok"
+		}
+		return "diff"
+	}
+	orDash := func(v string) string {
+		if v == "" {
+			return "-"
+		}
+		return v
+	}
+	writer.Columns(
+		table.NewColumn("INSTANCE", func() interface{} { return s.Instance }),
+		table.NewColumn("STATUS", func() interface{} { return s.Status }),
+		table.NewColumn("STATE", func() interface{} { return orDash(s.State) }),
+		table.NewColumn("IPV4", func() interface{} { return orDash(s.IPv4) }),
+		table.NewColumn("PROFILES", func() interface{} { return check(s.ProfilesOK) }),
+		table.NewColumn("DEVICES", func() interface{} { return check(s.DevicesOK) }),
+		table.NewColumn("MISSING", func() interface{} {
+			return orDash(strings.Join(append(append([]string(nil), s.MissingFilesystems...), s.MissingDevices...), ","))
+		}),
+		table.NewColumn("SNAPSHOT", func() interface{} { return orDash(s.Snapshot) }),
+		table.NewColumn("AGE", func() interface{} { return snapshotAge(s.SnapshotCreated, now) }),
+	)
+	for _, s = range list {
+		writer.WriteRow()
+	}
+	writer.End()
+}
+
+// Write writes the status of instances in the configured format
+func (t *Status) Write(w io.Writer, list []*InstanceStatus) error {
+	switch t.Format {
+	case "yaml":
+		return yaml.Write(w, list)
+	case "json":
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	default:
+		t.writeTable(w, list)
+		return nil
+	}
+}
+
+// Run prints the status of the instances of config or stack files
+func (t *Status) Run(configs []string) error {
+	instances, err := t.InstanceList(false, configs...)
+	if err != nil {
+		return err
+	}
+	list := make([]*InstanceStatus, len(instances))
+	for i, instance := range instances {
+		list[i], err = t.InstanceStatus(instance)
+		if err != nil {
+			return fmt.Errorf("%s: %w", instance.Name, err)
+		}
+	}
+	return t.Write(os.Stdout, list)
+}
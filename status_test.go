@@ -0,0 +1,127 @@
+package lxdops
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+)
+
+func TestStatus(t *testing.T) {
+	x := newLauncherTest()
+	dir := t.TempDir()
+	config := newLaunchConfig()
+	config.Filesystems["root"].Pattern = Pattern(dir + "/(instance)")
+	status := &Status{Client: x.Launcher.Client, Host: x.Host, Format: "table"}
+	instance, err := NewInstance(nil, config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := status.InstanceStatus(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Status != StatusMissing || s.State != "" || len(s.MissingFilesystems) != 1 {
+		t.Fatalf("before launch: %v", s)
+	}
+
+	err = x.Launcher.LaunchContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fake host does not create directories
+	err = os.MkdirAll(filepath.Join(dir, "a", "home"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.Server.CreateInstanceSnapshot("a", api.InstanceSnapshotsPost{Name: "s1"})
+	s, err = status.InstanceStatus(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Status != StatusOK || s.State != "Running" || s.IPv4 == "" || s.Snapshot != "s1" {
+		t.Fatalf("after launch: %v", s)
+	}
+
+	x.Server.Instance("a").Profiles = []string{"a.lxdops", "base"}
+	x.Server.Profile("a.lxdops").Devices["home"]["readonly"] = "true"
+	s, err = status.InstanceStatus(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Status != StatusDrift || s.ProfilesOK || s.DevicesOK || len(s.DeviceChanges) != 1 {
+		t.Fatalf("drift: %v", s)
+	}
+
+	for _, format := range []string{"table", "yaml", "json"} {
+		var buf bytes.Buffer
+		status.Format = format
+		err = status.Write(&buf, []*InstanceStatus{s})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), StatusDrift) {
+			t.Errorf("%s: %s", format, buf.String())
+		}
+	}
+}
+
+func TestStatusServerError(t *testing.T) {
+	for _, method := range []string{"GetProfile", "GetInstance"} {
+		x := newLauncherTest()
+		x.Launcher.Client.SetRootServer(&failingServer{Server: x.Server, Methods: []string{method}})
+		instance, err := NewInstance(nil, newLaunchConfig(), "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := &Status{Client: x.Launcher.Client, Host: x.Host}
+		_, err = status.InstanceStatus(instance)
+		if err == nil {
+			t.Errorf("%s: status treated a server error as a missing resource", method)
+		}
+	}
+}
+
+func TestSnapshotAge(t *testing.T) {
+	now := time.Unix(100000000, 0)
+	created := now.Add(-50 * time.Hour)
+	if age := snapshotAge(&created, now); age != "2d" {
+		t.Errorf("age: %s", age)
+	}
+	if age := snapshotAge(nil, now); age != "-" {
+		t.Errorf("age: %s", age)
+	}
+}
+
+func TestStatusDefaultProfile(t *testing.T) {
+	x := newLauncherTest()
+	dir := t.TempDir()
+	config := newLaunchConfig()
+	config.Profiles = nil
+	config.Filesystems["root"].Pattern = Pattern(dir + "/(instance)")
+	instance, err := NewInstance(nil, config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "a", "home"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := &Status{Client: x.Launcher.Client, Host: x.Host}
+	s, err := status.InstanceStatus(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the container has the default profile, as launch and plan expect
+	if s.Status != StatusOK || !s.ProfilesOK {
+		t.Fatalf("status: %v", s)
+	}
+}
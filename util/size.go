@@ -0,0 +1,20 @@
+package util
+
+import (
+	"fmt"
+)
+
+// FormatSize formats a number of bytes using binary units, similarly to zfs list, for example 1.50G
+func FormatSize(size int64) string {
+	const units = "KMGTPE"
+	if size < 1024 {
+		return fmt.Sprintf("%dB", size)
+	}
+	value := float64(size)
+	var unit byte
+	for i := 0; i < len(units) && value >= 1024; i++ {
+		value /= 1024
+		unit = units[i]
+	}
+	return fmt.Sprintf("%.2f%c", value, unit)
+}
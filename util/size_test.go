@@ -0,0 +1,24 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestFormatSize(t *testing.T) {
+	cases := []struct {
+		Size     int64
+		Expected string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.00K"},
+		{3 * 1024 * 1024 / 2, "1.50M"},
+		{5 << 30, "5.00G"},
+	}
+	for _, c := range cases {
+		s := FormatSize(c.Size)
+		if s != c.Expected {
+			t.Errorf("%d: %s expected: %s", c.Size, s, c.Expected)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package lxdops
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
+)
+
+// customVolume is the LXD storage volume type of volume filesystems
+const customVolume = "custom"
+
+// VolumeOps creates, copies, snapshots, and deletes volume filesystems, using the LXD API.
+// It does not need access to the LXD host, so it works with remote LXD servers and clusters.
+type VolumeOps struct {
+	Server lxd.InstanceServer
+	Trace  bool
+	DryRun bool
+}
+
+// NewVolumeOps returns a VolumeOps for the given project.
+func NewVolumeOps(client *lxdutil.LxdClient, project string) (*VolumeOps, error) {
+	if client == nil {
+		return nil, errors.New("volume filesystems require an LXD client")
+	}
+	server, err := client.ProjectServer(project)
+	if err != nil {
+		return nil, err
+	}
+	return &VolumeOps{Server: server}, nil
+}
+
+// VolumeList returns the volume filesystems of the instance, sorted by name.
+func (t *Instance) VolumeList() ([]*InstanceFS, error) {
+	filesystems, err := t.FilesystemList()
+	if err != nil {
+		return nil, err
+	}
+	var volumes []*InstanceFS
+	for _, fs := range filesystems {
+		if fs.IsVolume() {
+			volumes = append(volumes, fs)
+		}
+	}
+	return volumes, nil
+}
+
+func (t *VolumeOps) wait(fs *InstanceFS, op lxd.Operation, err error) error {
+	if err == nil {
+		err = op.Wait()
+	}
+	return lxdutil.AnnotateLXDError(fs.VolumeName(), err)
+}
+
+// Exists returns true if the volume exists.
+// It returns an error if the volume cannot be queried, for any other reason than that it is not found.
+func (t *VolumeOps) Exists(fs *InstanceFS) (bool, error) {
+	_, _, err := t.Server.GetStoragePoolVolume(fs.Pool, customVolume, fs.Path)
+	if err == nil {
+		return true, nil
+	}
+	if api.StatusErrorCheck(err, http.StatusNotFound) {
+		return false, nil
+	}
+	return false, lxdutil.AnnotateLXDError(fs.VolumeName(), err)
+}
+
+// Create creates an empty volume, with the VolumeConfig of its Filesystem.
+func (t *VolumeOps) Create(fs *InstanceFS) error {
+	if t.Trace {
+		fmt.Printf("create volume %s\n", fs.VolumeName())
+	}
+	if t.DryRun {
+		return nil
+	}
+	post := api.StorageVolumesPost{Name: fs.Path, Type: customVolume}
+	post.Config = fs.Filesystem.VolumeConfig
+	err := t.Server.CreateStoragePoolVolume(fs.Pool, post)
+	return lxdutil.AnnotateLXDError(fs.VolumeName(), err)
+}
+
+// Copy creates a volume by copying another volume, or a snapshot of it, if snapshot is not empty.
+// The source volume is in sourceServer, which may be in a different project.
+// Snapshots of the source are not copied.
+func (t *VolumeOps) Copy(fs *InstanceFS, sourceServer lxd.InstanceServer, source *InstanceFS, snapshot string) error {
+	name := source.Path
+	if snapshot != "" {
+		name += "/" + snapshot
+	}
+	if t.Trace {
+		fmt.Printf("copy volume %s/%s %s\n", source.Pool, name, fs.VolumeName())
+	}
+	if t.DryRun {
+		return nil
+	}
+	volume := api.StorageVolume{Name: name, Type: customVolume}
+	args := &lxd.StoragePoolVolumeCopyArgs{Name: fs.Path, VolumeOnly: true}
+	op, err := t.Server.CopyStoragePoolVolume(fs.Pool, sourceServer, source.Pool, volume, args)
+	if err == nil {
+		err = op.Wait()
+	}
+	return lxdutil.AnnotateLXDError(fs.VolumeName(), err)
+}
+
+func (t *VolumeOps) Snapshot(fs *InstanceFS, snapshot string) error {
+	if t.Trace {
+		fmt.Printf("snapshot volume %s %s\n", fs.VolumeName(), snapshot)
+	}
+	if t.DryRun {
+		return nil
+	}
+	op, err := t.Server.CreateStoragePoolVolumeSnapshot(fs.Pool, customVolume, fs.Path, api.StorageVolumeSnapshotsPost{Name: snapshot})
+	return t.wait(fs, op, err)
+}
+
+// Restore restores a volume from one of its snapshots.
+func (t *VolumeOps) Restore(fs *InstanceFS, snapshot string) error {
+	if t.Trace {
+		fmt.Printf("restore volume %s %s\n", fs.VolumeName(), snapshot)
+	}
+	if t.DryRun {
+		return nil
+	}
+	volume, etag, err := t.Server.GetStoragePoolVolume(fs.Pool, customVolume, fs.Path)
+	if err != nil {
+		return lxdutil.AnnotateLXDError(fs.VolumeName(), err)
+	}
+	put := volume.StorageVolumePut
+	put.Restore = snapshot
+	err = t.Server.UpdateStoragePoolVolume(fs.Pool, customVolume, fs.Path, put, etag)
+	return lxdutil.AnnotateLXDError(fs.VolumeName(), err)
+}
+
+func (t *VolumeOps) DeleteSnapshot(fs *InstanceFS, snapshot string) error {
+	if t.Trace {
+		fmt.Printf("delete volume snapshot %s %s\n", fs.VolumeName(), snapshot)
+	}
+	if t.DryRun {
+		return nil
+	}
+	op, err := t.Server.DeleteStoragePoolVolumeSnapshot(fs.Pool, customVolume, fs.Path, snapshot)
+	return t.wait(fs, op, err)
+}
+
+// Delete deletes a volume and its snapshots.
+func (t *VolumeOps) Delete(fs *InstanceFS) error {
+	if t.Trace {
+		fmt.Printf("delete volume %s\n", fs.VolumeName())
+	}
+	if t.DryRun {
+		return nil
+	}
+	err := t.Server.DeleteStoragePoolVolume(fs.Pool, customVolume, fs.Path)
+	return lxdutil.AnnotateLXDError(fs.VolumeName(), err)
+}
+
+func (t *VolumeOps) Rename(fs *InstanceFS, newName string) error {
+	if t.Trace {
+		fmt.Printf("rename volume %s %s\n", fs.VolumeName(), newName)
+	}
+	if t.DryRun {
+		return nil
+	}
+	err := t.Server.RenameStoragePoolVolume(fs.Pool, customVolume, fs.Path, api.StorageVolumePost{Name: newName})
+	return lxdutil.AnnotateLXDError(fs.VolumeName(), err)
+}
+
+// RestoreInstance restores the non-transient volumes of an instance from a snapshot.
+func (t *VolumeOps) RestoreInstance(instance *Instance, snapshot string) error {
+	volumes, err := instance.VolumeList()
+	if err != nil {
+		return err
+	}
+	for _, fs := range volumes {
+		if fs.Filesystem.Transient {
+			continue
+		}
+		err := t.Restore(fs, snapshot)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package lxdops
+
+import (
+	"testing"
+
+	"github.com/canonical/lxd/shared/api"
+	"melato.org/lxdops/lxdutil"
+	"melato.org/lxdops/lxdutil/lxdtest"
+)
+
+func newVolumeConfig() *Config {
+	config := newLaunchConfig()
+	config.Filesystems["data"] = &Filesystem{Pattern: "(instance)-data", Pool: "p", Destroy: true,
+		VolumeConfig: map[string]string{"size": "1GiB"}}
+	config.Devices["data"] = &Device{Path: "/data", Filesystem: "data"}
+	return config
+}
+
+func TestVolumeExists(t *testing.T) {
+	server := lxdtest.NewServer()
+	server.AddVolume("p", "a-data", api.StorageVolumePut{})
+	instance, err := NewInstance(nil, newVolumeConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filesystems, err := instance.Filesystems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := filesystems["data"]
+	volumes := &VolumeOps{Server: server}
+	exists, err := volumes.Exists(fs)
+	if err != nil || !exists {
+		t.Errorf("exists: %v %v", exists, err)
+	}
+	server.DeleteStoragePoolVolume("p", customVolume, "a-data")
+	exists, err = volumes.Exists(fs)
+	if err != nil || exists {
+		t.Errorf("deleted: %v %v", exists, err)
+	}
+	volumes.Server = &failingServer{Server: server, Methods: []string{"GetStoragePoolVolume"}}
+	_, err = volumes.Exists(fs)
+	if err == nil {
+		t.Errorf("server error was treated as a missing volume")
+	}
+}
+
+func TestVolumeLaunch(t *testing.T) {
+	x := newLauncherTest()
+	instance, err := NewInstance(nil, newVolumeConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := x.Server.Volume("p", "a-data")
+	if volume == nil {
+		t.Fatalf("missing volume")
+	}
+	if volume.Config["size"] != "1GiB" {
+		t.Errorf("volume config: %v", volume.Config)
+	}
+	data := x.Server.Profile("a.lxdops").Devices["data"]
+	if data["type"] != "disk" || data["path"] != "/data" || data["pool"] != "p" || data["source"] != "a-data" {
+		t.Errorf("data device: %v", data)
+	}
+	// the volume has no host directory
+	verifyCommands(t, x.Host.Commands,
+		"sudo zfs create -p z/test/a",
+		"sudo mkdir -p /z/test/a/home",
+		"lxc --project default init images:alpine/3.18 -p base -p a.lxdops a",
+	)
+}
+
+func TestVolumeSnapshot(t *testing.T) {
+	x := newLauncherTest()
+	x.Server.AddVolume("p", "a-data", api.StorageVolumePut{})
+	instance, err := NewInstance(nil, newVolumeConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &RecordingRunner{}
+	snapshot := &Snapshot{Host: host, Client: x.Launcher.Client}
+	snapshot.Snapshot = "s1"
+	err = snapshot.Run(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyCommands(t, host.Commands, "sudo zfs snapshot z/test/a@s1")
+	if x.Server.Volume("p", "a-data").Snapshots["s1"] == nil {
+		t.Fatalf("missing volume snapshot")
+	}
+
+	host.Output = map[string][]string{
+		"zfs list -H -p -t snapshot -o name,used,creation,clones -d 1 z/test/a": {"z/test/a@s1\t0\t1690000000\t-"},
+	}
+	rollback := &Rollback{Host: host, Client: x.Launcher.Client, Snapshot: "s1"}
+	err = rollback.Run(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Server.Volume("p", "a-data").Restored != "s1" {
+		t.Errorf("volume was not restored")
+	}
+
+	snapshot.Destroy = true
+	err = snapshot.Run(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(x.Server.Volume("p", "a-data").Snapshots) != 0 {
+		t.Errorf("volume snapshot was not deleted")
+	}
+}
+
+func TestVolumeClone(t *testing.T) {
+	x := newLauncherTest()
+	x.Server.AddVolume("p", "t-data", api.StorageVolumePut{}).Snapshots["copy"] = &api.StorageVolumeSnapshot{Name: "copy"}
+	config := newVolumeConfig()
+	instance, err := NewInstance(nil, config, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin, err := NewInstance(nil, config, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &DeviceConfigurer{Config: config, Host: &RecordingRunner{}, Client: x.Launcher.Client}
+	err = dev.CreateFilesystems(instance, origin, "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := x.Server.Volume("p", "a-data")
+	if volume == nil || volume.Source != "p/t-data/copy" {
+		t.Errorf("volume was not copied from snapshot: %v", volume)
+	}
+}
+
+func TestVolumeDestroy(t *testing.T) {
+	x := newLauncherTest()
+	instance, err := NewInstance(nil, newVolumeConfig(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.LaunchContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lxdutil.InstanceServer{Server: x.Server}.StopContainer("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.Launcher.DestroyContainer(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Server.Volume("p", "a-data") != nil {
+		t.Errorf("volume was not deleted")
+	}
+}
+
+func TestVolumeDeviceDir(t *testing.T) {
+	config := newVolumeConfig()
+	config.Devices["data"].Dir = "sub"
+	if config.verifyDevices() {
+		t.Errorf("accepted volume device with dir")
+	}
+}